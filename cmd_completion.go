@@ -55,7 +55,9 @@ Options:
 }
 
 func cmdCompletion() error {
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
 	args := pflag.Args()[1:]
 	if fHelp || len(args) == 0 || len(args) > 1 {
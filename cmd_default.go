@@ -24,15 +24,32 @@ Options:
   General:
     --nocolor
       disable colored output.
+    --error-format <text | json>
+      how errors are printed on stderr. "json" prints each error as an
+      object with "error", "code" and "kind" keys.
+      available in all commands, before or after the command name.
+      default: text.
     --help, -h
       show help.
+
+Exit Codes:
+  0  success.
+  1  unclassified failure.
+  2  invalid flags or arguments.
+  3  a file couldn't be opened, read or written.
+  4  an mmdb file is corrupt or invalid.
+  5  diff found differences.
+  6  partial failure; some inputs failed and were skipped.
+  130  interrupted by SIGINT or SIGTERM; partial output files are removed.
 `, progBase)
 }
 
 func cmdDefault() (err error) {
 	pflag.BoolVarP(&fHelp, "help", "h", false, "show help.")
 	pflag.BoolVar(&fNoColor, "nocolor", false, "disable colored output.")
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
 	if fNoColor {
 		color.NoColor = true
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ipinfo/cli/lib/complete"
@@ -17,6 +18,8 @@ var completionsDiff = &complete.Command{
 		"--subnets": predict.Nothing,
 		"-r":        predict.Nothing,
 		"--records": predict.Nothing,
+		"-q":        predict.Nothing,
+		"--quiet":   predict.Nothing,
 	},
 }
 
@@ -32,6 +35,11 @@ Options:
   General:
     --help, -h
       show help.
+    --quiet, -q
+      don't report progress on stderr.
+      progress is redrawn in place on a terminal, and logged periodically
+      otherwise.
+      default: false.
     --subnets, -s
       show subnets difference.
     --records, -r
@@ -39,10 +47,12 @@ Options:
 `, progBase)
 }
 
-func cmdDiff() error {
+func cmdDiff(ctx context.Context) error {
 	f := lib.CmdDiffFlags{}
 	f.Init()
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
-	return lib.CmdDiff(f, pflag.Args()[1:], printHelpDiff)
+	return lib.CmdDiffContext(ctx, f, pflag.Args()[1:], printHelpDiff)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ipinfo/mmdbctl/lib"
@@ -10,17 +11,70 @@ import (
 	"github.com/spf13/pflag"
 )
 
-var predictFormats = []string{"csv", "tsv", "json"}
+var predictFormats = []string{
+	"csv", "tsv", "json", "parquet", "sql", "pgcopy", "clickhouse", "es-bulk",
+	"geojson", "nginx-geo", "haproxy-map", "ipset", "nftables-set",
+}
+var predictDialects = []string{"postgres", "sqlite", "mysql"}
+var predictDocIDs = []string{"prefix", "none"}
+
+var predictComputed = []string{
+	"start_ip",
+	"end_ip",
+	"prefix_len",
+	"num_addresses",
+	"ip_version",
+	"start_ip_decimal",
+	"end_ip_decimal",
+	"offset",
+}
 
 var completionsExport = &complete.Command{
 	Flags: map[string]complete.Predictor{
-		"-h":          predict.Nothing,
-		"--help":      predict.Nothing,
-		"-o":          predict.Nothing,
-		"--out":       predict.Nothing,
-		"-f":          predict.Set(predictFormats),
-		"--format":    predict.Set(predictFormats),
-		"--no-header": predict.Nothing,
+		"-h":                predict.Nothing,
+		"--help":            predict.Nothing,
+		"-o":                predict.Nothing,
+		"--out":             predict.Nothing,
+		"-f":                predict.Set(predictFormats),
+		"--format":          predict.Set(predictFormats),
+		"--dialect":         predict.Set(predictDialects),
+		"--table":           predict.Nothing,
+		"--value-field":     predict.Nothing,
+		"--set-name":        predict.Nothing,
+		"--index":           predict.Nothing,
+		"--doc-id":          predict.Set(predictDocIDs),
+		"--mapping":         predict.Files("*.json"),
+		"--ddl":             predict.Files("*.sql"),
+		"--coords":          predict.Nothing,
+		"--geojson-seq":     predict.Nothing,
+		"--per-location":    predict.Nothing,
+		"--no-header":       predict.Nothing,
+		"--fields":          predict.Nothing,
+		"--flatten":         predict.Nothing,
+		"--array-delim":     predict.Nothing,
+		"--typed-header":    predict.Nothing,
+		"--tsv-escape":      predict.Nothing,
+		"--within":          predict.Nothing,
+		"--ipv4-only":       predict.Nothing,
+		"--ipv6-only":       predict.Nothing,
+		"--where":           predict.Nothing,
+		"--ranges":          predict.Nothing,
+		"--decimal":         predict.Nothing,
+		"--computed":        predict.Set(predictComputed),
+		"--include-aliased": predict.Nothing,
+		"--include-empty":   predict.Nothing,
+		"--ipv4-as-mapped":  predict.Nothing,
+		"--ipv4-native":     predict.Nothing,
+		"--normalized":      predict.Nothing,
+		"--cache-size":      predict.Nothing,
+		"--workers":         predict.Nothing,
+		"--shards":          predict.Nothing,
+		"--shard-files":     predict.Nothing,
+		"--split-by":        predict.Nothing,
+		"--out-dir":         predict.Dirs("*"),
+		"--max-open-files":  predict.Nothing,
+		"-q":                predict.Nothing,
+		"--quiet":           predict.Nothing,
 	},
 }
 
@@ -32,29 +86,262 @@ Options:
   General:
     --help, -h
       show help.
+    --quiet, -q
+      don't report progress on stderr.
+      progress is redrawn in place on a terminal, and logged periodically
+      otherwise.
+      default: false.
+    --cache-size <n>
+      the number of decoded entries kept in memory, for the many networks
+      which usually share the same data. the least recently used are
+      evicted, bounding memory use on databases with many unique entries.
+      default: 65536.
+    --workers <n>
+      the number of goroutines decoding and formatting entries in parallel
+      for the csv, tsv and json formats. the output is the same, in network
+      order.
+      default: 1.
+    --shards <n>
+      split the address space into <n> parts, exported concurrently and
+      written out in order. parts without networks are left out and single
+      networks aren't split, so there may be fewer. only csv, tsv and json
+      shards can be merged into one output; the others need --shard-files.
+      ranges aren't merged across shards.
+      default: 1.
+    --shard-files
+      write each shard to its own file, named after the output file, e.g.
+      out.0001.csv, out.0002.csv, ..., for -o out.csv.
+      default: false.
 
   Input/Output:
     -o <fname>, --out <fname>
       output file name. (e.g. out.csv)
       default: <out_file> if specified, otherwise stdout.
+    --normalized
+      write each unique record once, instead of once per network: the
+      networks go to <name>.networks.<ext> with the record_id of their data,
+      and the data to <name>.records.<ext> with its record_id, e.g.
+      geo.networks.csv and geo.records.csv for -o geo.csv. the record_id is
+      the offset of the data in the data section, and is empty for networks
+      without data. only csv, tsv and json are supported.
+      default: false.
+    --split-by <field>
+      write the networks of each value of <field> to a file of their own in
+      --out-dir, named after the value with the format as extension, e.g.
+      US.csv and DE.csv for --split-by country. each file has a header.
+      nested values are selected by their dotted paths, as for --fields,
+      and networks without a value are left out. only csv, tsv and json
+      are supported.
+      default: none.
+    --out-dir <dir>
+      the directory the files of --split-by are written to, created if
+      needed.
+      default: none.
+    --max-open-files <n>
+      the number of files of --split-by kept open at once. the least
+      recently written is closed once another is needed, and reopened to
+      append to.
+      default: 128.
+
+  Filters:
+    --within <cidr1,cidr2,...>
+      only export networks within these networks. networks larger than one
+      of these are clipped to it.
+      default: the whole database.
+    --ipv4-only
+      only export IPv4 networks.
+      default: false.
+    --ipv6-only
+      only export IPv6 networks.
+      default: false.
+    --include-aliased
+      include networks which alias the IPv4 networks of an IPv6 database,
+      e.g. ::ffff:0:0/96 and 2002::/16. they're skipped by default.
+      can't be combined with --ipv4-as-mapped or --ipv4-native.
+      default: false.
+    --include-empty
+      include networks without data, as entries with empty fields.
+      default: false.
+    --where <expr>
+      only export networks whose data satisfies <expr>, e.g.
+        'country == "US" && asn != 0'
+      fields are compared with ==, !=, <, <=, > and >= against a quoted
+      string, a number, true, false or null, and comparisons are combined
+      with &&, || and !, grouped with parentheses. integer fields are
+      compared with numbers exactly, and float fields as floats. nested
+      fields are named by their dotted paths, e.g. location.latitude. a
+      field on its own is true if it's set and not empty, zero or false.
+      default: none.
 
   Format:
+    --ipv4-as-mapped
+      write IPv4 networks as IPv4-mapped IPv6 networks, e.g.
+      ::ffff:1.0.0.0/120.
+      default: false.
+    --ipv4-native
+      write IPv4-mapped IPv6 networks as IPv4 networks, e.g. 1.0.0.0/24.
+      default: false; networks of the IPv4 subtree of an IPv6 database are
+      written as IPv4, and its aliases as IPv6.
     -f <format>, --format <format>
       the output file format.
-      can be "csv", "tsv" or "json".
+      can be "csv", "tsv", "json", "parquet", "sql", "pgcopy", "clickhouse",
+      "es-bulk", "geojson", "nginx-geo", "haproxy-map", "ipset" or
+      "nftables-set".
+      parquet, sql and clickhouse columns are typed after the mmdb types of the data,
+      which takes an extra pass over the database to discover. fields whose
+      values don't share a type are written as strings.
+        parquet: nested maps become groups and arrays become lists. import
+          the output with "import --parquet".
+        sql: a CREATE TABLE statement followed by batched INSERT statements
+          in a transaction, in the --dialect. nested data is JSON.
+        pgcopy: a psql script with a CREATE TABLE statement and the rows in
+          COPY text format. networks are typed cidr, IPs inet and nested
+          data jsonb.
+        clickhouse: TSV for a ClickHouse ip_trie dictionary, with the
+          network in a prefix column. see --ddl for the dictionary.
+        es-bulk: Elasticsearch/OpenSearch bulk API requests, indexing a
+          document per network with the network in a "range" field of type
+          ip_range, followed by the data as for json. post the output to
+          the _bulk endpoint.
+        geojson: a FeatureCollection of a Point feature per network at the
+          --coords of its data, with the range and fields as properties as
+          for json. networks without coordinates are left out.
+        nginx-geo, haproxy-map: the entries of an nginx geo block, or an
+          HAProxy map file, mapping networks to their --value-field.
+        ipset, nftables-set: an "ipset restore" script, or nftables set
+          declarations to include in a table, of the networks; IPv4
+          networks go to the <--set-name>_v4 set and IPv6 networks to the
+          <--set-name>_v6 set.
+        these config formats aggregate adjacent networks with the same
+        value into the fewest CIDRs covering them.
       default: csv if output file ends in ".csv", tsv if ".tsv",
-      json if ".json", otherwise csv.
+      json if ".json", parquet if ".parquet", sql if ".sql", geojson if
+      ".geojson", otherwise csv.
+    --dialect <postgres | sqlite | mysql>
+      the SQL dialect of the sql format.
+      default: postgres.
+    --table <name>
+      the table name of the sql and pgcopy formats, or the dictionary name
+      of the clickhouse format.
+      default: networks.
+    --ddl <fname>
+      with the clickhouse format, also write the CREATE DICTIONARY statement
+      of an ip_trie dictionary loading the output to <fname>, with the
+      attributes typed after the mmdb types of the data. the dictionary's
+      FILE source is the output file name, which must be copied to the
+      user_files directory of the server.
+      default: none.
+    --index <name>
+      the index the documents of the es-bulk format are indexed into.
+      default: networks.
+    --doc-id <prefix | none>
+      the document IDs of the es-bulk format: the network, or the start and
+      end IPs of a merged --ranges entry; or none, letting Elasticsearch
+      generate them.
+      default: prefix.
+    --mapping <fname>
+      with the es-bulk format, also write the index mapping of the documents
+      to <fname>, typed after the mmdb types of the data. this takes an
+      extra pass over the database to discover.
+      default: none.
+    --coords <field> | <lat_field>,<lon_field>
+      the fields holding the coordinates of the geojson format: a single
+      field of "lat,lon" text, like ipinfo's loc, or a latitude and a
+      longitude field, e.g. location.latitude,location.longitude.
+      default: detected in each entry from common names: loc,
+      latitude/longitude, lat/lng, lat/lon and
+      location.latitude/location.longitude.
+    --geojson-seq
+      write the geojson features as a GeoJSON text sequence (RFC 8142), for
+      streaming, instead of a FeatureCollection.
+      default: false.
+    --per-location
+      write a geojson feature per unique location instead of per network,
+      with the networks found at it and their count as properties.
+      default: false.
+    --value-field <field>
+      the field whose value networks are mapped to, for nginx-geo and
+      haproxy-map, which require it; networks without a value are left
+      out. for ipset and nftables-set, only networks whose value is set and
+      not empty, zero or false are members of the sets.
+      nested values are selected by their dotted paths, as for --fields.
+      default: none; for sets, all networks are members.
+    --set-name <name>
+      the name the sets of the ipset and nftables-set formats are named
+      after.
+      default: networks.
+    --ranges
+      merge adjacent networks which have the same data into a single entry,
+      written as start_ip and end_ip instead of range.
+      the output can be imported back with "import --range-multicol".
+      default: false.
+    --decimal
+      with --ranges, write start_ip and end_ip as decimal integers.
+      default: false.
+    --computed <col1,col2,...>
+      add columns computed from the network of each entry, after the range:
+        start_ip, end_ip: the first and last IP.
+        prefix_len: the prefix length; empty for merged --ranges.
+        num_addresses: the number of IPs.
+        ip_version: 4 or 6.
+        start_ip_decimal, end_ip_decimal: start_ip and end_ip as decimal
+          integers.
+        offset: the offset of the data in the data section.
+      these replace data fields with the same names.
+      default: none.
     --no-header
       don't output the header for file formats that include one, like
-      CSV/TSV/JSON.
+      CSV/TSV/JSON. for sql, this leaves out the CREATE TABLE statement, and
+      for pgcopy, everything but the rows. for ipset, it writes just the
+      networks, and for nftables-set just the elements of the sets. for
+      clickhouse, the dictionary loads the rows as TabSeparated instead of
+      TabSeparatedWithNames.
+      default: false.
+    --fields <field1,field2,...>
+      the fields to output, in order, after the range. only these fields are
+      decoded, which is faster than decoding whole records.
+      each field is <path>[:<name>]; <path> selects nested fields and array
+      elements by separating them with ".", e.g. location.latitude or
+      subdivisions.0.iso_code, and <name> renames the field in the output,
+      e.g. country:cc.
+      records missing a field have an empty CSV/TSV cell for it, and leave
+      it out of JSON objects.
+      default: all fields. for CSV/TSV, the columns are all fields found in
+      any record, sorted. this takes an extra pass over the database to
+      discover.
+    --flatten
+      for csv/tsv, expand nested maps and arrays into columns named by their
+      dotted paths (e.g. country.names.en, subdivisions.0.iso_code) instead
+      of JSON strings in a single column.
+      import the output with --unflatten to restore the structure.
+      default: false.
+    --array-delim <delim>
+      with --flatten, join arrays of scalars into a single column with
+      <delim> instead of a column per element.
+      default: none.
+    --typed-header
+      for csv/tsv, annotate the header with the MMDB type of each column
+      (e.g. asn:uint32,lat:float64,is_anycast:bool) and write values exactly:
+      floats with full precision, bytes as base64, and nested data as JSON.
+      fields with values of different types are annotated as "mixed", and
+      empty strings are written as "", as empty values are missing fields.
+      this takes an extra pass over the database to discover the types.
+      import the output with "import --typed-header" to restore the types.
+      default: false.
+    --tsv-escape
+      for tsv, write backslashes, tabs, newlines and carriage returns in
+      values as \\, \t, \n and \r, so that they can't shift columns or
+      split rows. import the output with "import --tsv-escape".
       default: false.
 `, progBase)
 }
 
-func cmdExport() error {
+func cmdExport(ctx context.Context) error {
 	f := lib.CmdExportFlags{}
 	f.Init()
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
-	return lib.CmdExport(f, pflag.Args()[1:], printHelpExport)
+	return lib.CmdExportContext(ctx, f, pflag.Args()[1:], printHelpExport)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ipinfo/cli/lib/complete"
@@ -27,6 +28,7 @@ var completionsImport = &complete.Command{
 		"--tsv":                       predict.Nothing,
 		"-j":                          predict.Nothing,
 		"--json":                      predict.Nothing,
+		"--parquet":                   predict.Nothing,
 		"-f":                          predict.Nothing,
 		"--fields":                    predict.Nothing,
 		"--fields-from-header":        predict.Nothing,
@@ -34,6 +36,9 @@ var completionsImport = &complete.Command{
 		"--joinkey-col":               predict.Nothing,
 		"--no-fields":                 predict.Nothing,
 		"--no-network":                predict.Nothing,
+		"--unflatten":                 predict.Nothing,
+		"--typed-header":              predict.Nothing,
+		"--tsv-escape":                predict.Nothing,
 		"--ip":                        predict.Set(predictIpVsn),
 		"-s":                          predict.Set(predictSize),
 		"--size":                      predict.Set(predictSize),
@@ -43,6 +48,8 @@ var completionsImport = &complete.Command{
 		"--disallow-reserved":         predict.Nothing,
 		"--alias-6to4":                predict.Nothing,
 		"--disable-metadata-pointers": predict.Nothing,
+		"-q":                          predict.Nothing,
+		"--quiet":                     predict.Nothing,
 	},
 }
 
@@ -58,11 +65,16 @@ Options:
   General:
     --help, -h
       show help.
+    --quiet, -q
+      don't report progress, or the entries written, on stderr.
+      progress is redrawn in place on a terminal, and logged periodically
+      otherwise.
+      default: false.
 
   Input/Output:
     -i <fname>, --in <fname>
       input file name. (e.g. data.csv or - for stdin)
-      must be in CSV, TSV or JSON.
+      must be in CSV, TSV, JSON or Parquet.
       default: stdin.
     -o <fname>, --out <fname>
       output file name. (e.g. sample.mmdb)
@@ -76,6 +88,13 @@ Options:
     -j, --json
       interpret input file as JSON.
       by default, the .json extension will turn this on.
+    --parquet
+      interpret input file as Parquet, like that written by
+      "export --format parquet". columns keep their types, e.g. unsigned
+      integer columns become uints and groups become maps, and null values
+      are left out. the network is read from the range column, or the
+      start_ip and end_ip columns.
+      by default, the .parquet extension will turn this on.
 
   Fields:
     One of the following fields flags, or other flags that implicitly specify
@@ -108,6 +127,24 @@ Options:
     --no-network
       if --fields-from-header is set, then don't write the network field, which
       is assumed to be the *first* field in the header.
+      implied for parquet input, whose records are those of the exported
+      database.
+      default: false.
+    --unflatten
+      for csv/tsv, nest fields with dotted names (e.g. country.names.en) into
+      maps, and fields indexed like subdivisions.0.iso_code into arrays.
+      reverses "export --flatten". empty values are left out.
+      default: false.
+    --typed-header
+      for csv/tsv, read the type of each field from its annotation in the
+      header (e.g. asn:uint32), as written by "export --typed-header", rather
+      than reading all values as strings. empty values are left out, as they
+      are written for fields missing from a record, while empty strings are
+      written as "" and kept. implies --no-network.
+      default: false.
+    --tsv-escape
+      for tsv, read \\, \t, \n and \r in fields as a backslash, tab, newline
+      and carriage return. reverses "export --tsv-escape".
       default: false.
 
   Meta:
@@ -141,10 +178,12 @@ Options:
 `, progBase)
 }
 
-func cmdImport() error {
+func cmdImport(ctx context.Context) error {
 	f := lib.CmdImportFlags{}
 	f.Init()
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
-	return lib.CmdImport(f, pflag.Args()[1:], printHelpImport)
+	return lib.CmdImportContext(ctx, f, pflag.Args()[1:], printHelpImport)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ipinfo/cli/lib/complete"
@@ -19,6 +20,8 @@ var completionsMetadata = &complete.Command{
 		"--help":       predict.Nothing,
 		"-f":           predict.Set(predictMetadataFmts),
 		"--format":     predict.Set(predictMetadataFmts),
+		"-q":           predict.Nothing,
+		"--quiet":      predict.Nothing,
 	},
 }
 
@@ -34,6 +37,11 @@ Options:
       show data type sizes within the data section.
     --help, -h
       show help.
+    --quiet, -q
+      don't report progress on stderr.
+      progress is redrawn in place on a terminal, and logged periodically
+      otherwise.
+      default: false.
 
   Format:
     -f <format>, --format <format>
@@ -43,10 +51,12 @@ Options:
 `, progBase)
 }
 
-func cmdMetadata() error {
+func cmdMetadata(ctx context.Context) error {
 	f := lib.CmdMetadataFlags{}
 	f.Init()
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
-	return lib.CmdMetadata(f, pflag.Args()[1:], printHelpMetadata)
+	return lib.CmdMetadataContext(ctx, f, pflag.Args()[1:], printHelpMetadata)
 }
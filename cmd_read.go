@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ipinfo/cli/lib/complete"
@@ -19,11 +20,16 @@ var predictReadFmts = []string{
 
 var completionsRead = &complete.Command{
 	Flags: map[string]complete.Predictor{
-		"--nocolor": predict.Nothing,
-		"-h":        predict.Nothing,
-		"--help":    predict.Nothing,
-		"-f":        predict.Set(predictReadFmts),
-		"--format":  predict.Set(predictReadFmts),
+		"--nocolor":         predict.Nothing,
+		"-h":                predict.Nothing,
+		"--help":            predict.Nothing,
+		"-f":                predict.Set(predictReadFmts),
+		"--format":          predict.Set(predictReadFmts),
+		"--flatten":         predict.Nothing,
+		"--array-delim":     predict.Nothing,
+		"--no-network":      predict.Nothing,
+		"--prefix-len":      predict.Nothing,
+		"--replace-network": predict.Nothing,
 	},
 }
 
@@ -31,6 +37,10 @@ func printHelpRead() {
 	fmt.Printf(
 		`Usage: %s read [<opts>] <ip | ip-range | cidr | filepath> <mmdb>
 
+CIDRs and IP ranges are answered with each distinct network overlapping them,
+along with the first IP of the CIDR or range in it, rather than by looking up
+every IP.
+
 Options:
   General:
     --nocolor
@@ -44,13 +54,37 @@ Options:
       can be "json", "json-compact", "json-pretty", "tsv" or "csv".
       note that "json" is short for "json-compact".
       default: json.
+    --flatten
+      for csv/tsv, expand nested maps and arrays into columns named by their
+      dotted paths (e.g. country.names.en, subdivisions.0.iso_code) instead
+      of JSON strings in a single column.
+      default: false.
+    --array-delim <delim>
+      with --flatten, join arrays of scalars into a single column with
+      <delim> instead of a column per element.
+      default: none.
+    --no-network
+      leave out the network each IP was found in, which is otherwise written
+      as "network", after the IP for csv/tsv, unless the data has a network
+      field of its own.
+      default: false.
+    --prefix-len
+      also write the prefix length of the network each IP was found in, as
+      "prefix_len", unless the data has a prefix_len field of its own.
+      default: false.
+    --replace-network
+      write the network and prefix length in place of network and
+      prefix_len fields of the data, which are kept by default.
+      default: false.
 `, progBase)
 }
 
-func cmdRead() error {
+func cmdRead(ctx context.Context) error {
 	f := mmdbLib.CmdReadFlags{}
 	f.Init()
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
-	return mmdbLib.CmdRead(f, pflag.Args()[1:], printHelpRead)
+	return mmdbLib.CmdReadContext(ctx, f, pflag.Args()[1:], printHelpRead)
 }
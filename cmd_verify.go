@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ipinfo/cli/lib/complete"
@@ -27,10 +28,12 @@ Options:
 `, progBase)
 }
 
-func cmdVerify() error {
+func cmdVerify(ctx context.Context) error {
 	f := lib.CmdVerifyFlags{}
 	f.Init()
-	pflag.Parse()
+	if err := parseFlags(); err != nil {
+		return err
+	}
 
-	return lib.CmdVerify(f, pflag.Args()[1:], printHelpVerify)
+	return lib.CmdVerifyContext(ctx, f, pflag.Args()[1:], printHelpVerify)
 }
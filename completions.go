@@ -16,9 +16,10 @@ var completions = &complete.Command{
 		"completion": completionsCompletion,
 	},
 	Flags: map[string]complete.Predictor{
-		"--nocolor": predict.Nothing,
-		"-h":        predict.Nothing,
-		"--help":    predict.Nothing,
+		"--nocolor":      predict.Nothing,
+		"--error-format": predict.Set([]string{"text", "json"}),
+		"-h":             predict.Nothing,
+		"--help":         predict.Nothing,
 	},
 }
 
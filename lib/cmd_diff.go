@@ -1,10 +1,10 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/netip"
-	"reflect"
+	"os"
 
 	"github.com/oschwald/maxminddb-golang/v2"
 	"github.com/spf13/pflag"
@@ -15,6 +15,7 @@ type CmdDiffFlags struct {
 	Help    bool
 	Subnets bool
 	Records bool
+	Quiet   bool
 }
 
 // Init initializes the common flags available to CmdDiff with sensible
@@ -38,61 +39,25 @@ func (f *CmdDiffFlags) Init() {
 		"records", "r", false,
 		_h,
 	)
+	pflag.BoolVarP(
+		&f.Quiet,
+		"quiet", "q", false,
+		_h,
+	)
 }
 
-type cmdDiffRecord struct {
-	oldr interface{}
-	newr interface{}
-}
-
-func doDiff(
-	newDb *maxminddb.Reader,
-	newDbStr string,
-	oldDb *maxminddb.Reader,
-	oldDbStr string,
-) (map[netip.Prefix]netip.Prefix, map[netip.Prefix]cmdDiffRecord, error) {
-	modifiedSubnets := map[netip.Prefix]netip.Prefix{}
-	modifiedRecords := map[netip.Prefix]cmdDiffRecord{}
-	for result := range newDb.Networks() {
-		var recordA interface{}
-		var recordB interface{}
-
-		if err := result.Decode(&recordA); err != nil {
-			return nil, nil, fmt.Errorf(
-				"failed to get record for subnet from %v: %w",
-				newDbStr, err,
-			)
-		}
-		subnetA := result.Prefix()
-
-		lookupResult := oldDb.Lookup(subnetA.Addr())
-		if err := lookupResult.Decode(&recordB); err != nil {
-			return nil, nil, fmt.Errorf(
-				"failed to get record for IP %v from %v: %w",
-				subnetA.Addr(), oldDbStr, err,
-			)
-		}
-		subnetB := lookupResult.Prefix()
-
-		// unequal subnets?
-		if subnetA != subnetB {
-			modifiedSubnets[subnetA] = subnetB
-			continue
-		}
-
-		// different data for same subnet?
-		if !reflect.DeepEqual(recordA, recordB) {
-			modifiedRecords[subnetA] = cmdDiffRecord{
-				oldr: recordB,
-				newr: recordA,
-			}
-		}
-	}
-
-	return modifiedSubnets, modifiedRecords, nil
+func CmdDiff(f CmdDiffFlags, args []string, printHelp func()) error {
+	return CmdDiffContext(context.Background(), f, args, printHelp)
 }
 
-func CmdDiff(f CmdDiffFlags, args []string, printHelp func()) error {
+// CmdDiffContext is like CmdDiff, but stops early with an ExitInterrupted
+// error once ctx is cancelled.
+func CmdDiffContext(
+	ctx context.Context,
+	f CmdDiffFlags,
+	args []string,
+	printHelp func(),
+) error {
 	if f.Help || (pflag.NArg() == 1 && pflag.NFlag() == 0) {
 		printHelp()
 		return nil
@@ -100,14 +65,14 @@ func CmdDiff(f CmdDiffFlags, args []string, printHelp func()) error {
 
 	// validate input files.
 	if len(args) != 2 {
-		return errors.New("two input mmdb file required as arguments")
+		return usageError(errors.New("two input mmdb file required as arguments"))
 	}
 
 	// open old db.
 	oldMmdb := args[0]
 	oldDb, err := maxminddb.Open(oldMmdb)
 	if err != nil {
-		return fmt.Errorf("couldnt open %v: %w", oldMmdb, err)
+		return openDBError(fmt.Errorf("couldnt open %v: %w", oldMmdb, err))
 	}
 	defer oldDb.Close()
 
@@ -115,60 +80,56 @@ func CmdDiff(f CmdDiffFlags, args []string, printHelp func()) error {
 	newMmdb := args[1]
 	newDb, err := maxminddb.Open(newMmdb)
 	if err != nil {
-		return fmt.Errorf("couldnt open %v: %w", newMmdb, err)
+		return openDBError(fmt.Errorf("couldnt open %v: %w", newMmdb, err))
 	}
 	defer newDb.Close()
 
-	// confirm that they're of the same IP version.
-	if newDb.Metadata.IPVersion != oldDb.Metadata.IPVersion {
-		return fmt.Errorf(
-			"IP versions differ between files: %v=%v and %v=%v",
-			newMmdb, newDb.Metadata.IPVersion,
-			oldMmdb, oldDb.Metadata.IPVersion,
-		)
+	opts := DiffOptions{
+		OldName: oldMmdb,
+		NewName: newMmdb,
+	}
+	if !f.Quiet {
+		opts.Progress = os.Stderr
 	}
 
 	// collect set difference data.
-	ambSn, ambRec, err := doDiff(newDb, newMmdb, oldDb, oldMmdb)
-	if err != nil {
-		return err
-	}
-	bmaSn, _, err := doDiff(oldDb, oldMmdb, newDb, newMmdb)
+	res, err := Diff(ctx, oldDb, newDb, opts)
 	if err != nil {
 		return err
 	}
 
 	// print.
 	if f.Subnets {
-		if len(ambSn) > 0 || len(bmaSn) > 0 {
+		if len(res.Subnets) > 0 {
 			fmt.Println("** SUBNETS **")
-			for newSn, oldSn := range ambSn {
-				fmt.Printf("%v -> %v\n", oldSn, newSn)
-			}
-			for newSn, oldSn := range bmaSn {
-				fmt.Printf("%v -> %v\n", newSn, oldSn)
+			for _, sn := range res.Subnets {
+				fmt.Printf("%v -> %v\n", sn.Old, sn.New)
 			}
 		}
-		fmt.Println(len(ambSn)+len(bmaSn), "subnet(s) modified.")
+		fmt.Println(len(res.Subnets), "subnet(s) modified.")
 	}
 	if f.Records {
 		if f.Subnets {
 			fmt.Println()
 		}
 
-		if len(ambRec) > 0 {
+		if len(res.Records) > 0 {
 			fmt.Println("** RECORDS **")
-			for sn, diffRecord := range ambRec {
-				fmt.Println(sn)
-				fmt.Printf("	-%v\n", diffRecord.oldr)
-				fmt.Printf("	+%v\n", diffRecord.newr)
+			for _, rec := range res.Records {
+				fmt.Println(rec.Network)
+				fmt.Printf("	-%v\n", rec.Old)
+				fmt.Printf("	+%v\n", rec.New)
 			}
 		}
-		fmt.Println(len(ambRec), "record(s) modified.")
+		fmt.Println(len(res.Records), "record(s) modified.")
 	}
 	if !f.Subnets && !f.Records {
-		fmt.Println(len(ambSn)+len(bmaSn), "subnet(s) modified.")
-		fmt.Println(len(ambRec), "record(s) modified.")
+		fmt.Println(len(res.Subnets), "subnet(s) modified.")
+		fmt.Println(len(res.Records), "record(s) modified.")
+	}
+
+	if !res.Empty() {
+		return &CmdError{Code: ExitDiffFound}
 	}
 
 	return nil
@@ -1,9 +1,13 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/oschwald/maxminddb-golang/v2"
@@ -12,10 +16,46 @@ import (
 
 // CmdExportFlags are flags expected by CmdExport.
 type CmdExportFlags struct {
-	Help   bool
-	NoHdr  bool
-	Format string
-	Out    string
+	Help       bool
+	NoHdr      bool
+	Format     string
+	Dialect    string
+	Table      string
+	ValueField string
+	SetName    string
+	Index      string
+	DocID      string
+	Mapping    string
+	DDL        string
+	Coords     []string
+	GeoJSONSeq bool
+	PerLoc     bool
+	CacheSize  int
+	Workers    int
+	Shards     int
+	ShardFiles bool
+	SplitBy    string
+	OutDir     string
+	MaxOpen    int
+	Out        string
+	Fields     []string
+	Flatten    bool
+	ArrayDelim string
+	TypedHdr   bool
+	TSVEscape  bool
+	Within     []string
+	IPv4Only   bool
+	IPv6Only   bool
+	Where      string
+	Ranges     bool
+	Decimal    bool
+	Computed   []string
+	Aliased    bool
+	Empty      bool
+	IPv4Mapped bool
+	IPv4Native bool
+	Normalized bool
+	Quiet      bool
 }
 
 // Init initializes the common flags available to CmdExport with sensible
@@ -39,14 +79,205 @@ func (f *CmdExportFlags) Init() {
 		"format", "f", "",
 		_h,
 	)
+	pflag.StringVar(
+		&f.Dialect,
+		"dialect", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.Table,
+		"table", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.ValueField,
+		"value-field", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.SetName,
+		"set-name", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.Index,
+		"index", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.DocID,
+		"doc-id", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.Mapping,
+		"mapping", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.DDL,
+		"ddl", "",
+		_h,
+	)
+	pflag.StringSliceVar(
+		&f.Coords,
+		"coords", nil,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.GeoJSONSeq,
+		"geojson-seq", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.PerLoc,
+		"per-location", false,
+		_h,
+	)
 	pflag.StringVarP(
 		&f.Out,
 		"out", "o", "",
 		_h,
 	)
+	pflag.StringSliceVar(
+		&f.Fields,
+		"fields", nil,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.Flatten,
+		"flatten", false,
+		_h,
+	)
+	pflag.StringVar(
+		&f.ArrayDelim,
+		"array-delim", "",
+		_h,
+	)
+	pflag.BoolVar(
+		&f.TypedHdr,
+		"typed-header", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.TSVEscape,
+		"tsv-escape", false,
+		_h,
+	)
+	pflag.StringSliceVar(
+		&f.Within,
+		"within", nil,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.IPv4Only,
+		"ipv4-only", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.IPv6Only,
+		"ipv6-only", false,
+		_h,
+	)
+	pflag.StringVar(
+		&f.Where,
+		"where", "",
+		_h,
+	)
+	pflag.BoolVar(
+		&f.Ranges,
+		"ranges", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.Decimal,
+		"decimal", false,
+		_h,
+	)
+	pflag.StringSliceVar(
+		&f.Computed,
+		"computed", nil,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.Aliased,
+		"include-aliased", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.Empty,
+		"include-empty", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.IPv4Mapped,
+		"ipv4-as-mapped", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.IPv4Native,
+		"ipv4-native", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.Normalized,
+		"normalized", false,
+		_h,
+	)
+	pflag.IntVar(
+		&f.CacheSize,
+		"cache-size", defaultCacheSize,
+		_h,
+	)
+	pflag.IntVar(
+		&f.Workers,
+		"workers", 1,
+		_h,
+	)
+	pflag.IntVar(
+		&f.Shards,
+		"shards", 1,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.ShardFiles,
+		"shard-files", false,
+		_h,
+	)
+	pflag.StringVar(
+		&f.SplitBy,
+		"split-by", "",
+		_h,
+	)
+	pflag.StringVar(
+		&f.OutDir,
+		"out-dir", "",
+		_h,
+	)
+	pflag.IntVar(
+		&f.MaxOpen,
+		"max-open-files", defaultMaxOpenSplits,
+		_h,
+	)
+	pflag.BoolVarP(
+		&f.Quiet,
+		"quiet", "q", false,
+		_h,
+	)
 }
 
 func CmdExport(f CmdExportFlags, args []string, printHelp func()) error {
+	return CmdExportContext(context.Background(), f, args, printHelp)
+}
+
+// CmdExportContext is like CmdExport, but stops early with an ExitInterrupted
+// error once ctx is cancelled.
+func CmdExportContext(
+	ctx context.Context,
+	f CmdExportFlags,
+	args []string,
+	printHelp func(),
+) error {
 	// help?
 	if f.Help || (pflag.NArg() == 1 && pflag.NFlag() == 0) {
 		printHelp()
@@ -55,25 +286,60 @@ func CmdExport(f CmdExportFlags, args []string, printHelp func()) error {
 
 	// validate input file.
 	if len(args) == 0 {
-		return errors.New("input mmdb file required as first argument")
+		return usageError(errors.New("input mmdb file required as first argument"))
 	}
 
-	// prepare output file.
-	var outFile *os.File
-	if f.Out == "" && len(args) < 2 {
-		outFile = os.Stdout
-	} else {
-		// either flag or argument is defined.
-		if f.Out == "" {
-			f.Out = args[1]
+	// parse networks to export within.
+	within := make([]netip.Prefix, 0, len(f.Within))
+	for _, s := range f.Within {
+		prefix, err := parsePrefixOrAddr(s)
+		if err != nil {
+			return usageError(fmt.Errorf("invalid network %q to export within: %w", s, err))
 		}
+		within = append(within, prefix)
+	}
 
-		var err error
-		outFile, err = os.Create(f.Out)
-		if err != nil {
-			return fmt.Errorf("could not create %v: %w", f.Out, err)
+	// figure out IPv4 format.
+	var ipv4Fmt string
+	if f.IPv4Mapped && f.IPv4Native {
+		return usageError(errors.New("--ipv4-as-mapped and --ipv4-native are mutually exclusive"))
+	} else if f.IPv4Mapped {
+		ipv4Fmt = "mapped"
+	} else if f.IPv4Native {
+		ipv4Fmt = "native"
+	}
+
+	// prepare output paths; a normalized export writes two, named after the
+	// output file.
+	if f.Out == "" && len(args) >= 2 {
+		f.Out = args[1]
+	}
+	outPaths := []string{f.Out}
+	if f.Normalized && (f.ShardFiles || f.SplitBy != "") {
+		return usageError(errors.New("normalized exports can't be written to shard files or split"))
+	}
+	if f.Normalized {
+		if f.Out == "" {
+			return usageError(errors.New("normalized exports require an output file"))
+		}
+		outPaths = normalizedPaths(f.Out)
+	}
+	// a file per shard is created once the shards are known.
+	if f.ShardFiles {
+		if f.Out == "" {
+			return usageError(errors.New("shard files require an output file"))
+		}
+		outPaths = nil
+	}
+	// a split export creates a file per value in the output directory.
+	if (f.SplitBy == "") != (f.OutDir == "") {
+		return usageError(errors.New("--split-by and --out-dir must be used together"))
+	}
+	if f.SplitBy != "" {
+		if f.Out != "" {
+			return usageError(errors.New("split exports are written to --out-dir, not an output file"))
 		}
-		defer outFile.Close()
+		outPaths = nil
 	}
 
 	// infer format from extension if not specified.
@@ -84,29 +350,206 @@ func CmdExport(f CmdExportFlags, args []string, printHelp func()) error {
 			f.Format = "tsv"
 		} else if strings.HasSuffix(f.Out, ".json") {
 			f.Format = "json"
+		} else if strings.HasSuffix(f.Out, ".parquet") {
+			f.Format = "parquet"
+		} else if strings.HasSuffix(f.Out, ".sql") {
+			f.Format = "sql"
+		} else if strings.HasSuffix(f.Out, ".geojson") {
+			f.Format = "geojson"
 		} else {
 			f.Format = "csv"
 		}
 	}
 
+	opts := ExportOptions{
+		Format:         f.Format,
+		Dialect:        f.Dialect,
+		Table:          f.Table,
+		ValueField:     f.ValueField,
+		SetName:        f.SetName,
+		Index:          f.Index,
+		DocID:          f.DocID,
+		Coords:         f.Coords,
+		GeoJSONSeq:     f.GeoJSONSeq,
+		PerLocation:    f.PerLoc,
+		NoHdr:          f.NoHdr,
+		Fields:         f.Fields,
+		Flatten:        f.Flatten,
+		ArrayDelim:     f.ArrayDelim,
+		TypedHeader:    f.TypedHdr,
+		TSVEscape:      f.TSVEscape,
+		Within:         within,
+		IPv4Only:       f.IPv4Only,
+		IPv6Only:       f.IPv6Only,
+		Where:          f.Where,
+		Ranges:         f.Ranges,
+		DecimalRanges:  f.Decimal,
+		Computed:       f.Computed,
+		IncludeAliased: f.Aliased,
+		IncludeEmpty:   f.Empty,
+		IPv4Format:     ipv4Fmt,
+		CacheSize:      f.CacheSize,
+		Workers:        f.Workers,
+		Shards:         f.Shards,
+	}
+	var outFiles []*os.File
+	defer func() {
+		for _, outFile := range outFiles {
+			outFile.Close()
+		}
+	}()
+	createOut := func(path string) (*os.File, error) {
+		outFile, err := os.Create(path)
+		if err != nil {
+			return nil, ioError(fmt.Errorf("could not create %v: %w", path, err))
+		}
+		outFiles = append(outFiles, outFile)
+		return outFile, nil
+	}
+	if f.SplitBy != "" {
+		opts.SplitBy = f.SplitBy
+		opts.MaxOpenSplits = f.MaxOpen
+		opts.SplitOutput = func(value string, appending bool) (io.WriteCloser, error) {
+			path := filepath.Join(f.OutDir, splitFileName(value)+"."+f.Format)
+			if appending {
+				outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					return nil, ioError(fmt.Errorf("could not reopen %v: %w", path, err))
+				}
+				return outFile, nil
+			}
+			outPaths = append(outPaths, path)
+			outFile, err := os.Create(path)
+			if err != nil {
+				return nil, ioError(fmt.Errorf("could not create %v: %w", path, err))
+			}
+			return outFile, nil
+		}
+	}
+	if f.ShardFiles {
+		opts.ShardOutput = func(shard int) (io.Writer, error) {
+			path := shardPath(f.Out, shard)
+			outPaths = append(outPaths, path)
+			return createOut(path)
+		}
+	}
+	// the records, DDL and mapping files are only created once the options
+	// are known to be valid.
+	if f.Normalized {
+		opts.NormalizedRecords = io.Discard
+	}
+	if f.DDL != "" {
+		opts.DDL = io.Discard
+		// the dictionary loads the output file, once copied to the server.
+		if f.Out != "" {
+			opts.DictSource = filepath.Base(f.Out)
+		}
+	}
+	if f.Mapping != "" {
+		opts.Mapping = io.Discard
+	}
+	if !f.Quiet {
+		opts.Progress = os.Stderr
+	}
+
+	// validate before touching any files.
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
 	// open tree.
 	db, err := maxminddb.Open(args[0])
 	if err != nil {
-		return fmt.Errorf("couldn't open mmdb file: %w", err)
+		return openDBError(fmt.Errorf("couldn't open mmdb file: %w", err))
 	}
 	defer db.Close()
 
-	var exp exporter
-	switch f.Format {
-	case "csv":
-		exp = newCSVExporter(outFile, f.NoHdr)
-	case "tsv":
-		exp = newTSVExporter(outFile, f.NoHdr)
-	case "json":
-		exp = newJSONExporter(outFile)
-	default:
-		return errors.New("format must be \"csv\" or \"tsv\" or \"json\"")
+	// create output files.
+	if f.SplitBy != "" {
+		if err := os.MkdirAll(f.OutDir, 0755); err != nil {
+			return ioError(fmt.Errorf("could not create %v: %w", f.OutDir, err))
+		}
+	}
+	var out io.Writer = io.Discard
+	if f.Out == "" && f.SplitBy == "" {
+		out = os.Stdout
+	} else {
+		for i, path := range outPaths {
+			outFile, err := createOut(path)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				out = outFile
+			}
+		}
+	}
+	if f.Normalized {
+		opts.NormalizedRecords = outFiles[1]
+	}
+	// the DDL and mapping describe the export, and are removed along with
+	// it if it's interrupted.
+	if f.DDL != "" {
+		outPaths = append(outPaths, f.DDL)
+		ddlFile, err := createOut(f.DDL)
+		if err != nil {
+			return err
+		}
+		opts.DDL = ddlFile
+	}
+	if f.Mapping != "" {
+		outPaths = append(outPaths, f.Mapping)
+		mappingFile, err := createOut(f.Mapping)
+		if err != nil {
+			return err
+		}
+		opts.Mapping = mappingFile
+	}
+
+	_, err = Export(ctx, db, opts, out)
+	if err != nil && len(outPaths) > 0 && ExitCode(err) == ExitInterrupted {
+		// rows already on stdout can't be taken back, but a partial file
+		// could be mistaken for a complete export, as could a DDL or
+		// mapping file for one.
+		for _, outFile := range outFiles {
+			outFile.Close()
+		}
+		for _, path := range outPaths {
+			os.Remove(path)
+		}
 	}
+	return err
+}
 
-	return exportNetworks(db, exp)
+// normalizedPaths returns the paths of the networks and records files of a
+// normalized export to out, e.g. "geo.networks.csv" and "geo.records.csv" for
+// "geo.csv".
+func normalizedPaths(out string) []string {
+	ext := filepath.Ext(out)
+	base := strings.TrimSuffix(out, ext)
+	return []string{base + ".networks" + ext, base + ".records" + ext}
+}
+
+// shardPath returns the path of the file of a shard of an export to out,
+// numbered from 1, e.g. "geo.0001.csv" for the first shard of "geo.csv".
+func shardPath(out string, shard int) string {
+	ext := filepath.Ext(out)
+	return fmt.Sprintf("%s.%04d%s", strings.TrimSuffix(out, ext), shard+1, ext)
+}
+
+// splitFileName returns the name of the file of a split export value, without
+// its extension: letters, digits, "-" and "_" are kept and other bytes
+// percent-encoded, so that distinct values have distinct names, e.g.
+// "US" or "AS%2013335" for "AS 13335".
+func splitFileName(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
 }
@@ -1,12 +1,28 @@
 package lib
 
 import (
+	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang/v2"
 )
 
 func TestCmdExportFlags_Init(t *testing.T) {
@@ -81,6 +97,39 @@ func TestCmdExport_NonExistentMMDBFile(t *testing.T) {
 	}
 }
 
+func TestCmdExport_ExitCodes(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	createTestMMDB(t, mmdbFile)
+
+	notMMDBFile := filepath.Join(tempDir, "not.mmdb")
+	if err := os.WriteFile(notMMDBFile, []byte("not an mmdb file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		f        CmdExportFlags
+		args     []string
+		expected int
+	}{
+		{"missing input", CmdExportFlags{}, []string{}, ExitUsage},
+		{"invalid format", CmdExportFlags{Format: "xml", Out: filepath.Join(tempDir, "out.xml")}, []string{mmdbFile}, ExitUsage},
+		{"nonexistent input", CmdExportFlags{Out: filepath.Join(tempDir, "out1.csv")}, []string{filepath.Join(tempDir, "nonexistent.mmdb")}, ExitIO},
+		{"invalid input", CmdExportFlags{Out: filepath.Join(tempDir, "out2.csv")}, []string{notMMDBFile}, ExitInvalidDB},
+		{"success", CmdExportFlags{Out: filepath.Join(tempDir, "out3.csv")}, []string{mmdbFile}, ExitOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CmdExport(tt.f, tt.args, func() {})
+			if code := ExitCode(err); code != tt.expected {
+				t.Errorf("expected exit code %d, got %d (%v)", tt.expected, code, err)
+			}
+		})
+	}
+}
+
 func TestCmdExport_CSVFormat(t *testing.T) {
 	tempDir := t.TempDir()
 	mmdbFile := filepath.Join(tempDir, "test.mmdb")
@@ -529,3 +578,2235 @@ func assertRowContains(t *testing.T, records [][]string, expectedValues ...strin
 
 	t.Errorf("expected to find row with exactly these values: %v", expectedValues)
 }
+
+func TestExport_InMemory(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	createTestMMDB(t, mmdbFile)
+
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var out bytes.Buffer
+	stats, err := Export(context.Background(), db, ExportOptions{Format: "tsv"}, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if stats.Networks != 3 {
+		t.Errorf("expected 3 networks, got %d", stats.Networks)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected header and 3 rows, got %d lines", len(lines))
+	}
+	if lines[0] != "range\tasn\tcity\tcountry\tnetwork" {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+}
+
+func TestCmdExport_Interrupted(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	outFile := filepath.Join(tempDir, "out.csv")
+	createTestMMDB(t, mmdbFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	flags := CmdExportFlags{Format: "csv", Quiet: true}
+	err := CmdExportContext(ctx, flags, []string{mmdbFile, outFile}, func() {})
+	if code := ExitCode(err); code != ExitInterrupted {
+		t.Fatalf("expected exit code %d, got %d (%v)", ExitInterrupted, code, err)
+	}
+	if _, err := os.Stat(outFile); !os.IsNotExist(err) {
+		t.Errorf("expected partial output %s to be removed", outFile)
+	}
+
+	// so are the DDL and mapping files of the export.
+	descFile := filepath.Join(tempDir, "desc")
+	for _, flags := range []CmdExportFlags{
+		{Format: "clickhouse", DDL: descFile, Quiet: true},
+		{Format: "es-bulk", Mapping: descFile, Quiet: true},
+	} {
+		err := CmdExportContext(ctx, flags, []string{mmdbFile, outFile}, func() {})
+		if code := ExitCode(err); code != ExitInterrupted {
+			t.Fatalf("%s: expected exit code %d, got %d (%v)", flags.Format, ExitInterrupted, code, err)
+		}
+		for _, path := range []string{outFile, descFile} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: expected partial output %s to be removed", flags.Format, path)
+			}
+		}
+	}
+
+	// library callers can tell a deadline from a cancel.
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = Export(ctx, db, ExportOptions{Format: "csv"}, io.Discard)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		t.Errorf("expected the error to wrap context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// createSparseTestMMDB creates an MMDB whose records don't all have the same
+// keys; the first network's record has fewer keys than the others.
+func createSparseTestMMDB(t *testing.T, outputPath string) {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		IPVersion:               6,
+		RecordSize:              32,
+		IncludeReservedNetworks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []struct {
+		network string
+		data    mmdbtype.Map
+	}{
+		{"5.150.80.0/20", mmdbtype.Map{
+			"country": mmdbtype.String("UK"),
+		}},
+		{"167.153.128.0/17", mmdbtype.Map{
+			"country": mmdbtype.String("US"),
+			"city":    mmdbtype.String("New York"),
+		}},
+		{"204.138.232.0/24", mmdbtype.Map{
+			"country": mmdbtype.String("CA"),
+			"asn":     mmdbtype.String("14836"),
+		}},
+	}
+	for _, r := range records {
+		_, network, err := net.ParseCIDR(r.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(network, r.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outFile.Close()
+	if _, err := tree.WriteTo(outFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdExport_HeaderFromAllRecords(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "sparse.mmdb")
+	createSparseTestMMDB(t, mmdbFile)
+
+	for _, format := range []string{"csv", "tsv"} {
+		t.Run(format, func(t *testing.T) {
+			outputFile := filepath.Join(tempDir, "output."+format)
+			f := CmdExportFlags{Format: format, Out: outputFile, Quiet: true}
+			if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			var data csvData
+			if format == "csv" {
+				data = parseCSV(t, outputFile)
+			} else {
+				data = parseTSV(t, outputFile)
+			}
+
+			expectedHdr := []string{"range", "asn", "city", "country"}
+			if strings.Join(data.header, ",") != strings.Join(expectedHdr, ",") {
+				t.Errorf("expected header %v, got %v", expectedHdr, data.header)
+			}
+			assertRowCount(t, data, 3)
+			assertCSVContains(t, data, map[string]string{
+				"range":   "5.150.80.0/20",
+				"asn":     "",
+				"city":    "",
+				"country": "UK",
+			})
+			assertCSVContains(t, data, map[string]string{
+				"range":   "204.138.232.0/24",
+				"asn":     "14836",
+				"city":    "",
+				"country": "CA",
+			})
+		})
+	}
+}
+
+func TestCmdExport_Fields(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "sparse.mmdb")
+	outputFile := filepath.Join(tempDir, "output.csv")
+	createSparseTestMMDB(t, mmdbFile)
+
+	f := CmdExportFlags{
+		Format: "csv",
+		Out:    outputFile,
+		Fields: []string{"country", "city", "missing"},
+		Quiet:  true,
+	}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	data := parseCSV(t, outputFile)
+	expectedHdr := []string{"range", "country", "city", "missing"}
+	if strings.Join(data.header, ",") != strings.Join(expectedHdr, ",") {
+		t.Errorf("expected header %v, got %v", expectedHdr, data.header)
+	}
+	assertCSVContains(t, data, map[string]string{
+		"range":   "167.153.128.0/17",
+		"country": "US",
+		"city":    "New York",
+		"missing": "",
+	})
+
+	// duplicate fields are rejected.
+	f.Fields = []string{"country", "country"}
+	err := CmdExport(f, []string{mmdbFile}, func() {})
+	if code := ExitCode(err); code != ExitUsage {
+		t.Errorf("expected exit code %d, got %d (%v)", ExitUsage, code, err)
+	}
+}
+
+func TestCmdExport_FlattenRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "nested.mmdb")
+	csvFile := filepath.Join(tempDir, "flat.csv")
+	roundTripFile := filepath.Join(tempDir, "roundtrip.mmdb")
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{IPVersion: 6, RecordSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, network, _ := net.ParseCIDR("167.153.128.0/17")
+	err = tree.Insert(network, mmdbtype.Map{
+		"country": mmdbtype.Map{
+			"iso_code": mmdbtype.String("US"),
+			"names":    mmdbtype.Map{"en": mmdbtype.String("United States")},
+		},
+		"subdivisions": mmdbtype.Slice{
+			mmdbtype.Map{"iso_code": mmdbtype.String("NY")},
+		},
+		"tags": mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.String("b")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	// export flattened.
+	ef := CmdExportFlags{Format: "csv", Out: csvFile, Flatten: true, Quiet: true}
+	if err := CmdExport(ef, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected export error: %s", err.Error())
+	}
+	data := parseCSV(t, csvFile)
+	assertCSVContains(t, data, map[string]string{
+		"range":                   "167.153.128.0/17",
+		"country.iso_code":        "US",
+		"country.names.en":        "United States",
+		"subdivisions.0.iso_code": "NY",
+		"tags.0":                  "a",
+		"tags.1":                  "b",
+	})
+
+	// import unflattened.
+	imf := CmdImportFlagsDefaults
+	imf.In = csvFile
+	imf.Out = roundTripFile
+	imf.NoNetwork = true
+	imf.Unflatten = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("unexpected import error: %s", err.Error())
+	}
+
+	db, err := maxminddb.Open(roundTripFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var record map[string]any
+	if err := db.Lookup(netip.MustParseAddr("167.153.128.1")).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(record)
+	expected := `{"country":{"iso_code":"US","names":{"en":"United States"}},` +
+		`"subdivisions":[{"iso_code":"NY"}],"tags":["a","b"]}`
+	if string(got) != expected {
+		t.Errorf("expected record %s, got %s", expected, got)
+	}
+}
+
+func TestCmdExport_FlattenArrayDelim(t *testing.T) {
+	record := map[string]any{
+		"tags":  []any{"a", uint64(2)},
+		"items": []any{map[string]any{"k": "v"}},
+	}
+	flat := flattenRecord(record, "|")
+	if flat["tags"] != "a|2" {
+		t.Errorf("expected joined tags \"a|2\", got %q", flat["tags"])
+	}
+	if flat["items.0.k"] != "v" {
+		t.Errorf("expected indexed items.0.k \"v\", got %v", flat)
+	}
+}
+
+func TestCmdExport_Filters(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	createTestMMDB(t, mmdbFile)
+
+	tests := []struct {
+		name   string
+		flags  CmdExportFlags
+		ranges []string
+	}{
+		{
+			name:   "within",
+			flags:  CmdExportFlags{Within: []string{"167.153.0.0/16", "5.150.80.1"}},
+			ranges: []string{"167.153.128.0/17", "5.150.80.1/32"},
+		},
+		{
+			name:   "within clips larger networks",
+			flags:  CmdExportFlags{Within: []string{"167.153.130.0/24"}},
+			ranges: []string{"167.153.130.0/24"},
+		},
+		{
+			name:   "within overlapping",
+			flags:  CmdExportFlags{Within: []string{"167.153.130.0/24", "167.153.0.0/16"}},
+			ranges: []string{"167.153.128.0/17"},
+		},
+		{
+			name:   "ipv4 only",
+			flags:  CmdExportFlags{IPv4Only: true},
+			ranges: []string{"167.153.128.0/17", "204.138.232.0/24", "5.150.80.0/20"},
+		},
+		{
+			name:   "ipv6 only",
+			flags:  CmdExportFlags{IPv6Only: true},
+			ranges: nil,
+		},
+		{
+			name:   "where",
+			flags:  CmdExportFlags{Where: `country == "US" || (asn > 50000 && city != 'Paris')`},
+			ranges: []string{"167.153.128.0/17", "5.150.80.0/20"},
+		},
+		{
+			name:   "where negated",
+			flags:  CmdExportFlags{Where: `!(country == "US") && !missing`},
+			ranges: []string{"204.138.232.0/24", "5.150.80.0/20"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			f := tt.flags
+			f.Format = "csv"
+			f.NoHdr = true
+			f.Quiet = true
+			f.Out = filepath.Join(tempDir, "output.csv")
+			if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			content, err := os.ReadFile(f.Out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out.Write(content)
+
+			records, err := csv.NewReader(&out).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ranges []string
+			for _, record := range records {
+				ranges = append(ranges, record[0])
+			}
+			sort.Strings(ranges)
+			if strings.Join(ranges, ",") != strings.Join(tt.ranges, ",") {
+				t.Errorf("expected ranges %v, got %v", tt.ranges, ranges)
+			}
+		})
+	}
+}
+
+func TestCmdExport_WithinOrder(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	createTestMMDB(t, mmdbFile)
+
+	// the networks are written in address order, whatever the order of the
+	// prefixes they're within.
+	f := CmdExportFlags{
+		Format: "csv",
+		NoHdr:  true,
+		Quiet:  true,
+		Out:    filepath.Join(tempDir, "output.csv"),
+		Within: []string{"204.138.232.0/24", "167.153.0.0/16", "5.150.80.0/20"},
+	}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	content, err := os.ReadFile(f.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges []string
+	for _, record := range records {
+		ranges = append(ranges, record[0])
+	}
+	expected := []string{"5.150.80.0/20", "167.153.128.0/17", "204.138.232.0/24"}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected ranges %v, got %v", expected, ranges)
+	}
+
+	// IPv4 prefixes are within IPv6 prefixes covering ::/96.
+	f.Within = []string{"::/0", "204.138.232.0/24"}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	content, err = os.ReadFile(f.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "204.138.232.0/24,"); n != 1 {
+		t.Errorf("expected 204.138.232.0/24 once, got %d times in:\n%s", n, content)
+	}
+}
+
+func TestCmdExport_FilterErrors(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	createTestMMDB(t, mmdbFile)
+
+	for _, f := range []CmdExportFlags{
+		{Within: []string{"not-a-network"}},
+		{IPv4Only: true, IPv6Only: true},
+		{Aliased: true, IPv4Native: true},
+		{Aliased: true, IPv4Mapped: true},
+		{Where: `country ==`},
+		{Where: `country == "US" &&`},
+		{Where: `asn > true`},
+		{Where: `(country == "US"`},
+	} {
+		f.Format = "csv"
+		f.Quiet = true
+		f.Out = filepath.Join(tempDir, "output.csv")
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", f, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_FieldsProjection(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "nested.mmdb")
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{IPVersion: 6, RecordSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, network, _ := net.ParseCIDR("167.153.128.0/17")
+	err = tree.Insert(network, mmdbtype.Map{
+		"country":  mmdbtype.Map{"iso_code": mmdbtype.String("US")},
+		"location": mmdbtype.Map{"latitude": mmdbtype.Float64(40.5)},
+		"asn":      mmdbtype.Uint32(22252),
+		"unused":   mmdbtype.String("x"),
+		"subdivisions": mmdbtype.Slice{
+			mmdbtype.Map{"iso_code": mmdbtype.String("NY")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	fields := []string{
+		"country.iso_code:cc",
+		"location.latitude",
+		"subdivisions.0.iso_code:region",
+		"asn",
+		"country.iso_code.bad:bad",
+	}
+
+	// CSV.
+	csvFile := filepath.Join(tempDir, "out.csv")
+	f := CmdExportFlags{Format: "csv", Out: csvFile, Fields: fields, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	data := parseCSV(t, csvFile)
+	expectedHdr := "range,cc,location.latitude,region,asn,bad"
+	if strings.Join(data.header, ",") != expectedHdr {
+		t.Errorf("expected header %s, got %v", expectedHdr, data.header)
+	}
+	assertCSVContains(t, data, map[string]string{
+		"range":             "167.153.128.0/17",
+		"cc":                "US",
+		"location.latitude": "40.500000",
+		"region":            "NY",
+		"asn":               "22252",
+		"bad":               "",
+	})
+
+	// JSON keeps the field order.
+	jsonFile := filepath.Join(tempDir, "out.json")
+	f = CmdExportFlags{Format: "json", Out: jsonFile, Fields: fields, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	content, err := os.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"range":"167.153.128.0/17","cc":"US","location.latitude":40.5,"region":"NY","asn":22252}`
+	if strings.TrimSpace(string(content)) != expected {
+		t.Errorf("expected %s, got %s", expected, content)
+	}
+
+	// duplicate names after renaming are rejected.
+	f.Fields = []string{"country.iso_code:cc", "asn:cc"}
+	err = CmdExport(f, []string{mmdbFile}, func() {})
+	if code := ExitCode(err); code != ExitUsage {
+		t.Errorf("expected exit code %d, got %d (%v)", ExitUsage, code, err)
+	}
+}
+
+func TestCmdExport_Ranges(t *testing.T) {
+	tempDir := t.TempDir()
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	mmdbFile := filepath.Join(tempDir, "ranges.mmdb")
+
+	// the first range spans 2 networks with the same data.
+	csvData := `start_ip,end_ip,country
+1.0.0.0,1.0.2.255,AU
+1.0.3.0,1.0.3.255,CN
+`
+	if err := os.WriteFile(inputCSV, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = mmdbFile
+	imf.NoNetwork = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+
+	outputFile := filepath.Join(tempDir, "output.csv")
+	f := CmdExportFlags{Format: "csv", Out: outputFile, Ranges: true, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	data := parseCSV(t, outputFile)
+	assertRowCount(t, data, 2)
+	assertCSVContains(t, data, map[string]string{
+		"start_ip": "1.0.0.0",
+		"end_ip":   "1.0.2.255",
+		"country":  "AU",
+	})
+	assertCSVContains(t, data, map[string]string{
+		"start_ip": "1.0.3.0",
+		"end_ip":   "1.0.3.255",
+		"country":  "CN",
+	})
+
+	// decimal.
+	f.Decimal = true
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	data = parseCSV(t, outputFile)
+	assertCSVContains(t, data, map[string]string{
+		"start_ip": "16777216",
+		"end_ip":   "16777983",
+		"country":  "AU",
+	})
+
+	// the output imports back to the same data.
+	roundTripFile := filepath.Join(tempDir, "roundtrip.mmdb")
+	imf.In = outputFile
+	imf.Out = roundTripFile
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("unexpected import error: %s", err.Error())
+	}
+	db, err := maxminddb.Open(roundTripFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var record map[string]any
+	if err := db.Lookup(netip.MustParseAddr("1.0.2.1")).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record["country"] != "AU" {
+		t.Errorf("expected country AU, got %v", record)
+	}
+}
+
+func TestCmdExport_RangesJSON(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	outputFile := filepath.Join(tempDir, "output.json")
+	createTestMMDB(t, mmdbFile)
+
+	f := CmdExportFlags{Format: "json", Out: outputFile, Ranges: true, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	records := parseJSONLines(t, outputFile)
+	assertJSONContains(t, records, map[string]interface{}{
+		"start_ip": "204.138.232.0",
+		"end_ip":   "204.138.232.255",
+		"asn":      "14836",
+		"city":     "Toronto",
+		"country":  "CA",
+		"network":  "204.138.232.0/24",
+	})
+}
+
+func TestCmdExport_Computed(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	createTestMMDB(t, mmdbFile)
+
+	computed := []string{
+		"start_ip", "end_ip", "prefix_len", "num_addresses", "ip_version",
+		"start_ip_decimal", "end_ip_decimal",
+	}
+
+	csvFile := filepath.Join(tempDir, "output.csv")
+	f := CmdExportFlags{
+		Format:   "csv",
+		Out:      csvFile,
+		Fields:   []string{"country"},
+		Computed: computed,
+		Quiet:    true,
+	}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	data := parseCSV(t, csvFile)
+	expectedHdr := "range,start_ip,end_ip,prefix_len,num_addresses,ip_version,start_ip_decimal,end_ip_decimal,country"
+	if strings.Join(data.header, ",") != expectedHdr {
+		t.Errorf("expected header %s, got %v", expectedHdr, data.header)
+	}
+	assertCSVContains(t, data, map[string]string{
+		"range":            "204.138.232.0/24",
+		"start_ip":         "204.138.232.0",
+		"end_ip":           "204.138.232.255",
+		"prefix_len":       "24",
+		"num_addresses":    "256",
+		"ip_version":       "4",
+		"start_ip_decimal": "3431655424",
+		"end_ip_decimal":   "3431655679",
+		"country":          "CA",
+	})
+
+	// JSON has numbers for numeric columns.
+	jsonFile := filepath.Join(tempDir, "output.json")
+	f = CmdExportFlags{
+		Format:   "json",
+		Out:      jsonFile,
+		Fields:   []string{"country"},
+		Computed: []string{"prefix_len", "num_addresses", "offset"},
+		Quiet:    true,
+	}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	records := parseJSONLines(t, jsonFile)
+	for _, record := range records {
+		if record["range"] != "5.150.80.0/20" {
+			continue
+		}
+		if record["prefix_len"] != float64(20) || record["num_addresses"] != "4096" {
+			t.Errorf("unexpected computed values in %v", record)
+		}
+		if _, ok := record["offset"].(float64); !ok {
+			t.Errorf("expected numeric offset in %v", record)
+		}
+	}
+
+	// unknown and duplicate columns are rejected.
+	for _, computed := range [][]string{{"bogus"}, {"ip_version", "ip_version"}} {
+		f.Computed = computed
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%v: expected exit code %d, got %d (%v)", computed, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_IncludeEmptyAndAliased(t *testing.T) {
+	tempDir := t.TempDir()
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	mmdbFile := filepath.Join(tempDir, "aliased.mmdb")
+	outputFile := filepath.Join(tempDir, "output.csv")
+
+	if err := os.WriteFile(inputCSV, []byte("network,country\n1.0.0.0/24,AU\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = mmdbFile
+	imf.Alias6to4 = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+
+	export := func(f CmdExportFlags) []string {
+		t.Helper()
+		f.Format = "csv"
+		f.Out = outputFile
+		f.NoHdr = true
+		f.Fields = []string{"country"}
+		f.Quiet = true
+		if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		content, err := os.ReadFile(outputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+
+	lines := export(CmdExportFlags{})
+	if strings.Join(lines, ";") != "1.0.0.0/24,AU" {
+		t.Errorf("expected only the IPv4 network by default, got %v", lines)
+	}
+
+	lines = export(CmdExportFlags{IPv4Mapped: true})
+	if strings.Join(lines, ";") != "::ffff:1.0.0.0/120,AU" {
+		t.Errorf("expected IPv4-mapped network, got %v", lines)
+	}
+
+	lines = export(CmdExportFlags{Aliased: true})
+	if !slices.Contains(lines, "::ffff:1.0.0.0/120,AU") || !slices.Contains(lines, "2002:100::/40,AU") {
+		t.Errorf("expected aliased networks, got %v", lines)
+	}
+
+	// aliases formatted as IPv4 networks would repeat them.
+	f := CmdExportFlags{Format: "csv", Out: outputFile, Aliased: true, IPv4Native: true, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); ExitCode(err) != ExitUsage {
+		t.Errorf("expected a usage error for aliased networks written natively, got %v", err)
+	}
+
+	lines = export(CmdExportFlags{Within: []string{"1.0.0.0/22"}, Empty: true})
+	expected := "1.0.0.0/24,AU;1.0.1.0/24,;1.0.2.0/23,"
+	if strings.Join(lines, ";") != expected {
+		t.Errorf("expected %s, got %v", expected, lines)
+	}
+}
+
+// createTypedTestMMDB creates a database with values of each MMDB type, and
+// returns its records by network.
+func createTypedTestMMDB(t *testing.T, outputPath string) map[string]mmdbtype.Map {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{IPVersion: 6, RecordSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hugeVal := new(big.Int).Lsh(big.NewInt(1), 100)
+	records := map[string]mmdbtype.Map{
+		"167.153.128.0/17": {
+			"asn":       mmdbtype.Uint32(22252),
+			"count":     mmdbtype.Uint64(1 << 40),
+			"huge":      (*mmdbtype.Uint128)(hugeVal),
+			"delta":     mmdbtype.Int32(-5),
+			"ratio":     mmdbtype.Float32(0.5),
+			"latitude":  mmdbtype.Float64(40.7128),
+			"anycast":   mmdbtype.Bool(true),
+			"raw":       mmdbtype.Bytes{1, 2, 3},
+			"mixed":     mmdbtype.String("text"),
+			"name":      mmdbtype.String("it's a\ttab"),
+			"tags":      mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.String("b")},
+			"country":   mmdbtype.Map{"iso_code": mmdbtype.String("US"), "geoname_id": mmdbtype.Uint32(6252001)},
+			"threshold": mmdbtype.Uint16(7),
+		},
+		"204.138.232.0/24": {
+			"asn":     mmdbtype.Uint32(14836),
+			"mixed":   mmdbtype.Uint32(3),
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("CA")},
+		},
+	}
+	for cidr, record := range records {
+		_, network, _ := net.ParseCIDR(cidr)
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := os.Create(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	return records
+}
+
+func TestCmdExport_ParquetRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	parquetFile := filepath.Join(tempDir, "typed.parquet")
+	roundTripFile := filepath.Join(tempDir, "roundtrip.mmdb")
+
+	records := createTypedTestMMDB(t, mmdbFile)
+
+	// export; the format is inferred from the extension.
+	ef := CmdExportFlags{Out: parquetFile, Quiet: true}
+	if err := CmdExport(ef, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected export error: %s", err.Error())
+	}
+
+	imf := CmdImportFlagsDefaults
+	// the records of the database are imported as is, without a network
+	// field.
+	imf.In = parquetFile
+	imf.Out = roundTripFile
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("unexpected import error: %s", err.Error())
+	}
+
+	db, err := maxminddb.Open(roundTripFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// values of the same type come back as is, and values of mixed types as
+	// strings.
+	records["204.138.232.0/24"]["mixed"] = mmdbtype.String("3")
+	for cidr, expected := range records {
+		prefix := netip.MustParsePrefix(cidr)
+		got, err := decodeTypedRecord(db.Lookup(prefix.Addr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%v: expected record %#v, got %#v", cidr, expected, got)
+		}
+	}
+}
+
+func TestCmdExport_SQL(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+
+	export := func(f CmdExportFlags) string {
+		t.Helper()
+		f.Out = filepath.Join(tempDir, "out.sql")
+		f.Quiet = true
+		if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		out, err := os.ReadFile(f.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	assertContains := func(out string, expected ...string) {
+		t.Helper()
+		for _, s := range expected {
+			if !strings.Contains(out, s) {
+				t.Errorf("expected output to contain %q, got:\n%s", s, out)
+			}
+		}
+	}
+
+	// the format is inferred from the extension, and the dialect defaults
+	// to postgres.
+	out := export(CmdExportFlags{Fields: []string{"asn", "anycast", "raw", "name", "country", "mixed"}})
+	assertContains(out,
+		`CREATE TABLE "networks" (`,
+		`"range" cidr NOT NULL,`,
+		`"asn" bigint,`,
+		`"anycast" boolean,`,
+		`"raw" bytea,`,
+		`"country" jsonb,`,
+		`"mixed" text`,
+		`INSERT INTO "networks" ("range", "asn", "anycast", "raw", "name", "country", "mixed") VALUES`,
+		`('167.153.128.0/17', 22252, TRUE, '\x010203', 'it''s a`+"\t"+`tab', '{"geoname_id":6252001,"iso_code":"US"}', 'text')`,
+		`('204.138.232.0/24', 14836, NULL, NULL, NULL, '{"iso_code":"CA"}', '3');`,
+		"COMMIT;",
+	)
+
+	out = export(CmdExportFlags{
+		Format:  "sql",
+		Dialect: "mysql",
+		Table:   "geo",
+		Ranges:  true,
+		Fields:  []string{"asn", "raw", "huge"},
+	})
+	assertContains(out,
+		"CREATE TABLE `geo` (",
+		"`start_ip` VARCHAR(39) NOT NULL,",
+		"`asn` INT UNSIGNED,",
+		"`huge` DECIMAL(39,0)",
+		"('167.153.128.0', '167.153.255.255', 22252, X'010203', 1267650600228229401496703205376)",
+	)
+
+	out = export(CmdExportFlags{
+		Format:   "sql",
+		Dialect:  "sqlite",
+		NoHdr:    true,
+		Computed: []string{"prefix_len"},
+		Fields:   []string{"anycast"},
+	})
+	if strings.Contains(out, "CREATE TABLE") {
+		t.Errorf("expected no CREATE TABLE statement, got:\n%s", out)
+	}
+	assertContains(out, `('167.153.128.0/17', 17, 1)`)
+
+	out = export(CmdExportFlags{Format: "pgcopy", Fields: []string{"asn", "raw", "name", "tags"}})
+	assertContains(out,
+		`"range" cidr NOT NULL,`,
+		`"tags" jsonb`,
+		`COPY "networks" ("range", "asn", "raw", "name", "tags") FROM stdin;`,
+		"167.153.128.0/17\t22252\t\\\\x010203\tit's a\\ttab\t[\"a\",\"b\"]\n",
+		"204.138.232.0/24\t14836\t\\N\t\\N\t\\N\n",
+		"\\.\n",
+	)
+
+	// dialects only apply to sql, and must be known.
+	for _, f := range []CmdExportFlags{
+		{Format: "csv", Dialect: "mysql"},
+		{Format: "sql", Dialect: "oracle"},
+		{Format: "json", Table: "geo"},
+	} {
+		f.Out = filepath.Join(tempDir, "out.txt")
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", f, ExitUsage, code, err)
+		}
+	}
+}
+
+// cancelAfterCtx is a context cancelled once its Err has been checked n
+// times, or never if n is negative, counting the checks in calls.
+type cancelAfterCtx struct {
+	context.Context
+	n     int
+	calls int
+}
+
+func (c *cancelAfterCtx) Err() error {
+	c.calls++
+	if c.n >= 0 && c.calls > c.n {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestExport_SQLInterrupted(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, tt := range []struct {
+		format     string
+		terminator string
+		abort      string
+	}{
+		{"sql", "COMMIT;", "ROLLBACK;\n"},
+		{"pgcopy", "\\.", "\n"},
+	} {
+		// count the checks of a whole export, then cancel it before its
+		// last network.
+		ctx := &cancelAfterCtx{Context: context.Background(), n: -1}
+		if _, err := Export(ctx, db, ExportOptions{Format: tt.format}, io.Discard); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.format, err.Error())
+		}
+		ctx = &cancelAfterCtx{Context: context.Background(), n: ctx.calls - 1}
+		var out bytes.Buffer
+		_, err := Export(ctx, db, ExportOptions{Format: tt.format}, &out)
+		if ExitCode(err) != ExitInterrupted {
+			t.Fatalf("%s: expected an interrupted error, got %v", tt.format, err)
+		}
+		if !strings.Contains(out.String(), "167.153.128.0/17") {
+			t.Errorf("%s: expected the networks written so far, got:\n%s", tt.format, out.String())
+		}
+		if strings.Contains(out.String(), tt.terminator) || !strings.HasSuffix(out.String(), tt.abort) {
+			t.Errorf("%s: expected a partial export not to end with %s, got:\n%s", tt.format, tt.terminator, out.String())
+		}
+	}
+}
+
+func TestCmdExport_Normalized(t *testing.T) {
+	tempDir := t.TempDir()
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	mmdbFile := filepath.Join(tempDir, "normalized.mmdb")
+
+	// the AU networks share a record.
+	csvData := `range,country,asn
+1.0.0.0/24,AU,13335
+1.0.2.0/24,AU,13335
+1.0.3.0/24,CN,4134
+`
+	if err := os.WriteFile(inputCSV, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = mmdbFile
+	imf.NoNetwork = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+
+	f := CmdExportFlags{Out: filepath.Join(tempDir, "geo.csv"), Normalized: true, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	networks := parseCSV(t, filepath.Join(tempDir, "geo.networks.csv"))
+	records := parseCSV(t, filepath.Join(tempDir, "geo.records.csv"))
+	if !reflect.DeepEqual(networks.header, []string{"range", "record_id"}) {
+		t.Errorf("unexpected networks header %v", networks.header)
+	}
+	if !reflect.DeepEqual(records.header, []string{"record_id", "asn", "country"}) {
+		t.Errorf("unexpected records header %v", records.header)
+	}
+	assertRowCount(t, networks, 3)
+	assertRowCount(t, records, 2)
+
+	// each network refers to the record of its data.
+	byID := make(map[string]map[string]string)
+	for _, row := range records.rows {
+		byID[row["record_id"]] = row
+	}
+	for network, country := range map[string]string{
+		"1.0.0.0/24": "AU",
+		"1.0.2.0/24": "AU",
+		"1.0.3.0/24": "CN",
+	} {
+		var id string
+		for _, row := range networks.rows {
+			if row["range"] == network {
+				id = row["record_id"]
+			}
+		}
+		if got := byID[id]["country"]; got != country {
+			t.Errorf("%v: expected record with country %v, got %q", network, country, got)
+		}
+	}
+
+	// json writes the same split.
+	f.Out = filepath.Join(tempDir, "geo.json")
+	f.Ranges = true
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	networksJSON := parseJSONLines(t, filepath.Join(tempDir, "geo.networks.json"))
+	recordsJSON := parseJSONLines(t, filepath.Join(tempDir, "geo.records.json"))
+	if len(networksJSON) != 3 || len(recordsJSON) != 2 {
+		t.Fatalf("expected 3 networks and 2 records, got %v and %v", networksJSON, recordsJSON)
+	}
+	if _, ok := networksJSON[0]["country"]; ok {
+		t.Errorf("expected networks without fields, got %v", networksJSON[0])
+	}
+	if _, ok := recordsJSON[0]["start_ip"]; ok {
+		t.Errorf("expected records without ranges, got %v", recordsJSON[0])
+	}
+
+	// normalized exports need files, and a format with unrelated tables.
+	for _, f := range []CmdExportFlags{
+		{Normalized: true},
+		{Format: "parquet", Normalized: true, Out: filepath.Join(tempDir, "geo.parquet")},
+	} {
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", f, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_ConfigFormats(t *testing.T) {
+	tempDir := t.TempDir()
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	mmdbFile := filepath.Join(tempDir, "config.mmdb")
+
+	// the AU networks span 1.0.1.0-1.0.3.255, which isn't a single CIDR.
+	csvData := `range,country,name
+1.0.1.0/24,AU,a
+1.0.2.0/24,AU,b
+1.0.3.0/24,AU,
+1.0.4.0/24,CN,say "hi"
+2001:db8::/33,US,
+2001:db8:8000::/33,US,
+`
+	if err := os.WriteFile(inputCSV, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = mmdbFile
+	imf.NoNetwork = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+
+	export := func(f CmdExportFlags) string {
+		t.Helper()
+		f.Out = filepath.Join(tempDir, "out.conf")
+		f.Quiet = true
+		if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		out, err := os.ReadFile(f.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	for _, tc := range []struct {
+		f        CmdExportFlags
+		expected string
+	}{
+		{
+			CmdExportFlags{Format: "nginx-geo", ValueField: "country"},
+			"1.0.1.0/24 AU;\n1.0.2.0/23 AU;\n1.0.4.0/24 CN;\n2001:db8::/32 US;\n",
+		},
+		{
+			// networks without a value are left out.
+			CmdExportFlags{Format: "nginx-geo", ValueField: "name"},
+			"1.0.1.0/24 a;\n1.0.2.0/24 b;\n1.0.4.0/24 \"say \\\"hi\\\"\";\n",
+		},
+		{
+			CmdExportFlags{Format: "haproxy-map", ValueField: "country"},
+			"1.0.1.0/24 AU\n1.0.2.0/23 AU\n1.0.4.0/24 CN\n2001:db8::/32 US\n",
+		},
+		{
+			CmdExportFlags{Format: "ipset"},
+			"create networks_v4 hash:net family inet -exist\n" +
+				"create networks_v6 hash:net family inet6 -exist\n" +
+				"add networks_v4 1.0.1.0/24 -exist\n" +
+				"add networks_v4 1.0.2.0/23 -exist\n" +
+				"add networks_v4 1.0.4.0/24 -exist\n" +
+				"add networks_v6 2001:db8::/32 -exist\n",
+		},
+		{
+			// only networks with a value are members.
+			CmdExportFlags{Format: "ipset", ValueField: "name", SetName: "named", NoHdr: true},
+			"1.0.1.0/24\n1.0.2.0/24\n1.0.4.0/24\n",
+		},
+		{
+			CmdExportFlags{Format: "nftables-set", ValueField: "name"},
+			"set networks_v4 {\n\ttype ipv4_addr\n\tflags interval\n\telements = {\n" +
+				"\t\t1.0.1.0/24,\n\t\t1.0.2.0/24,\n\t\t1.0.4.0/24,\n\t}\n}\n" +
+				"set networks_v6 {\n\ttype ipv6_addr\n\tflags interval\n}\n",
+		},
+	} {
+		if out := export(tc.f); out != tc.expected {
+			t.Errorf("%+v: expected:\n%s\ngot:\n%s", tc.f, tc.expected, out)
+		}
+	}
+
+	for _, f := range []CmdExportFlags{
+		{Format: "haproxy-map"},
+		{Format: "nginx-geo", ValueField: "country", Ranges: true},
+		{Format: "nginx-geo", ValueField: "country", SetName: "geo"},
+		{Format: "ipset", SetName: "bad-name"},
+		{Format: "csv", ValueField: "country"},
+	} {
+		f.Out = filepath.Join(tempDir, "out.conf")
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", f, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_ESBulk(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+
+	outputFile := filepath.Join(tempDir, "bulk.ndjson")
+	mappingFile := filepath.Join(tempDir, "mapping.json")
+	f := CmdExportFlags{
+		Format:  "es-bulk",
+		Out:     outputFile,
+		Index:   "geo",
+		Fields:  []string{"asn", "country.iso_code:cc"},
+		Mapping: mappingFile,
+		Quiet:   true,
+	}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	lines := parseJSONLines(t, outputFile)
+	expected := []map[string]interface{}{
+		{"index": map[string]interface{}{"_index": "geo", "_id": "167.153.128.0/17"}},
+		{"range": "167.153.128.0/17", "asn": float64(22252), "cc": "US"},
+		{"index": map[string]interface{}{"_index": "geo", "_id": "204.138.232.0/24"}},
+		{"range": "204.138.232.0/24", "asn": float64(14836), "cc": "CA"},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+
+	mapping, err := os.ReadFile(mappingFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var props struct {
+		Mappings struct {
+			Properties map[string]map[string]string
+		}
+	}
+	if err := json.Unmarshal(mapping, &props); err != nil {
+		t.Fatalf("invalid mapping: %s", err.Error())
+	}
+	expectedProps := map[string]map[string]string{
+		"range": {"type": "ip_range"},
+		"asn":   {"type": "long"},
+		"cc":    {"type": "keyword"},
+	}
+	if !reflect.DeepEqual(props.Mappings.Properties, expectedProps) {
+		t.Errorf("expected mapping %v, got %v", expectedProps, props.Mappings.Properties)
+	}
+
+	// ranges which aren't a single network are gte/lte objects.
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	rangesFile := filepath.Join(tempDir, "ranges.mmdb")
+	csvData := "range,country\n1.0.1.0/24,AU\n1.0.2.0/23,AU\n"
+	if err := os.WriteFile(inputCSV, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = rangesFile
+	imf.NoNetwork = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+	f = CmdExportFlags{Format: "es-bulk", Out: outputFile, Ranges: true, DocID: "none", Quiet: true}
+	if err := CmdExport(f, []string{rangesFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	lines = parseJSONLines(t, outputFile)
+	expected = []map[string]interface{}{
+		{"index": map[string]interface{}{"_index": "networks"}},
+		{
+			"range":   map[string]interface{}{"gte": "1.0.1.0", "lte": "1.0.3.255"},
+			"country": "AU",
+		},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+
+	for _, f := range []CmdExportFlags{
+		{Format: "es-bulk", Index: "Geo"},
+		{Format: "es-bulk", DocID: "uuid"},
+		{Format: "es-bulk", DocID: "offset"},
+		{Format: "es-bulk", Ranges: true, Decimal: true},
+		{Format: "json", Index: "geo"},
+	} {
+		f.Out = outputFile
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", f, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_ClickHouse(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+
+	outputFile := filepath.Join(tempDir, "geo.tsv")
+	ddlFile := filepath.Join(tempDir, "geo.sql")
+	f := CmdExportFlags{
+		Format: "clickhouse",
+		Out:    outputFile,
+		Table:  "geo",
+		DDL:    ddlFile,
+		Fields: []string{"asn", "anycast", "name", "country"},
+		Quiet:  true,
+	}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	out, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "prefix\tasn\tanycast\tname\tcountry\n" +
+		"167.153.128.0/17\t22252\ttrue\tit's a\\ttab\t{\"geoname_id\":6252001,\"iso_code\":\"US\"}\n" +
+		"204.138.232.0/24\t14836\t\\N\t\\N\t{\"iso_code\":\"CA\"}\n"
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+
+	ddl, err := os.ReadFile(ddlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `CREATE DICTIONARY "geo"
+(
+  "prefix" String,
+  "asn" UInt32,
+  "anycast" Bool,
+  "name" String,
+  "country" String
+)
+PRIMARY KEY "prefix"
+SOURCE(FILE(path 'geo.tsv' format 'TabSeparatedWithNames'))
+LAYOUT(IP_TRIE)
+LIFETIME(0);
+`
+	if string(ddl) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, ddl)
+	}
+
+	for _, f := range []CmdExportFlags{
+		{Format: "clickhouse", Ranges: true},
+		{Format: "csv", DDL: ddlFile},
+	} {
+		f.Out = outputFile
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", f, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_GeoJSON(t *testing.T) {
+	tempDir := t.TempDir()
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	mmdbFile := filepath.Join(tempDir, "geo.mmdb")
+
+	// the Sydney networks aren't adjacent, and the last has no location.
+	csvData := `range,loc,lat,lng,city
+1.0.0.0/24,"-33.8688,151.2093",-33.8688,151.2093,Sydney
+1.0.2.0/24,"-33.8688,151.2093",-33.8688,151.2093,Sydney
+1.0.4.0/24,"40.7128,-74.0060",40.7,-74,New York
+1.0.5.0/24,,,,Nowhere
+`
+	if err := os.WriteFile(inputCSV, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = mmdbFile
+	imf.NoNetwork = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+
+	export := func(f CmdExportFlags) []byte {
+		t.Helper()
+		f.Out = filepath.Join(tempDir, "out.geojson")
+		f.Quiet = true
+		if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		out, err := os.ReadFile(f.Out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	type feature struct {
+		Type     string
+		Geometry struct {
+			Type        string
+			Coordinates []float64
+		}
+		Properties map[string]interface{}
+	}
+	var collection struct {
+		Type     string
+		Features []feature
+	}
+
+	// the format is inferred, and the loc field detected.
+	out := export(CmdExportFlags{Fields: []string{"city"}})
+	if err := json.Unmarshal(out, &collection); err != nil {
+		t.Fatalf("invalid GeoJSON: %s\n%s", err.Error(), out)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 3 {
+		t.Fatalf("expected a FeatureCollection of 3 features, got:\n%s", out)
+	}
+	f := collection.Features[2]
+	if f.Type != "Feature" || f.Geometry.Type != "Point" ||
+		!reflect.DeepEqual(f.Geometry.Coordinates, []float64{-74.006, 40.7128}) {
+		t.Errorf("unexpected feature %+v", f)
+	}
+	expectedProps := map[string]interface{}{"range": "1.0.4.0/24", "city": "New York"}
+	if !reflect.DeepEqual(f.Properties, expectedProps) {
+		t.Errorf("expected properties %v, got %v", expectedProps, f.Properties)
+	}
+
+	// chosen latitude and longitude fields, as a sequence.
+	out = export(CmdExportFlags{Coords: []string{"lat", "lng"}, GeoJSONSeq: true, Fields: []string{"city"}})
+	records := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(records) != 3 {
+		t.Fatalf("expected 3 features, got:\n%s", out)
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(record, "\x1e") {
+			t.Errorf("expected record separator before %q", record)
+		}
+		var f feature
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(record, "\x1e")), &f); err != nil {
+			t.Fatalf("invalid GeoJSON: %s", err.Error())
+		}
+	}
+	if !strings.Contains(records[2], `"coordinates":[-74,40.7]`) {
+		t.Errorf("expected lat/lng coordinates, got %q", records[2])
+	}
+
+	// aggregated per location.
+	out = export(CmdExportFlags{PerLoc: true})
+	collection.Features = nil
+	if err := json.Unmarshal(out, &collection); err != nil {
+		t.Fatalf("invalid GeoJSON: %s\n%s", err.Error(), out)
+	}
+	if len(collection.Features) != 2 {
+		t.Fatalf("expected 2 features, got:\n%s", out)
+	}
+	expectedProps = map[string]interface{}{
+		"networks":      []interface{}{"1.0.0.0/24", "1.0.2.0/24"},
+		"network_count": float64(2),
+	}
+	if props := collection.Features[0].Properties; !reflect.DeepEqual(props, expectedProps) {
+		t.Errorf("expected properties %v, got %v", expectedProps, props)
+	}
+
+	for _, f := range []CmdExportFlags{
+		{Format: "geojson", Coords: []string{"a", "b", "c"}},
+		{Format: "geojson", PerLoc: true, Fields: []string{"city"}},
+		{Format: "json", PerLoc: true},
+	} {
+		f.Out = filepath.Join(tempDir, "out.geojson")
+		err := CmdExport(f, []string{mmdbFile}, func() {})
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", f, ExitUsage, code, err)
+		}
+	}
+}
+
+// createManyRecordsTestMMDB writes an MMDB of n IPv4 /24 networks, cycling
+// through the given number of unique records so that adjacent networks
+// don't share one.
+func createManyRecordsTestMMDB(tb testing.TB, outputPath string, n int, records int) {
+	tb.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{IPVersion: 6, RecordSize: 32})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := range n {
+		j := i % records
+		network := &net.IPNet{
+			IP:   net.IPv4(byte(1+i>>16), byte(i>>8), byte(i), 0).To4(),
+			Mask: net.CIDRMask(24, 32),
+		}
+		record := mmdbtype.Map{
+			"asn":  mmdbtype.Uint32(j),
+			"name": mmdbtype.String("org " + strings.Repeat("x", j%16)),
+			"location": mmdbtype.Map{
+				"latitude":  mmdbtype.Float64(float64(j%180) - 90),
+				"longitude": mmdbtype.Float64(float64(j%360) - 180),
+			},
+			"tags": mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.Uint32(j)},
+		}
+		if err := tree.Insert(network, record); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	out, err := os.Create(outputPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := tree.WriteTo(out); err != nil {
+		tb.Fatal(err)
+	}
+	out.Close()
+}
+
+func TestExport_ParallelBoundedCache(t *testing.T) {
+	mmdbFile := filepath.Join(t.TempDir(), "many.mmdb")
+	createManyRecordsTestMMDB(t, mmdbFile, 3000, 500)
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	export := func(opts ExportOptions) (string, string) {
+		t.Helper()
+		var out, records bytes.Buffer
+		if opts.Format == "json" {
+			opts.NormalizedRecords = &records
+		}
+		stats, err := Export(context.Background(), db, opts, &out)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %s", opts, err.Error())
+		}
+		if stats.Networks != 3000 {
+			t.Errorf("%+v: expected 3000 networks, got %d", opts, stats.Networks)
+		}
+		return out.String(), records.String()
+	}
+
+	// rows are written in order whatever the workers and cache size.
+	for _, format := range []string{"csv", "tsv", "json"} {
+		expected, expectedRecords := export(ExportOptions{Format: format})
+		for _, opts := range []ExportOptions{
+			{Format: format, CacheSize: 7},
+			{Format: format, Workers: 4},
+			{Format: format, Workers: 3, CacheSize: 1},
+		} {
+			out, records := export(opts)
+			if out != expected || records != expectedRecords {
+				t.Errorf("%+v: output differs from the serial export", opts)
+			}
+		}
+	}
+
+	for _, opts := range []ExportOptions{
+		{Format: "csv", CacheSize: -1},
+		{Format: "parquet", Workers: 2},
+	} {
+		_, err := Export(context.Background(), db, opts, io.Discard)
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", opts, ExitUsage, code, err)
+		}
+	}
+}
+
+func BenchmarkExport(b *testing.B) {
+	mmdbFile := filepath.Join(b.TempDir(), "many.mmdb")
+	createManyRecordsTestMMDB(b, mmdbFile, 1<<16, 1<<14)
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, format := range []string{"csv", "json"} {
+		for _, workers := range []int{1, 4} {
+			// a cache which holds all records, and one which mostly misses.
+			for _, cacheSize := range []int{defaultCacheSize, 1 << 10} {
+				name := fmt.Sprintf("%s/workers=%d/cache=%d", format, workers, cacheSize)
+				b.Run(name, func(b *testing.B) {
+					opts := ExportOptions{
+						Format:    format,
+						Fields:    []string{"asn", "name", "location.latitude", "tags"},
+						Workers:   workers,
+						CacheSize: cacheSize,
+					}
+					for b.Loop() {
+						if _, err := Export(context.Background(), db, opts, io.Discard); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestExport_Shards(t *testing.T) {
+	tempDir := t.TempDir()
+	manyFile := filepath.Join(tempDir, "many.mmdb")
+	createManyRecordsTestMMDB(t, manyFile, 3000, 500)
+
+	// a few IPv4 and IPv6 networks, one of which is far larger than the
+	// shards would be.
+	mixedFile := filepath.Join(tempDir, "mixed.mmdb")
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		IPVersion:               6,
+		RecordSize:              32,
+		IncludeReservedNetworks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cidr := range []string{
+		"1.2.3.0/24", "64.0.0.0/2", "200.1.0.0/16", "2001:db8::/32", "2400:cb00::/32", "2a00::/12",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		if err := tree.Insert(network, mmdbtype.Map{"id": mmdbtype.Uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := os.Create(mixedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	for _, mmdbFile := range []string{manyFile, mixedFile} {
+		db, err := maxminddb.Open(mmdbFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, format := range []string{"csv", "tsv", "json"} {
+			var expected bytes.Buffer
+			expectedStats, err := Export(context.Background(), db, ExportOptions{Format: format}, &expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// merged shards are written as a single export.
+			for _, opts := range []ExportOptions{
+				{Format: format, Shards: 4},
+				{Format: format, Shards: 64, Workers: 2},
+				{Format: format, Shards: 3, Within: []netip.Prefix{
+					netip.MustParsePrefix("1.0.0.0/8"), netip.MustParsePrefix("2000::/3"),
+				}},
+			} {
+				var out bytes.Buffer
+				stats, err := Export(context.Background(), db, opts, &out)
+				if err != nil {
+					t.Fatalf("%v %+v: unexpected error: %s", mmdbFile, opts, err.Error())
+				}
+				if len(opts.Within) > 0 {
+					continue
+				}
+				if out.String() != expected.String() || stats != expectedStats {
+					t.Errorf("%v %+v: output differs from the unsharded export", mmdbFile, opts)
+				}
+			}
+
+			// shard outputs are each a whole export, with a header.
+			var shards []*bytes.Buffer
+			opts := ExportOptions{
+				Format: format,
+				Shards: 64,
+				ShardOutput: func(shard int) (io.Writer, error) {
+					if shard != len(shards) {
+						t.Errorf("expected shard %d, got %d", len(shards), shard)
+					}
+					shards = append(shards, &bytes.Buffer{})
+					return shards[shard], nil
+				},
+			}
+			stats, err := Export(context.Background(), db, opts, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats != expectedStats {
+				t.Errorf("%v %v: expected %+v, got %+v", mmdbFile, format, expectedStats, stats)
+			}
+			if len(shards) < 2 || len(shards) > 64 {
+				t.Errorf("%v %v: expected 2 to 64 shards, got %d", mmdbFile, format, len(shards))
+			}
+			var rows string
+			for _, shard := range shards {
+				if format == "json" {
+					rows += shard.String()
+					continue
+				}
+				hdr, body, _ := strings.Cut(shard.String(), "\n")
+				if !strings.HasPrefix(hdr, "range") {
+					t.Errorf("%v %v: expected a header in each shard, got %q", mmdbFile, format, hdr)
+				}
+				rows += body
+			}
+			_, expectedRows, _ := strings.Cut(expected.String(), "\n")
+			if format == "json" {
+				expectedRows = expected.String()
+			}
+			if rows != expectedRows {
+				t.Errorf("%v %v: shard rows differ from the unsharded export", mmdbFile, format)
+			}
+		}
+	}
+
+	db, err := maxminddb.Open(mixedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the /2 network and the /12 IPv6 network aren't split.
+	var shards int
+	opts := ExportOptions{
+		Format: "csv",
+		Shards: 1000,
+		ShardOutput: func(int) (io.Writer, error) {
+			shards++
+			return io.Discard, nil
+		},
+	}
+	if _, err := Export(context.Background(), db, opts, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if shards != 6 {
+		t.Errorf("expected a shard per network, got %d", shards)
+	}
+
+	for _, opts := range []ExportOptions{
+		{Format: "csv", Shards: -1},
+		{Format: "parquet", Shards: 2},
+		{Format: "csv", Shards: 2, Ranges: true},
+		{Format: "csv", Shards: 2, NormalizedRecords: io.Discard},
+	} {
+		_, err := Export(context.Background(), db, opts, io.Discard)
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", opts, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_ShardFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+
+	f := CmdExportFlags{Out: filepath.Join(tempDir, "geo.csv"), Shards: 4, ShardFiles: true, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	// the two networks make two shards, and no merged file.
+	for i, network := range []string{"167.153.128.0/17", "204.138.232.0/24"} {
+		data := parseCSV(t, filepath.Join(tempDir, fmt.Sprintf("geo.%04d.csv", i+1)))
+		assertRowCount(t, data, 1)
+		if data.rows[0]["range"] != network {
+			t.Errorf("expected shard %d to have %v, got %v", i+1, network, data.rows[0]["range"])
+		}
+	}
+	for _, name := range []string{"geo.csv", "geo.0003.csv"} {
+		if _, err := os.Stat(filepath.Join(tempDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected no %v", name)
+		}
+	}
+
+	f = CmdExportFlags{Shards: 4, ShardFiles: true, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); ExitCode(err) != ExitUsage {
+		t.Errorf("expected a usage error for shard files without an output file, got %v", err)
+	}
+
+	f = CmdExportFlags{Out: filepath.Join(tempDir, "norm.csv"), Normalized: true, ShardFiles: true, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); ExitCode(err) != ExitUsage {
+		t.Errorf("expected a usage error for normalized shard files, got %v", err)
+	}
+}
+
+// splitBuffer is an output of a split export in memory.
+type splitBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *splitBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestExport_SplitBy(t *testing.T) {
+	mmdbFile := filepath.Join(t.TempDir(), "many.mmdb")
+	createManyRecordsTestMMDB(t, mmdbFile, 300, 10)
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, format := range []string{"csv", "tsv", "json"} {
+		// the values alternate, so outputs are closed and reopened all the
+		// time.
+		outputs := make(map[string]*splitBuffer)
+		opts := ExportOptions{
+			Format:        format,
+			Fields:        []string{"asn", "name"},
+			SplitBy:       "asn",
+			MaxOpenSplits: 3,
+			SplitOutput: func(value string, appending bool) (io.WriteCloser, error) {
+				out, ok := outputs[value]
+				if ok != appending || (ok && !out.closed) {
+					t.Fatalf("%v: unexpected open of %q, appending %v", format, value, appending)
+				}
+				if !ok {
+					out = &splitBuffer{}
+					outputs[value] = out
+				}
+				open := 0
+				for _, other := range outputs {
+					if other != out && !other.closed {
+						open++
+					}
+				}
+				if open >= 3 {
+					t.Fatalf("%v: more than 3 outputs open", format)
+				}
+				out.closed = false
+				return out, nil
+			},
+		}
+		if _, err := Export(context.Background(), db, opts, io.Discard); err != nil {
+			t.Fatalf("%v: unexpected error: %s", format, err.Error())
+		}
+		if len(outputs) != 10 {
+			t.Errorf("%v: expected 10 outputs, got %d", format, len(outputs))
+		}
+
+		// each output is the export of the networks with its value.
+		for value, out := range outputs {
+			if !out.closed {
+				t.Errorf("%v: expected the output of %q to be closed", format, value)
+			}
+			var expected bytes.Buffer
+			_, err := Export(context.Background(), db, ExportOptions{
+				Format: format,
+				Fields: []string{"asn", "name"},
+				Where:  "asn == " + value,
+			}, &expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != expected.String() {
+				t.Errorf("%v: output of %q differs:\n%s\nexpected:\n%s", format, value, out.String(), expected.String())
+			}
+		}
+	}
+
+	for _, opts := range []ExportOptions{
+		{Format: "parquet", SplitBy: "asn", SplitOutput: func(string, bool) (io.WriteCloser, error) { return nil, nil }},
+		{Format: "csv", SplitBy: "asn"},
+		{Format: "csv", SplitBy: "asn", Shards: 2, SplitOutput: func(string, bool) (io.WriteCloser, error) { return nil, nil }},
+		{Format: "csv", SplitOutput: func(string, bool) (io.WriteCloser, error) { return nil, nil }},
+	} {
+		_, err := Export(context.Background(), db, opts, io.Discard)
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%+v: expected exit code %d, got %d (%v)", opts, ExitUsage, code, err)
+		}
+	}
+}
+
+func TestCmdExport_SplitBy(t *testing.T) {
+	tempDir := t.TempDir()
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	mmdbFile := filepath.Join(tempDir, "split.mmdb")
+	csvData := `range,country,org
+1.0.0.0/24,AU,AS 13335
+1.0.2.0/24,CN,AS 4134
+1.0.3.0/24,AU,
+1.0.4.0/24,,AS 4134
+`
+	if err := os.WriteFile(inputCSV, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = mmdbFile
+	imf.NoNetwork = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+
+	outDir := filepath.Join(tempDir, "by-org")
+	f := CmdExportFlags{SplitBy: "org", OutDir: outDir, MaxOpen: 1, Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"AS%2013335.csv", "AS%204134.csv"}) {
+		t.Fatalf("unexpected files %v", names)
+	}
+	data := parseCSV(t, filepath.Join(outDir, "AS%204134.csv"))
+	assertRowCount(t, data, 2)
+	assertCSVContains(t, data, map[string]string{"range": "1.0.2.0/24", "country": "CN", "org": "AS 4134"})
+	assertCSVContains(t, data, map[string]string{"range": "1.0.4.0/24", "country": "", "org": "AS 4134"})
+
+	for _, f := range []CmdExportFlags{
+		{SplitBy: "org"},
+		{OutDir: outDir},
+		{SplitBy: "org", OutDir: outDir, Out: filepath.Join(tempDir, "out.csv")},
+	} {
+		f.Quiet = true
+		if err := CmdExport(f, []string{mmdbFile}, func() {}); ExitCode(err) != ExitUsage {
+			t.Errorf("%+v: expected a usage error, got %v", f, err)
+		}
+	}
+
+	// invalid options are rejected before the output directory is created.
+	badDir := filepath.Join(tempDir, "bad")
+	f = CmdExportFlags{SplitBy: "org", OutDir: badDir, Format: "parquet", Quiet: true}
+	if err := CmdExport(f, []string{mmdbFile}, func() {}); ExitCode(err) != ExitUsage {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+	if _, err := os.Stat(badDir); !os.IsNotExist(err) {
+		t.Errorf("expected %v not to be created, got %v", badDir, err)
+	}
+}
+
+func TestTsvEscapeRoundTrip(t *testing.T) {
+	records := [][]string{
+		{"range", "name"},
+		{"tab\there", "new\nline"},
+		{"carriage\r\n", `back\slash`},
+		{`literal \t`, `trailing\`},
+		{"", `\\\n`},
+	}
+	var buf bytes.Buffer
+	wr := NewTsvWriter(&buf)
+	wr.Escape = true
+	for _, record := range records {
+		if err := wr.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wr.Flush()
+	if err := wr.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != len(records) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(records), lines, buf.String())
+	}
+
+	rdr := NewTsvReader(&buf)
+	rdr.Unescape = true
+	for _, expected := range records {
+		record, err := rdr.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(record, expected) {
+			t.Errorf("expected %q, got %q", expected, record)
+		}
+	}
+
+	// unknown escapes are kept as is.
+	if got := tsvUnescape(`a\b\`); got != `a\b\` {
+		t.Errorf(`expected "a\b\", got %q`, got)
+	}
+}
+
+func TestCmdExport_TSVEscapeRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "escapes.mmdb")
+	tsvFile := filepath.Join(tempDir, "escapes.tsv")
+	roundTripFile := filepath.Join(tempDir, "roundtrip.mmdb")
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{IPVersion: 6, RecordSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]mmdbtype.Map{
+		"1.0.0.0/24": {"name": mmdbtype.String("tab\there"), "org": mmdbtype.String("new\nline")},
+		"1.0.1.0/24": {"name": mmdbtype.String(`back\slash`), "org": mmdbtype.String("carriage\r")},
+		"1.0.2.0/24": {"name": mmdbtype.String(`literal \t`), "org": mmdbtype.String("plain")},
+	}
+	for cidr, record := range records {
+		_, network, _ := net.ParseCIDR(cidr)
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := os.Create(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	// unescaped values break rows and columns, as before.
+	ef := CmdExportFlags{Format: "tsv", Out: tsvFile, Quiet: true}
+	if err := CmdExport(ef, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected export error: %s", err.Error())
+	}
+	raw, err := os.ReadFile(tsvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(raw), "\n"); lines != 5 {
+		t.Errorf("expected the unescaped export to have 5 lines, got %d", lines)
+	}
+
+	ef.TSVEscape = true
+	if err := CmdExport(ef, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected export error: %s", err.Error())
+	}
+	raw, err = os.ReadFile(tsvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(raw), "\n"); lines != 4 {
+		t.Errorf("expected the escaped export to have 4 lines, got %d:\n%s", lines, raw)
+	}
+
+	imf := CmdImportFlagsDefaults
+	imf.In = tsvFile
+	imf.Out = roundTripFile
+	imf.NoNetwork = true
+	imf.TsvEscape = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("unexpected import error: %s", err.Error())
+	}
+
+	db, err := maxminddb.Open(roundTripFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for cidr, expected := range records {
+		var record map[string]string
+		prefix := netip.MustParsePrefix(cidr)
+		if err := db.Lookup(prefix.Addr()).Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range expected {
+			if record[string(k)] != string(v.(mmdbtype.String)) {
+				t.Errorf("%v: expected %v %q, got %q", cidr, k, v, record[string(k)])
+			}
+		}
+	}
+
+	ef = CmdExportFlags{Format: "csv", TSVEscape: true, Quiet: true}
+	if err := CmdExport(ef, []string{mmdbFile}, func() {}); ExitCode(err) != ExitUsage {
+		t.Errorf("expected a usage error for escaping csv, got %v", err)
+	}
+}
+
+func TestCmdExport_TypedHeaderRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	roundTripFile := filepath.Join(tempDir, "roundtrip.mmdb")
+
+	records := createTypedTestMMDB(t, mmdbFile)
+
+	// values of the same type come back as is, and values of mixed types as
+	// strings.
+	expectedRecords := maps.Clone(records)
+	expectedRecords["204.138.232.0/24"] = maps.Clone(records["204.138.232.0/24"])
+	expectedRecords["204.138.232.0/24"]["mixed"] = mmdbtype.String("3")
+
+	for _, format := range []string{"csv", "tsv"} {
+		for _, flatten := range []bool{false, true} {
+			name := format
+			if flatten {
+				name += "-flatten"
+			}
+			t.Run(name, func(t *testing.T) {
+				outFile := filepath.Join(tempDir, "typed."+format)
+				ef := CmdExportFlags{
+					Format:    format,
+					Out:       outFile,
+					TypedHdr:  true,
+					Flatten:   flatten,
+					TSVEscape: format == "tsv",
+					Quiet:     true,
+				}
+				if err := CmdExport(ef, []string{mmdbFile}, func() {}); err != nil {
+					t.Fatalf("unexpected export error: %s", err.Error())
+				}
+				raw, err := os.ReadFile(outFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				hdr, _, _ := strings.Cut(string(raw), "\n")
+				for _, col := range []string{"asn:uint32", "ratio:float32", "raw:bytes", "anycast:bool", "mixed:mixed"} {
+					if !strings.Contains(hdr, col) {
+						t.Errorf("expected header to have %q, got %q", col, hdr)
+					}
+				}
+
+				imf := CmdImportFlagsDefaults
+				imf.In = outFile
+				imf.Out = roundTripFile
+				imf.TypedHdr = true
+				imf.Unflatten = flatten
+				imf.TsvEscape = format == "tsv"
+				imf.Quiet = true
+				if err := CmdImport(imf, []string{}, func() {}); err != nil {
+					t.Fatalf("unexpected import error: %s", err.Error())
+				}
+
+				db, err := maxminddb.Open(roundTripFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+				for cidr, expected := range expectedRecords {
+					prefix := netip.MustParsePrefix(cidr)
+					got, err := decodeTypedRecord(db.Lookup(prefix.Addr()))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(got, expected) {
+						t.Errorf("%v: expected record %#v, got %#v", cidr, expected, got)
+					}
+				}
+			})
+		}
+	}
+
+	ef := CmdExportFlags{Format: "json", TypedHdr: true, Quiet: true}
+	if err := CmdExport(ef, []string{mmdbFile}, func() {}); ExitCode(err) != ExitUsage {
+		t.Errorf("expected a usage error for a typed json header, got %v", err)
+	}
+}
+
+func TestCmdExport_TypedHeaderEmptyStrings(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "strings.mmdb")
+	outFile := filepath.Join(tempDir, "strings.csv")
+	roundTripFile := filepath.Join(tempDir, "roundtrip.mmdb")
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{IPVersion: 6, RecordSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]mmdbtype.Map{
+		"1.0.0.0/24": {"name": mmdbtype.String(""), "note": mmdbtype.String(`"quoted"`)},
+		"1.0.1.0/24": {"note": mmdbtype.String("plain")},
+	}
+	for cidr, record := range records {
+		_, network, _ := net.ParseCIDR(cidr)
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := os.Create(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	ef := CmdExportFlags{Format: "csv", Out: outFile, TypedHdr: true, Quiet: true}
+	if err := CmdExport(ef, []string{mmdbFile}, func() {}); err != nil {
+		t.Fatalf("unexpected export error: %s", err.Error())
+	}
+	raw, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `range,name:string,note:string
+1.0.0.0/24,"""""","""\""quoted\"""""
+1.0.1.0/24,,plain
+`
+	if string(raw) != expected {
+		t.Errorf("expected %q, got %q", expected, string(raw))
+	}
+
+	// the empty string is kept, while the missing field is left out.
+	imf := CmdImportFlagsDefaults
+	imf.In = outFile
+	imf.Out = roundTripFile
+	imf.TypedHdr = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("unexpected import error: %s", err.Error())
+	}
+	db, err := maxminddb.Open(roundTripFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for cidr, expected := range records {
+		got, err := decodeTypedRecord(db.Lookup(netip.MustParsePrefix(cidr).Addr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%v: expected record %#v, got %#v", cidr, expected, got)
+		}
+	}
+}
+
+func TestParseTypedColumn(t *testing.T) {
+	tests := []struct {
+		col  string
+		name string
+		typ  string
+	}{
+		{"asn:uint32", "asn", "uint32"},
+		{"name", "name", ""},
+		{"a:b:float64", "a:b", "float64"},
+		{"time:12:00", "time:12:00", ""},
+		{"tags:slice[string]", "tags", "slice[string]"},
+		{"empty:slice[]", "empty", "slice[]"},
+		{`m:map{"a:b":map{x:bool},c:slice[uint16]}`, "m", `map{"a:b":map{x:bool},c:slice[uint16]}`},
+		{"m:map{a:nope}", "m:map{a:nope}", ""},
+	}
+	for _, tt := range tests {
+		name, ft := parseTypedColumn(tt.col)
+		typ := ""
+		if ft != nil {
+			typ = ft.annotation()
+		}
+		if name != tt.name || typ != tt.typ {
+			t.Errorf("%q: expected %q of type %q, got %q of type %q", tt.col, tt.name, tt.typ, name, typ)
+		}
+	}
+}
@@ -1,20 +1,14 @@
 package lib
 
 import (
-	"bufio"
-	"encoding/csv"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"net"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/ipinfo/cli/lib/iputil"
 	"github.com/maxmind/mmdbwriter"
-	"github.com/maxmind/mmdbwriter/inserter"
 	"github.com/maxmind/mmdbwriter/mmdbtype"
 	"github.com/spf13/pflag"
 )
@@ -27,12 +21,16 @@ type CmdImportFlags struct {
 	Csv                 bool
 	Tsv                 bool
 	Json                bool
+	Parquet             bool
 	Fields              []string
 	FieldsFromHdr       bool
 	RangeMultiCol       bool
 	JoinKeyCol          bool
 	NoFields            bool
 	NoNetwork           bool
+	Unflatten           bool
+	TypedHdr            bool
+	TsvEscape           bool
 	Ip                  int
 	Size                int
 	Merge               string
@@ -40,6 +38,7 @@ type CmdImportFlags struct {
 	DisallowReserved    bool
 	Alias6to4           bool
 	DisableMetadataPtrs bool
+	Quiet               bool
 }
 
 var CmdImportFlagsDefaults = CmdImportFlags{
@@ -49,12 +48,16 @@ var CmdImportFlagsDefaults = CmdImportFlags{
 	Csv:                 false,
 	Tsv:                 false,
 	Json:                false,
+	Parquet:             false,
 	Fields:              nil,
 	FieldsFromHdr:       false,
 	RangeMultiCol:       false,
 	JoinKeyCol:          false,
 	NoFields:            false,
 	NoNetwork:           false,
+	Unflatten:           false,
+	TypedHdr:            false,
+	TsvEscape:           false,
 	Ip:                  6,
 	Size:                32,
 	Merge:               "none",
@@ -62,6 +65,7 @@ var CmdImportFlagsDefaults = CmdImportFlags{
 	DisallowReserved:    false,
 	Alias6to4:           false,
 	DisableMetadataPtrs: true,
+	Quiet:               false,
 }
 
 // Init initializes the common flags available to CmdImport with sensible
@@ -100,6 +104,11 @@ func (f *CmdImportFlags) Init() {
 		"json", "j", CmdImportFlagsDefaults.Json,
 		_h,
 	)
+	pflag.BoolVar(
+		&f.Parquet,
+		"parquet", CmdImportFlagsDefaults.Parquet,
+		_h,
+	)
 	pflag.StringSliceVarP(
 		&f.Fields,
 		"fields", "f", CmdImportFlagsDefaults.Fields,
@@ -130,6 +139,21 @@ func (f *CmdImportFlags) Init() {
 		"no-network", CmdImportFlagsDefaults.NoNetwork,
 		_h,
 	)
+	pflag.BoolVar(
+		&f.Unflatten,
+		"unflatten", CmdImportFlagsDefaults.Unflatten,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.TypedHdr,
+		"typed-header", CmdImportFlagsDefaults.TypedHdr,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.TsvEscape,
+		"tsv-escape", CmdImportFlagsDefaults.TsvEscape,
+		_h,
+	)
 	pflag.IntVar(
 		&f.Ip,
 		"ip", CmdImportFlagsDefaults.Ip,
@@ -165,10 +189,25 @@ func (f *CmdImportFlags) Init() {
 		"disable-metadata-pointers", CmdImportFlagsDefaults.DisableMetadataPtrs,
 		_h,
 	)
-
+	pflag.BoolVarP(
+		&f.Quiet,
+		"quiet", "q", CmdImportFlagsDefaults.Quiet,
+		_h,
+	)
 }
 
 func CmdImport(f CmdImportFlags, args []string, printHelp func()) error {
+	return CmdImportContext(context.Background(), f, args, printHelp)
+}
+
+// CmdImportContext is like CmdImport, but stops early with an ExitInterrupted
+// error once ctx is cancelled.
+func CmdImportContext(
+	ctx context.Context,
+	f CmdImportFlags,
+	args []string,
+	printHelp func(),
+) error {
 	// help?
 	if f.Help || (pflag.NArg() == 1 && pflag.NFlag() == 0) {
 		printHelp()
@@ -181,75 +220,44 @@ func CmdImport(f CmdImportFlags, args []string, printHelp func()) error {
 		f.Out = args[1]
 	}
 
-	// validate IP version.
-	if f.Ip != 4 && f.Ip != 6 {
-		return errors.New("ip version must be \"4\" or \"6\"")
-	}
-
-	// validate record size.
-	if f.Size != 24 && f.Size != 28 && f.Size != 32 {
-		return errors.New("record size must be 24, 28 or 32")
-	}
-
-	// validate merge strategy.
-	var mergeStrategy inserter.FuncGenerator
-	if f.Merge == "none" {
-		mergeStrategy = inserter.ReplaceWith
-	} else if f.Merge == "toplevel" {
-		mergeStrategy = inserter.TopLevelMergeWith
-	} else if f.Merge == "recurse" {
-		mergeStrategy = inserter.DeepMergeWith
-	} else {
-		return errors.New("merge strategy must be \"none\", \"toplevel\" or \"recurse\"")
-	}
+	opts := f.importOptions()
 
 	// figure out file type.
-	var delim rune
-	if !f.Csv && !f.Tsv && !f.Json {
+	typeCnt := 0
+	for _, set := range []bool{f.Csv, f.Tsv, f.Json, f.Parquet} {
+		if set {
+			typeCnt += 1
+		}
+	}
+	if typeCnt == 0 {
 		if strings.HasSuffix(f.In, ".csv") {
-			delim = ','
+			opts.Format = "csv"
 		} else if strings.HasSuffix(f.In, ".tsv") {
-			delim = '\t'
+			opts.Format = "tsv"
 		} else if strings.HasSuffix(f.In, ".json") {
-			delim = '-'
+			opts.Format = "json"
+		} else if strings.HasSuffix(f.In, ".parquet") {
+			opts.Format = "parquet"
 		} else {
-			return errors.New("input file type unknown")
+			return usageError(errors.New("input file type unknown"))
 		}
 	} else {
-		if f.Csv && f.Tsv || f.Csv && f.Json || f.Tsv && f.Json {
-			return errors.New("multiple input file types specified")
+		if typeCnt > 1 {
+			return usageError(errors.New("multiple input file types specified"))
 		} else if f.Csv {
-			delim = ','
+			opts.Format = "csv"
 		} else if f.Tsv {
-			delim = '\t'
+			opts.Format = "tsv"
+		} else if f.Json {
+			opts.Format = "json"
 		} else {
-			delim = '-'
+			opts.Format = "parquet"
 		}
 	}
 
-	// figure out fields.
-	fieldSrcCnt := 0
-	if f.Fields != nil && len(f.Fields) > 0 {
-		fieldSrcCnt += 1
-	}
-	if f.FieldsFromHdr {
-		fieldSrcCnt += 1
-	}
-	if f.NoFields {
-		fieldSrcCnt += 1
-	}
-	if fieldSrcCnt > 1 {
-		return errors.New("conflicting field sources specified")
-	}
-	if f.NoFields {
-		f.Fields = []string{}
-		f.NoNetwork = false
-	} else if !f.FieldsFromHdr && (f.Fields == nil || len(f.Fields) == 0) {
-		f.FieldsFromHdr = true
-	}
-
-	if f.JoinKeyCol {
-		f.RangeMultiCol = true
+	// validate before touching any files.
+	if err := opts.validate(); err != nil {
+		return err
 	}
 
 	// prepare output file.
@@ -260,32 +268,11 @@ func CmdImport(f CmdImportFlags, args []string, printHelp func()) error {
 		var err error
 		outFile, err = os.Create(f.Out)
 		if err != nil {
-			return fmt.Errorf("could not create %v: %w", f.Out, err)
+			return ioError(fmt.Errorf("could not create %v: %w", f.Out, err))
 		}
 		defer outFile.Close()
 	}
 
-	// init tree.
-	dbdesc := "ipinfo " + filepath.Base(f.Out)
-	tree, err := mmdbwriter.New(
-		mmdbwriter.Options{
-			DatabaseType: dbdesc,
-			Description: map[string]string{
-				"en": dbdesc,
-			},
-			Languages:               []string{"en"},
-			DisableIPv4Aliasing:     !f.Alias6to4,
-			IncludeReservedNetworks: !f.DisallowReserved,
-			IPVersion:               f.Ip,
-			RecordSize:              f.Size,
-			DisableMetadataPointers: f.DisableMetadataPtrs,
-			Inserter:                mergeStrategy,
-		},
-	)
-	if err != nil {
-		return fmt.Errorf("could not create tree: %w", err)
-	}
-
 	// prepare input file.
 	var inFile *os.File
 	if f.In == "" || f.In == "-" {
@@ -294,308 +281,88 @@ func CmdImport(f CmdImportFlags, args []string, printHelp func()) error {
 		var err error
 		inFile, err = os.Open(f.In)
 		if err != nil {
-			return fmt.Errorf("invalid input file %v: %w", f.In, err)
+			return ioError(fmt.Errorf("invalid input file %v: %w", f.In, err))
 		}
 		defer inFile.Close()
 	}
 
-	inFileBuffered := bufio.NewReaderSize(inFile, 65536)
-
-	entrycnt := 0
-	if delim == ',' || delim == '\t' {
-		var rdr reader
-		if delim == ',' {
-			csvrdr := csv.NewReader(inFileBuffered)
-			csvrdr.Comma = delim
-			csvrdr.LazyQuotes = true
-
-			rdr = csvrdr
-		} else {
-			tsvrdr := NewTsvReader(inFileBuffered)
-
-			rdr = tsvrdr
-		}
-
-		// read from input, scanning & parsing each line according to delim,
-		// then insert that into the tree.
-		dataColStart := 1
-		hdrSeen := false
-		for {
-			parts, err := rdr.Read()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return fmt.Errorf("input scanning failed: %w", err)
-			}
-
-			// on header line?
-			if !hdrSeen {
-				hdrSeen = true
-
-				ParseCSVHeaders(parts, &f, &dataColStart)
-
-				// Now that f.Fields may have been resolved, the preprocessing step can be run
-				err = Preprocess(f, tree)
-				if err != nil {
-					return err
-				}
-
-				// should we skip this first line now?
-				if f.FieldsFromHdr {
-					continue
-				}
-			}
-
-			err = AppendCSVRecord(f, dataColStart, delim, parts, tree)
-			if err != nil {
-				return err
-			}
-
-			entrycnt += 1
-		}
-	} else if delim == '-' {
-		dataStream := json.NewDecoder(inFileBuffered)
-
-		// For JSON input, f.Fields may have been specified using the --fields flag, so preprocessing can be run
-		err = Preprocess(f, tree)
-		if err != nil {
-			return err
-		}
-
-		fieldsResolved := false
-		for {
-			// Decode one JSON document.
-			var row interface{}
-			err := dataStream.Decode(&row)
-
-			if err != nil {
-				// io.EOF is expected at end of stream.
-				if err != io.EOF {
-					return fmt.Errorf("error in io.EOF: %w", err)
-				}
-				break
-			}
-			mResult := row.(map[string]interface{})
-
-			if !fieldsResolved {
-				fieldsResolved = true
-				ParseJSONKeys(mResult, &f)
-			}
-
-			// convert 2 IPs into IP range?
-			var networkStr string
-			if val, ok := mResult["start_ip"].(string); ok {
-				networkStr = val + "-" + mResult["end_ip"].(string)
-				delete(mResult, "start_ip")
-				delete(mResult, "end_ip")
-				if _, ok := mResult["join_key"].(string); ok {
-					delete(mResult, "join_key")
-				}
-			} else if val, ok := mResult["range"].(string); ok {
-				networkStr = val
-				delete(mResult, "range")
-			} else {
-				return errors.New(
-					"couldn't get ip or range from the record",
-				)
-			}
-
-			// add network part to single-IP network if it's missing.
-			isNetworkRange := strings.Contains(networkStr, "-")
-			if !isNetworkRange && !strings.Contains(networkStr, "/") {
-				if f.Ip == 6 && strings.Contains(networkStr, ":") {
-					networkStr += "/128"
-				} else {
-					networkStr += "/32"
-				}
-			}
-			subMap := mmdbtype.Map{}
-			if !f.NoNetwork {
-				subMap["network"] = mmdbtype.String(networkStr)
-			}
-
-			// prep record.
-			errProcessData := ProcessJsonData(mResult, f, &subMap)
-			if errProcessData != nil {
-				return fmt.Errorf("failed to map to mmdb.type err: %w", errProcessData)
-			}
-
-			// range insertion or cidr insertion?
-			if isNetworkRange {
-				networkStrParts := strings.Split(networkStr, "-")
-				startIp := net.ParseIP(networkStrParts[0])
-				endIp := net.ParseIP(networkStrParts[1])
-				if err := tree.InsertRange(startIp, endIp, subMap); err != nil {
-					fmt.Fprintf(
-						os.Stderr, "warn: couldn't insert '%v'\n",
-						mResult,
-					)
-				}
-			} else {
-				_, network, err := net.ParseCIDR(networkStr)
-				if err != nil {
-					return fmt.Errorf(
-						"couldn't parse cidr \"%v\": %w",
-						networkStr, err,
-					)
-				}
-				if err := tree.Insert(network, subMap); err != nil {
-					fmt.Fprintf(
-						os.Stderr, "warn: couldn't insert '%v'\n",
-						mResult,
-					)
-				}
-			}
-
-			entrycnt += 1
+	stats, err := Import(ctx, opts, inFile, outFile)
+	if err != nil {
+		// a partially written mmdb file is useless; don't leave it behind.
+		if f.Out != "" && ExitCode(err) == ExitInterrupted {
+			outFile.Close()
+			os.Remove(f.Out)
 		}
+		return err
 	}
-
-	if entrycnt == 0 {
-		return errors.New("nothing to import")
+	if !f.Quiet && f.Out != "" {
+		fmt.Fprintf(os.Stderr, "writing to %s (%v entries)\n", f.Out, stats.Entries)
 	}
 
-	// write out mmdb file.
-	fmt.Fprintf(os.Stderr, "writing to %s (%v entries)\n", f.Out, entrycnt)
-	if _, err := tree.WriteTo(outFile); err != nil {
-		return fmt.Errorf("writing out to tree failed: %w", err)
+	if stats.Failed > 0 {
+		return &CmdError{
+			Code: ExitPartial,
+			Err:  fmt.Errorf("%v of %v entries couldn't be inserted", stats.Failed, stats.Entries),
+		}
 	}
 
 	return nil
 }
 
-func Preprocess(f CmdImportFlags, tree *mmdbwriter.Tree) error {
-	// insert empty values for all fields in 0.0.0.0/0 if requested.
-	if f.IgnoreEmptyVals {
-		_, network, _ := net.ParseCIDR("0.0.0.0/0")
-		record := mmdbtype.Map{}
-		for _, field := range f.Fields {
-			record[mmdbtype.String(field)] = mmdbtype.String("")
-		}
-		if err := tree.Insert(network, record); err != nil {
-			return errors.New(
-				"couldn't insert empty values to 0.0.0.0/0",
-			)
-		}
-	}
+// importOptions returns the Import options set by the flags; the input format
+// is left for the caller to determine.
+func (f *CmdImportFlags) importOptions() ImportOptions {
+	opts := ImportOptions{
+		Fields:              f.Fields,
+		FieldsFromHdr:       f.FieldsFromHdr,
+		RangeMultiCol:       f.RangeMultiCol,
+		JoinKeyCol:          f.JoinKeyCol,
+		NoFields:            f.NoFields,
+		NoNetwork:           f.NoNetwork,
+		Unflatten:           f.Unflatten,
+		TypedHeader:         f.TypedHdr,
+		TSVEscape:           f.TsvEscape,
+		Ip:                  f.Ip,
+		Size:                f.Size,
+		Merge:               f.Merge,
+		IgnoreEmptyVals:     f.IgnoreEmptyVals,
+		DisallowReserved:    f.DisallowReserved,
+		Alias6to4:           f.Alias6to4,
+		DisableMetadataPtrs: f.DisableMetadataPtrs,
+		DatabaseType:        "ipinfo " + filepath.Base(f.Out),
+		Log:                 os.Stderr,
+	}
+	if !f.Quiet {
+		opts.Progress = os.Stderr
+	}
+	return opts
+}
 
-	return nil
+func Preprocess(f CmdImportFlags, tree *mmdbwriter.Tree) error {
+	opts := f.importOptions()
+	return preprocess(&opts, tree)
 }
 
 func ParseCSVHeaders(parts []string, f *CmdImportFlags, dataColStart *int) {
-	// check if the header has a multi-column range.
-	if len(parts) > 1 && parts[0] == "start_ip" && parts[1] == "end_ip" {
-		f.RangeMultiCol = true
-
-		// maybe we also have a join key?
-		if len(parts) > 2 && parts[2] == "join_key" {
-			f.JoinKeyCol = true
-		}
-	}
-
-	if f.RangeMultiCol {
-		if f.JoinKeyCol {
-			*dataColStart = 3
-		} else {
-			*dataColStart = 2
-		}
-	}
-
-	// need to get fields from hdr?
-	if f.FieldsFromHdr {
-		// skip all non-data columns.
-		f.Fields = parts[*dataColStart:]
-	}
+	opts := f.importOptions()
+	parseCSVHeaders(parts, &opts, dataColStart)
+	f.RangeMultiCol = opts.RangeMultiCol
+	f.JoinKeyCol = opts.JoinKeyCol
+	f.Fields = opts.Fields
 }
 
 func ParseJSONKeys(result map[string]interface{}, f *CmdImportFlags) {
-	if _, hasStartIp := result["start_ip"].(string); hasStartIp {
-		if _, hasEndIp := result["end_ip"].(string); hasEndIp {
-			f.RangeMultiCol = true
-
-			if _, hasJoinKey := result["join_key"].(string); hasJoinKey {
-				f.JoinKeyCol = true
-			}
-		}
-	}
-
-	// determine fields
-	// NOTE: even though there are no headers for JSON, we reuse that variable to signal the need to extract fields
-	if f.FieldsFromHdr {
-		for key := range result {
-			switch key {
-			case "start_ip", "end_ip", "join_key", "range":
-				continue
-			default:
-				f.Fields = append(f.Fields, key)
-			}
-		}
-	}
+	opts := f.importOptions()
+	parseJSONKeys(result, &opts)
+	f.RangeMultiCol = opts.RangeMultiCol
+	f.JoinKeyCol = opts.JoinKeyCol
+	f.Fields = opts.Fields
 }
 
 func AppendCSVRecord(f CmdImportFlags, dataColStart int, delim rune, parts []string, tree *mmdbwriter.Tree) error {
-	if startIp, _ := iputil.DecimalStrToIP(parts[0], false); startIp != nil {
-		parts[0] = startIp.String()
-	}
-
-	networkStr := parts[0]
-
-	// convert 2 IPs into IP range?
-	if f.RangeMultiCol {
-		if endIp, _ := iputil.DecimalStrToIP(parts[1], false); endIp != nil {
-			parts[1] = endIp.String()
-		}
-
-		networkStr = parts[0] + "-" + parts[1]
-	}
-
-	// add network part to single-IP network if it's missing.
-	isNetworkRange := strings.Contains(networkStr, "-")
-	if !isNetworkRange && !strings.Contains(networkStr, "/") {
-		if f.Ip == 6 && strings.Contains(networkStr, ":") {
-			networkStr += "/128"
-		} else {
-			networkStr += "/32"
-		}
-	}
-
-	// prep record.
-	record := mmdbtype.Map{}
-	if !f.NoNetwork {
-		record["network"] = mmdbtype.String(networkStr)
-	}
-	for i, field := range f.Fields {
-		record[mmdbtype.String(field)] = mmdbtype.String(parts[i+dataColStart])
-	}
-
-	// range insertion or cidr insertion?
-	if isNetworkRange {
-		networkStrParts := strings.Split(networkStr, "-")
-		startIp := net.ParseIP(networkStrParts[0])
-		endIp := net.ParseIP(networkStrParts[1])
-		if err := tree.InsertRange(startIp, endIp, record); err != nil {
-			fmt.Fprintf(
-				os.Stderr, "warn: couldn't insert line '%v'\n",
-				strings.Join(parts, string(delim)),
-			)
-		}
-	} else {
-		_, network, err := net.ParseCIDR(networkStr)
-		if err != nil {
-			return fmt.Errorf(
-				"couldn't parse cidr \"%v\": %w",
-				networkStr, err,
-			)
-		}
-		if err := tree.Insert(network, record); err != nil {
-			fmt.Fprintf(
-				os.Stderr, "warn: couldn't insert line '%v'\n",
-				strings.Join(parts, string(delim)),
-			)
-		}
-	}
-
-	return nil
+	opts := f.importOptions()
+	_, err := appendCSVRecord(&opts, dataColStart, delim, parts, tree)
+	return err
 }
 
 func ProcessJsonData(
@@ -603,68 +370,6 @@ func ProcessJsonData(
 	f CmdImportFlags,
 	subMap *mmdbtype.Map,
 ) error {
-	// Insert each key-value pair into the map
-	for _, field := range f.Fields {
-		value, ok := data[field]
-		if !ok {
-			continue
-		}
-
-		mmdbValue, err := ConvertToMMDBType(value)
-		if err != nil {
-			return fmt.Errorf("failed to convert value to MMDB type: %v", err)
-		}
-		(*subMap)[mmdbtype.String(field)] = mmdbValue
-	}
-
-	return nil
-}
-
-func ConvertToMMDBType(value interface{}) (mmdbtype.DataType, error) {
-	switch v := value.(type) {
-	case nil:
-		return mmdbtype.String(""), nil
-	case string:
-		return mmdbtype.String(v), nil
-	case float64:
-		return mmdbtype.Float64(v), nil
-	case float32:
-		return mmdbtype.Float32(v), nil
-	case int32:
-		return mmdbtype.Int32(v), nil
-	case uint16:
-		return mmdbtype.Uint16(v), nil
-	case uint32:
-		return mmdbtype.Uint32(v), nil
-	case uint64:
-		return mmdbtype.Uint64(v), nil
-	case bool:
-		return mmdbtype.Bool(v), nil
-	case map[string]interface{}:
-		subMap := mmdbtype.Map{}
-		for key, val := range v {
-			mmdbValue, err := ConvertToMMDBType(val)
-			if err != nil {
-				return nil, fmt.Errorf("failed to convert value to MMDB type: %v", err)
-			}
-			subMap[mmdbtype.String(key)] = mmdbValue
-		}
-		return subMap, nil
-	case []interface{}:
-		subSlice := mmdbtype.Slice{}
-		for _, val := range v {
-			mmdbValue, err := ConvertToMMDBType(val)
-			if err != nil {
-				return nil, fmt.Errorf("failed to convert value to MMDB type: %v", err)
-			}
-			subSlice = append(subSlice, mmdbValue)
-		}
-		return subSlice, nil
-	default:
-		outJson, err := json.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
-		return mmdbtype.String(outJson), nil
-	}
+	opts := f.importOptions()
+	return processJSONData(data, &opts, subMap)
 }
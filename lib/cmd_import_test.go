@@ -1,6 +1,9 @@
 package lib
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"net/netip"
 	"os"
 	"path/filepath"
@@ -511,3 +514,174 @@ func TestCmdImport_NoNetwork(t *testing.T) {
 		},
 	})
 }
+
+func TestCmdImport_ExitCodes(t *testing.T) {
+	f := CmdImportFlags{
+		Ip:   3, // invalid
+		Size: 32,
+		In:   "test.csv",
+		Out:  "test.mmdb",
+	}
+	if code := ExitCode(CmdImport(f, []string{}, func() {})); code != ExitUsage {
+		t.Errorf("expected exit code %d for invalid flags, got %d", ExitUsage, code)
+	}
+
+	tempDir := t.TempDir()
+	f = CmdImportFlags{
+		Ip:    6,
+		Size:  32,
+		Merge: "none",
+		In:    filepath.Join(tempDir, "nonexistent.csv"),
+		Out:   filepath.Join(tempDir, "output.mmdb"),
+		Csv:   true,
+	}
+	if code := ExitCode(CmdImport(f, []string{}, func() {})); code != ExitIO {
+		t.Errorf("expected exit code %d for missing input, got %d", ExitIO, code)
+	}
+}
+
+func TestCmdImport_PartialFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	inputFile := filepath.Join(tempDir, "input.csv")
+	outputFile := filepath.Join(tempDir, "output.mmdb")
+
+	// 10.0.0.0/8 is reserved, so it can't be inserted.
+	csvData := "network,country\n167.153.128.0/17,US\n10.0.0.0/8,CA\n"
+	if err := os.WriteFile(inputFile, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := CmdImportFlags{
+		Ip:               6,
+		Size:             32,
+		Merge:            "none",
+		In:               inputFile,
+		Out:              outputFile,
+		Csv:              true,
+		DisallowReserved: true,
+	}
+
+	err := CmdImport(f, []string{}, func() {})
+	if code := ExitCode(err); code != ExitPartial {
+		t.Fatalf("expected exit code %d, got %d (%v)", ExitPartial, code, err)
+	}
+
+	// the entries which could be inserted are still written out.
+	verifyMMDBContent(t, outputFile, []struct {
+		ip       string
+		expected map[string]interface{}
+	}{
+		{
+			ip:       "167.153.128.1",
+			expected: map[string]interface{}{"country": "US"},
+		},
+	})
+}
+
+func TestImport_InMemory(t *testing.T) {
+	opts := ImportOptionsDefaults
+	opts.Format = "json"
+
+	in := strings.NewReader(`{"range":"167.153.128.0/17","country":"US"}
+{"range":"204.138.232.0/24","country":"CA"}
+`)
+	var out bytes.Buffer
+	stats, err := Import(context.Background(), opts, in, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if stats.Entries != 2 || stats.Failed != 0 {
+		t.Errorf("expected 2 entries and no failures, got %+v", stats)
+	}
+
+	db, err := maxminddb.OpenBytes(out.Bytes())
+	if err != nil {
+		t.Fatalf("failed to open imported MMDB: %s", err.Error())
+	}
+	defer db.Close()
+
+	var record map[string]interface{}
+	if err := db.Lookup(netip.MustParseAddr("204.138.232.1")).Decode(&record); err != nil {
+		t.Fatalf("failed to lookup IP: %s", err.Error())
+	}
+	if record["country"] != "CA" {
+		t.Errorf("expected country CA, got %v", record["country"])
+	}
+}
+
+func TestImport_Interrupted(t *testing.T) {
+	opts := ImportOptionsDefaults
+	opts.Format = "csv"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	in := strings.NewReader("range,country\n167.153.128.0/17,US\n")
+	var out bytes.Buffer
+	_, err := Import(ctx, opts, in, &out)
+	if code := ExitCode(err); code != ExitInterrupted {
+		t.Fatalf("expected exit code %d, got %d (%v)", ExitInterrupted, code, err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the error to wrap context.Canceled, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no output, got %d bytes", out.Len())
+	}
+}
+
+func TestImport_ShortTypedRow(t *testing.T) {
+	opts := ImportOptionsDefaults
+	opts.Format = "tsv"
+	opts.TypedHeader = true
+
+	// the second row is missing its asn.
+	in := strings.NewReader("network\tcountry:string\tasn:uint32\n" +
+		"167.153.128.0/17\tUS\t22252\n" +
+		"204.138.232.0/24\tCA\n")
+	var out bytes.Buffer
+	stats, err := Import(context.Background(), opts, in, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if stats.Entries != 2 || stats.Failed != 1 {
+		t.Errorf("expected 2 entries and 1 failure, got %+v", stats)
+	}
+
+	db, err := maxminddb.OpenBytes(out.Bytes())
+	if err != nil {
+		t.Fatalf("failed to open imported MMDB: %s", err.Error())
+	}
+	defer db.Close()
+
+	var record map[string]any
+	if err := db.Lookup(netip.MustParseAddr("167.153.128.1")).Decode(&record); err != nil {
+		t.Fatalf("failed to lookup IP: %s", err.Error())
+	}
+	if record["asn"] != uint64(22252) {
+		t.Errorf("expected asn 22252, got %#v", record["asn"])
+	}
+}
+
+func TestImport_ShortRangeRow(t *testing.T) {
+	opts := ImportOptionsDefaults
+	opts.Format = "tsv"
+	var log bytes.Buffer
+	opts.Log = &log
+
+	// the second row is missing its end_ip.
+	in := strings.NewReader("start_ip\tend_ip\tcountry\n" +
+		"1.0.0.0\t1.0.0.255\tAU\n" +
+		"1.0.1.0\n")
+	var out bytes.Buffer
+	stats, err := Import(context.Background(), opts, in, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if stats.Failed != 1 {
+		t.Errorf("expected 1 failure, got %+v", stats)
+	}
+	if !strings.Contains(log.String(), "expected 3 fields, got 1") {
+		t.Errorf("expected a warning about the short row, got %q", log.String())
+	}
+}
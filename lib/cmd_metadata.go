@@ -1,27 +1,25 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
 	"github.com/fatih/color"
-	"github.com/oschwald/maxminddb-golang/v2"
 	"github.com/spf13/pflag"
 )
 
-const (
-	MetadataStartMarker = "\xAB\xCD\xEFMaxMind.com"
-)
-
 // CmdMetadataFlags are flags expected by CmdMetadata.
 type CmdMetadataFlags struct {
 	Help      bool
 	NoColor   bool
 	Format    string
 	DataTypes bool
+	Quiet     bool
 }
 
 // Init initializes the common flags available to CmdMetadata with sensible
@@ -50,9 +48,25 @@ func (f *CmdMetadataFlags) Init() {
 		"data-types", false,
 		"show data type sizes within the data section.",
 	)
+	pflag.BoolVarP(
+		&f.Quiet,
+		"quiet", "q", false,
+		_h,
+	)
 }
 
 func CmdMetadata(f CmdMetadataFlags, args []string, printHelp func()) error {
+	return CmdMetadataContext(context.Background(), f, args, printHelp)
+}
+
+// CmdMetadataContext is like CmdMetadata, but stops early with an ExitInterrupted
+// error once ctx is cancelled.
+func CmdMetadataContext(
+	ctx context.Context,
+	f CmdMetadataFlags,
+	args []string,
+	printHelp func(),
+) error {
 	if f.NoColor {
 		color.NoColor = true
 	}
@@ -65,7 +79,7 @@ func CmdMetadata(f CmdMetadataFlags, args []string, printHelp func()) error {
 
 	// validate input file.
 	if len(args) == 0 {
-		return errors.New("input mmdb file required as first argument")
+		return usageError(errors.New("input mmdb file required as first argument"))
 	}
 
 	// validate format
@@ -73,44 +87,17 @@ func CmdMetadata(f CmdMetadataFlags, args []string, printHelp func()) error {
 		f.Format = "pretty"
 	}
 	if f.Format != "pretty" && f.Format != "json" {
-		return errors.New("format must be one of \"pretty\" or \"json\"")
+		return usageError(errors.New("format must be one of \"pretty\" or \"json\""))
 	}
 
-	// open tree.
-	mmdbFile := args[0]
-	db, err := maxminddb.Open(mmdbFile)
-	if err != nil {
-		return fmt.Errorf("couldn't open mmdb file: %w", err)
+	opts := MetadataOptions{DataTypes: f.DataTypes}
+	if !f.Quiet {
+		opts.Progress = os.Stderr
 	}
-	defer db.Close()
-
-	mdFromLib := db.Metadata
-	binaryFmt := strconv.Itoa(int(mdFromLib.BinaryFormatMajorVersion)) + "." + strconv.Itoa(int(mdFromLib.BinaryFormatMinorVersion))
-	treeSize := ((int(mdFromLib.RecordSize) * 2) / 8) * int(mdFromLib.NodeCount)
-	dataSectionStartOffset := treeSize + 16
-	dataSectionEndOffset := 0
-	dataSectionSize := 0
-	metadataSectionStartOffset := 0
-
-	// Offset of this separator is used to determine the metadata start section, data section end and data section size.
-	offset, err := findSectionSeparator(mmdbFile, MetadataStartMarker)
+	md, err := Metadata(ctx, args[0], opts)
 	if err != nil {
-		return fmt.Errorf("couldn't process the mmdb file: %w", err)
-	}
-
-	if offset == -1 {
-		return errors.New("input valid mmdb file required as first argument")
-	}
-	dataSectionEndOffset = int(offset)
-	dataSectionSize = int(offset) - treeSize - 16
-	var typeSizes TypeSizes
-	if f.DataTypes {
-		typeSizes, err = traverseDataSection(mmdbFile, int64(dataSectionStartOffset), int64(dataSectionEndOffset))
-		if err != nil {
-			return fmt.Errorf("couldn't process the mmdb file: %w", err)
-		}
+		return err
 	}
-	metadataSectionStartOffset = int(offset) + len(MetadataStartMarker)
 
 	if f.Format == "pretty" {
 		fmtEntry := color.New(color.FgCyan)
@@ -128,14 +115,15 @@ func CmdMetadata(f CmdMetadataFlags, args []string, printHelp func()) error {
 		}
 
 		printline := printlineGen("", "13")
-		printline("Binary Format", binaryFmt, "")
-		printline("Database Type", mdFromLib.DatabaseType, "")
-		printline("IP Version", strconv.Itoa(int(mdFromLib.IPVersion)), "")
-		printline("Record Size", strconv.Itoa(int(mdFromLib.RecordSize)), "")
-		printline("Node Count", strconv.Itoa(int(mdFromLib.NodeCount)), simplifyCount(int64(mdFromLib.NodeCount)))
-		printline("Tree Size", strconv.Itoa(treeSize), simplifySize(int64(treeSize)))
-		printline("Data Section Size", strconv.Itoa(dataSectionSize), simplifySize(int64(dataSectionSize)))
-		if f.DataTypes {
+		printline("Binary Format", md.BinaryFormatVsn, "")
+		printline("Database Type", md.DatabaseType, "")
+		printline("IP Version", strconv.Itoa(int(md.IPVersion)), "")
+		printline("Record Size", strconv.Itoa(int(md.RecordSize)), "")
+		printline("Node Count", strconv.Itoa(int(md.NodeCount)), simplifyCount(int64(md.NodeCount)))
+		printline("Tree Size", strconv.Itoa(int(md.TreeSize)), simplifySize(int64(md.TreeSize)))
+		printline("Data Section Size", strconv.Itoa(int(md.DataSectionSize)), simplifySize(int64(md.DataSectionSize)))
+		if md.TypeSize != nil {
+			typeSizes := *md.TypeSize
 			typeSizePrintline := printlineGen("    ", "13")
 			typeSizePrintline("Pointer Size", strconv.Itoa(int(typeSizes.PointerSize)), simplifySize(typeSizes.PointerSize))
 			typeSizePrintline("UTF-8 String Size", strconv.Itoa(int(typeSizes.Utf8StringSize)), simplifySize(typeSizes.Utf8StringSize))
@@ -150,11 +138,11 @@ func CmdMetadata(f CmdMetadataFlags, args []string, printHelp func()) error {
 			typeSizePrintline("Array Length", strconv.Itoa(int(typeSizes.ArrayLength)), simplifyCount(typeSizes.ArrayLength))
 			typeSizePrintline("Float Size", strconv.Itoa(int(typeSizes.FloatSize)), simplifySize(typeSizes.FloatSize))
 		}
-		printline("Data Section Start Offset", strconv.Itoa(dataSectionStartOffset), "")
-		printline("Data Section End Offset", strconv.Itoa(dataSectionEndOffset), "")
-		printline("Metadata Section Start Offset", strconv.Itoa(metadataSectionStartOffset), "")
+		printline("Data Section Start Offset", strconv.Itoa(int(md.DataSectionStartOffset)), "")
+		printline("Data Section End Offset", strconv.Itoa(int(md.DataSectionEndOffset)), "")
+		printline("Metadata Section Start Offset", strconv.Itoa(int(md.MetadataStartOffset)), "")
 		printline("Description", "", "")
-		descKeys, descVals := sortedMapKeysAndVals(mdFromLib.Description)
+		descKeys, descVals := sortedMapKeysAndVals(md.Description)
 		longestDescKeyLen := strconv.Itoa(len(longestStrInStringSlice(descKeys)))
 		for i := 0; i < len(descKeys); i++ {
 			fmt.Printf(
@@ -163,44 +151,9 @@ func CmdMetadata(f CmdMetadataFlags, args []string, printHelp func()) error {
 				fmtVal.Sprintf("%v", descVals[i]),
 			)
 		}
-		printline("Languages", strings.Join(mdFromLib.Languages, ", "), "")
-		printline("Build Epoch", strconv.Itoa(int(mdFromLib.BuildEpoch)), "")
+		printline("Languages", strings.Join(md.Languages, ", "), "")
+		printline("Build Epoch", strconv.Itoa(int(md.BuildEpoch)), "")
 	} else { // json
-		var typeSizesPtr *TypeSizes
-		if f.DataTypes {
-			typeSizesPtr = &typeSizes
-		}
-		md := struct {
-			BinaryFormatVsn        string            `json:"binary_format"`
-			DatabaseType           string            `json:"db_type"`
-			IPVersion              uint              `json:"ip"`
-			RecordSize             uint              `json:"record_size"`
-			NodeCount              uint              `json:"node_count"`
-			TreeSize               uint              `json:"tree_size"`
-			DataSectionSize        uint              `json:"data_section_size"`
-			TypeSize               *TypeSizes        `json:"data_type_sizes,omitempty"`
-			DataSectionStartOffset uint              `json:"data_section_start_offset"`
-			DataSectionEndOffset   uint              `json:"data_section_end_offset"`
-			MetadataStartOffset    uint              `json:"metadata_section_start_offset"`
-			Description            map[string]string `json:"description"`
-			Languages              []string          `json:"languages"`
-			BuildEpoch             uint              `json:"build_epoch"`
-		}{
-			binaryFmt,
-			mdFromLib.DatabaseType,
-			mdFromLib.IPVersion,
-			mdFromLib.RecordSize,
-			mdFromLib.NodeCount,
-			uint(treeSize),
-			uint(dataSectionSize),
-			typeSizesPtr,
-			uint(dataSectionStartOffset),
-			uint(dataSectionEndOffset),
-			uint(metadataSectionStartOffset),
-			mdFromLib.Description,
-			mdFromLib.Languages,
-			mdFromLib.BuildEpoch,
-		}
 		out, err := json.MarshalIndent(md, "", "    ")
 		if err != nil {
 			return fmt.Errorf("couldn't marshal json metadata: %w", err)
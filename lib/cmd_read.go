@@ -1,11 +1,11 @@
 package lib
 
 import (
-	"encoding/csv"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/netip"
 	"os"
+	"strings"
 
 	"github.com/fatih/color"
 	"github.com/ipinfo/cli/lib/iputil"
@@ -13,19 +13,16 @@ import (
 	"github.com/spf13/pflag"
 )
 
-var predictReadFmts = []string{
-	"json",
-	"json-compact",
-	"json-pretty",
-	"tsv",
-	"csv",
-}
-
 // CmdReadFlags are flags expected by CmdRead.
 type CmdReadFlags struct {
-	Help    bool
-	NoColor bool
-	Format  string
+	Help           bool
+	NoColor        bool
+	Format         string
+	Flatten        bool
+	ArrayDelim     string
+	NoNetwork      bool
+	PrefixLen      bool
+	ReplaceNetwork bool
 }
 
 // Init initializes the common flags available to CmdRead with sensible
@@ -49,9 +46,45 @@ func (f *CmdReadFlags) Init() {
 		"format", "f", "json",
 		_h,
 	)
+	pflag.BoolVar(
+		&f.Flatten,
+		"flatten", false,
+		_h,
+	)
+	pflag.StringVar(
+		&f.ArrayDelim,
+		"array-delim", "",
+		_h,
+	)
+	pflag.BoolVar(
+		&f.NoNetwork,
+		"no-network", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.PrefixLen,
+		"prefix-len", false,
+		_h,
+	)
+	pflag.BoolVar(
+		&f.ReplaceNetwork,
+		"replace-network", false,
+		_h,
+	)
 }
 
 func CmdRead(f CmdReadFlags, args []string, printHelp func()) error {
+	return CmdReadContext(context.Background(), f, args, printHelp)
+}
+
+// CmdReadContext is like CmdRead, but stops early with an ExitInterrupted
+// error once ctx is cancelled.
+func CmdReadContext(
+	ctx context.Context,
+	f CmdReadFlags,
+	args []string,
+	printHelp func(),
+) error {
 	if f.NoColor {
 		color.NoColor = true
 	}
@@ -62,120 +95,106 @@ func CmdRead(f CmdReadFlags, args []string, printHelp func()) error {
 		return nil
 	}
 
-	// validate format.
-	if f.Format == "json" {
-		f.Format = "json-compact"
-	}
-	validFormat := false
-	for _, format := range predictReadFmts {
-		if f.Format == format {
-			validFormat = true
-			break
-		}
+	// validate options.
+	opts := ReadOptions{
+		Format:         f.Format,
+		Flatten:        f.Flatten,
+		ArrayDelim:     f.ArrayDelim,
+		NoNetwork:      f.NoNetwork,
+		PrefixLen:      f.PrefixLen,
+		ReplaceNetwork: f.ReplaceNetwork,
+		Log:            os.Stderr,
 	}
-	if !validFormat {
-		return fmt.Errorf("format must be one of %v", predictReadFmts)
+	if err := opts.validate(); err != nil {
+		return err
 	}
 
 	// last arg must be mmdb file; open it.
 	mmdbFileArg := args[len(args)-1]
 	db, err := maxminddb.Open(mmdbFileArg)
 	if err != nil {
-		return fmt.Errorf("couldn't open mmdb file %v: %w", mmdbFileArg, err)
+		return openDBError(fmt.Errorf("couldn't open mmdb file %v: %w", mmdbFileArg, err))
 	}
 	defer db.Close()
 
-	// get IP list.
-	ips, err := iputil.IPListFromAllSrcs(args[:len(args)-1])
-	if err != nil {
-		return fmt.Errorf("couldn't get IP list: %w", err)
-	}
-
-	requiresHdr := f.Format == "csv" || f.Format == "tsv"
-	hdrWritten := false
-	var wr writer
-	if f.Format == "csv" {
-		csvwr := csv.NewWriter(os.Stdout)
-		wr = csvwr
-	} else if f.Format == "tsv" {
-		tsvwr := NewTsvWriter(os.Stdout)
-		wr = tsvwr
-	}
-	for _, ip := range ips {
-		record := make(map[string]interface{})
-		addr, ok := netip.AddrFromSlice(ip)
-		if !ok {
-			if !requiresHdr {
-				fmt.Fprintf(os.Stderr,
-					"err: invalid IP address %s\n",
-					ip.String(),
-				)
-			}
-			continue
+	// get the IPs and ranges to read; ranges are read by network rather
+	// than expanded into their IPs.
+	requiresHdr := opts.Format == "csv" || opts.Format == "tsv"
+	failcnt := 0
+	var queries []ReadQuery
+	err = iputil.GetInputFrom(args[:len(args)-1], true, true, func(input string, inputType iputil.INPUT_TYPE) error {
+		switch inputType {
+		case iputil.INPUT_TYPE_IP, iputil.INPUT_TYPE_IP_RANGE, iputil.INPUT_TYPE_CIDR:
+		default:
+			return nil
 		}
-		if err := db.Lookup(addr).Decode(&record); err != nil || len(record) == 0 {
+		q, err := parseReadQuery(input, inputType)
+		if err != nil {
 			if !requiresHdr {
-				fmt.Fprintf(os.Stderr,
-					"err: couldn't get data for %s\n",
-					ip.String(),
-				)
+				fmt.Fprintf(os.Stderr, "err: %v\n", err)
 			}
-			continue
+			failcnt += 1
+			return nil
 		}
+		queries = append(queries, q)
+		return nil
+	})
+	if err != nil {
+		return usageError(fmt.Errorf("couldn't get IP list: %w", err))
+	}
 
-		if f.Format == "json-compact" || f.Format == "json-pretty" {
-			record["ip"] = ip
-		}
+	stats, err := Read(ctx, db, queries, opts, os.Stdout)
+	if err != nil {
+		return err
+	}
 
-		recordStr := mapInterfaceToStr(record)
+	failcnt += stats.Failed
+	if failcnt > 0 {
+		return &CmdError{
+			Code: ExitPartial,
+			Err:  fmt.Errorf("%v of %v inputs couldn't be read", failcnt, len(queries)+failcnt),
+		}
+	}
 
-		if !hdrWritten {
-			hdrWritten = true
+	return nil
+}
 
-			if requiresHdr {
-				hdr := append([]string{"ip"}, sortedMapKeys(recordStr)...)
-				if err := wr.Write(hdr); err != nil {
-					return fmt.Errorf(
-						"failed to write header %v: %w",
-						hdr, err,
-					)
-				}
-			}
+// parseReadQuery parses an IP, CIDR or "start-end" or "start,end" IP range
+// input. IPv4-mapped IPv6 IPs are read as IPv4.
+func parseReadQuery(input string, inputType iputil.INPUT_TYPE) (ReadQuery, error) {
+	switch inputType {
+	case iputil.INPUT_TYPE_CIDR:
+		prefix, err := netip.ParsePrefix(input)
+		if err != nil {
+			return ReadQuery{}, fmt.Errorf("invalid CIDR %s", input)
 		}
-
-		if f.Format == "json-compact" {
-			b, err := json.Marshal(record)
-			if err != nil {
-				fmt.Fprintf(os.Stderr,
-					"err: couldn't print data for %s\n",
-					ip.String(),
-				)
-				continue
-			}
-			fmt.Printf("%s\n", b)
-		} else if f.Format == "json-pretty" {
-			b, err := json.MarshalIndent(record, "", "  ")
-			if err != nil {
-				fmt.Fprintf(os.Stderr,
-					"err: couldn't print data for %s\n",
-					ip.String(),
-				)
-				continue
-			}
-			fmt.Printf("%s\n", b)
-		} else { // if fFormat == "csv" || fFormat == "tsv"
-			line := append([]string{ip.String()}, sortedMapValsByKeys(recordStr)...)
-			if err := wr.Write(line); err != nil {
-				return fmt.Errorf("failed to write line %v: %w", line, err)
-			}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0))
 		}
-	}
-	if wr != nil {
-		wr.Flush()
-		if err := wr.Error(); err != nil {
-			return fmt.Errorf("writer had failure: %w", err)
+		return ReadPrefix(prefix), nil
+	case iputil.INPUT_TYPE_IP_RANGE:
+		start, end, ok := strings.Cut(input, "-")
+		if !ok {
+			start, end, _ = strings.Cut(input, ",")
 		}
+		startAddr, err := netip.ParseAddr(start)
+		if err != nil {
+			return ReadQuery{}, fmt.Errorf("invalid IP range %s", input)
+		}
+		endAddr, err := netip.ParseAddr(end)
+		if err != nil {
+			return ReadQuery{}, fmt.Errorf("invalid IP range %s", input)
+		}
+		q := ReadQuery{Start: startAddr.Unmap(), End: endAddr.Unmap()}
+		if q.Start.BitLen() != q.End.BitLen() || q.End.Less(q.Start) {
+			return ReadQuery{}, fmt.Errorf("invalid IP range %s", input)
+		}
+		return q, nil
+	default:
+		addr, err := netip.ParseAddr(input)
+		if err != nil {
+			return ReadQuery{}, fmt.Errorf("invalid IP address %s", input)
+		}
+		return ReadIP(addr.Unmap()), nil
 	}
-
-	return nil
 }
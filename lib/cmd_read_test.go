@@ -0,0 +1,241 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+func TestRead_Network(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ips := []ReadQuery{
+		ReadIP(netip.MustParseAddr("167.153.200.1")),
+		ReadIP(netip.MustParseAddr("204.138.232.5")),
+	}
+
+	// JSON has the network of each IP by default.
+	var out bytes.Buffer
+	if _, err := Read(context.Background(), db, ips, ReadOptions{Format: "json"}, &out); err != nil {
+		t.Fatalf("unexpected read error: %s", err.Error())
+	}
+	dec := json.NewDecoder(&out)
+	for _, expected := range []string{"167.153.128.0/17", "204.138.232.0/24"} {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record["network"] != expected {
+			t.Errorf("expected network %q, got %v", expected, record["network"])
+		}
+		if _, ok := record["prefix_len"]; ok {
+			t.Errorf("expected no prefix_len by default, got %v", record["prefix_len"])
+		}
+	}
+
+	// CSV columns lead with the network and prefix length, and stay aligned
+	// for records without some of the fields of the first.
+	out.Reset()
+	opts := ReadOptions{Format: "csv", PrefixLen: true}
+	if _, err := Read(context.Background(), db, ips, opts, &out); err != nil {
+		t.Fatalf("unexpected read error: %s", err.Error())
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %v", rows)
+	}
+	if !reflect.DeepEqual(rows[0][:4], []string{"ip", "network", "prefix_len", "anycast"}) {
+		t.Errorf("unexpected header %v", rows[0])
+	}
+	if !reflect.DeepEqual(rows[2][:5], []string{"204.138.232.5", "204.138.232.0/24", "24", "", "14836"}) {
+		t.Errorf("unexpected row %v", rows[2])
+	}
+
+	out.Reset()
+	opts = ReadOptions{Format: "csv", NoNetwork: true}
+	if _, err := Read(context.Background(), db, ips[:1], opts, &out); err != nil {
+		t.Fatalf("unexpected read error: %s", err.Error())
+	}
+	rows, err = csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0][1] != "anycast" {
+		t.Errorf("expected no network column, got header %v", rows[0])
+	}
+}
+
+func TestRead_NetworkFieldKept(t *testing.T) {
+	tempDir := t.TempDir()
+	inputCSV := filepath.Join(tempDir, "input.csv")
+	mmdbFile := filepath.Join(tempDir, "fields.mmdb")
+	csvData := `range,network,prefix_len,name
+1.0.0.0/24,1.0.0.0/16,16,a
+1.0.1.0/24,1.0.1.0/24,24,b
+`
+	if err := os.WriteFile(inputCSV, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imf := CmdImportFlagsDefaults
+	imf.In = inputCSV
+	imf.Out = mmdbFile
+	imf.NoNetwork = true
+	imf.Quiet = true
+	if err := CmdImport(imf, []string{}, func() {}); err != nil {
+		t.Fatalf("failed to create MMDB: %s", err.Error())
+	}
+
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ips := []ReadQuery{
+		ReadIP(netip.MustParseAddr("1.0.0.1")),
+		ReadIP(netip.MustParseAddr("1.0.0.2")),
+		ReadIP(netip.MustParseAddr("1.0.1.1")),
+	}
+
+	var out, log bytes.Buffer
+	opts := ReadOptions{Format: "json", PrefixLen: true, Log: &log}
+	if _, err := Read(context.Background(), db, ips, opts, &out); err != nil {
+		t.Fatalf("unexpected read error: %s", err.Error())
+	}
+	var record map[string]any
+	if err := json.NewDecoder(&out).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record["network"] != "1.0.0.0/16" || record["prefix_len"] != "16" {
+		t.Errorf("expected the record's own fields, got %v", record)
+	}
+
+	// each kept field is warned about once; equal values aren't.
+	expected := `warn: the data of 1.0.0.1 has its own "network" (1.0.0.0/16), which is kept over that of its network (1.0.0.0/24)
+warn: the data of 1.0.0.1 has its own "prefix_len" (16), which is kept over that of its network (24)
+`
+	if log.String() != expected {
+		t.Errorf("expected warnings %q, got %q", expected, log.String())
+	}
+
+	// when asked for, the network of the database replaces them silently.
+	out.Reset()
+	log.Reset()
+	opts.ReplaceNetwork = true
+	if _, err := Read(context.Background(), db, ips, opts, &out); err != nil {
+		t.Fatalf("unexpected read error: %s", err.Error())
+	}
+	record = nil
+	if err := json.NewDecoder(&out).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record["network"] != "1.0.0.0/24" || record["prefix_len"] != 24.0 || log.Len() != 0 {
+		t.Errorf("expected the network of the database without warnings, got %v (%q)", record, log.String())
+	}
+
+	// without the network, the record's own is kept silently.
+	out.Reset()
+	log.Reset()
+	opts = ReadOptions{Format: "json", NoNetwork: true, Log: &log}
+	if _, err := Read(context.Background(), db, ips[:1], opts, &out); err != nil {
+		t.Fatalf("unexpected read error: %s", err.Error())
+	}
+	record = nil
+	if err := json.NewDecoder(&out).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if record["network"] != "1.0.0.0/16" || log.Len() != 0 {
+		t.Errorf("expected the record's network without warnings, got %v (%q)", record, log.String())
+	}
+}
+
+func TestRead_Ranges(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the /17 overlaps many of the prefixes making up the range, but is
+	// written once, with the first IP of the range in it.
+	queries := []ReadQuery{
+		{Start: netip.MustParseAddr("167.153.200.7"), End: netip.MustParseAddr("204.138.232.9")},
+		ReadPrefix(netip.MustParsePrefix("1.0.0.0/8")),
+		ReadPrefix(netip.MustParsePrefix("204.0.0.0/8")),
+	}
+	var out bytes.Buffer
+	stats, err := Read(context.Background(), db, queries, ReadOptions{Format: "csv"}, &out)
+	if err != nil {
+		t.Fatalf("unexpected read error: %s", err.Error())
+	}
+	if stats.Found != 3 || stats.NotFound != 1 {
+		t.Errorf("expected 3 found and 1 not found, got %+v", stats)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, row := range rows[1:] {
+		got = append(got, row[:2])
+	}
+	expected := [][]string{
+		{"167.153.200.7", "167.153.128.0/17"},
+		{"204.138.232.0", "204.138.232.0/24"},
+		{"204.138.232.0", "204.138.232.0/24"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected rows %v, got %v", expected, got)
+	}
+
+	invalid := []ReadQuery{{Start: netip.MustParseAddr("1.0.0.9"), End: netip.MustParseAddr("1.0.0.1")}}
+	if _, err := Read(context.Background(), db, invalid, ReadOptions{Format: "json"}, &out); ExitCode(err) != ExitUsage {
+		t.Errorf("expected a usage error for a reversed range, got %v", err)
+	}
+}
+
+func TestRead_Interrupted(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "typed.mmdb")
+	createTypedTestMMDB(t, mmdbFile)
+
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queries := []ReadQuery{ReadIP(netip.MustParseAddr("167.153.200.1"))}
+	var out bytes.Buffer
+	_, err = Read(ctx, db, queries, ReadOptions{Format: "json"}, &out)
+	if code := ExitCode(err); code != ExitInterrupted {
+		t.Fatalf("expected exit code %d, got %d (%v)", ExitInterrupted, code, err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the error to wrap context.Canceled, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -27,6 +28,17 @@ func (f *CmdVerifyFlags) Init() {
 }
 
 func CmdVerify(f CmdVerifyFlags, args []string, printHelp func()) error {
+	return CmdVerifyContext(context.Background(), f, args, printHelp)
+}
+
+// CmdVerifyContext is like CmdVerify, but stops early with an ExitInterrupted
+// error once ctx is cancelled.
+func CmdVerifyContext(
+	ctx context.Context,
+	f CmdVerifyFlags,
+	args []string,
+	printHelp func(),
+) error {
 	// help?
 	if f.Help || (pflag.NArg() == 1 && pflag.NFlag() == 0) {
 		printHelp()
@@ -35,23 +47,27 @@ func CmdVerify(f CmdVerifyFlags, args []string, printHelp func()) error {
 
 	// validate input file.
 	if len(args) == 0 {
-		return errors.New("input mmdb file required as first argument")
+		return usageError(errors.New("input mmdb file required as first argument"))
 	}
 
 	// open tree.
 	db, err := maxminddb.Open(args[0])
 	if err != nil {
-		return fmt.Errorf("couldn't open mmdb file: %w", err)
+		return openDBError(fmt.Errorf("couldn't open mmdb file: %w", err))
 	}
 	defer db.Close()
 
 	// verify.
-	err = db.Verify()
+	err = Verify(ctx, db)
+	if ExitCode(err) == ExitInterrupted {
+		return err
+	}
 	if err != nil {
+		// the verdict is the output; only the exit code is left to set.
 		fmt.Printf("invalid: %v\n", err)
-	} else {
-		fmt.Println("valid")
+		return &CmdError{Code: ExitInvalidDB}
 	}
+	fmt.Println("valid")
 
 	return nil
 }
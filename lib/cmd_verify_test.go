@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+func TestVerify_Interrupted(t *testing.T) {
+	tempDir := t.TempDir()
+	mmdbFile := filepath.Join(tempDir, "test.mmdb")
+	createTestMMDB(t, mmdbFile)
+
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := Verify(context.Background(), db); err != nil {
+		t.Fatalf("unexpected verify error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Verify(ctx, db)
+	if code := ExitCode(err); code != ExitInterrupted || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected an interrupted error, got %d (%v)", code, err)
+	}
+
+	// the command doesn't report the database as invalid.
+	err = CmdVerifyContext(ctx, CmdVerifyFlags{}, []string{mmdbFile}, func() {})
+	if code := ExitCode(err); code != ExitInterrupted {
+		t.Errorf("expected exit code %d, got %d (%v)", ExitInterrupted, code, err)
+	}
+}
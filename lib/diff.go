@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"reflect"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// DiffOptions are options for Diff.
+type DiffOptions struct {
+	// OldName and NewName identify the databases in errors and progress
+	// reports. They default to "old" and "new".
+	OldName string
+	NewName string
+
+	// Progress receives progress reports. If nil, none are made.
+	Progress io.Writer
+}
+
+// DiffResult is the set difference between two databases, i.e.
+// `(new - old) U (old - new)`.
+type DiffResult struct {
+	// Subnets are networks which are split differently between the
+	// databases.
+	Subnets []SubnetDiff
+
+	// Records are networks present in both databases with different data.
+	Records []RecordDiff
+}
+
+// SubnetDiff is a network in one database mapped to the network holding the
+// same address in the other database.
+type SubnetDiff struct {
+	Old netip.Prefix
+	New netip.Prefix
+}
+
+// RecordDiff is a network whose data differs between the databases.
+type RecordDiff struct {
+	Network netip.Prefix
+	Old     any
+	New     any
+}
+
+// Empty reports whether no differences were found.
+func (r DiffResult) Empty() bool {
+	return len(r.Subnets) == 0 && len(r.Records) == 0
+}
+
+// Diff compares the networks and data of two databases, which must be of the
+// same IP version.
+func Diff(
+	ctx context.Context,
+	oldDb *maxminddb.Reader,
+	newDb *maxminddb.Reader,
+	opts DiffOptions,
+) (DiffResult, error) {
+	var res DiffResult
+
+	if opts.OldName == "" {
+		opts.OldName = "old"
+	}
+	if opts.NewName == "" {
+		opts.NewName = "new"
+	}
+
+	// confirm that they're of the same IP version.
+	if newDb.Metadata.IPVersion != oldDb.Metadata.IPVersion {
+		return res, usageError(fmt.Errorf(
+			"IP versions differ between files: %v=%v and %v=%v",
+			opts.NewName, newDb.Metadata.IPVersion,
+			opts.OldName, oldDb.Metadata.IPVersion,
+		))
+	}
+
+	prog := newProgress(opts.Progress)
+
+	// collect set difference data.
+	ambSn, ambRec, err := doDiff(ctx, newDb, opts.NewName, oldDb, opts.OldName, prog)
+	if err != nil {
+		return res, err
+	}
+	bmaSn, _, err := doDiff(ctx, oldDb, opts.OldName, newDb, opts.NewName, prog)
+	if err != nil {
+		return res, err
+	}
+
+	for _, sn := range ambSn {
+		res.Subnets = append(res.Subnets, SubnetDiff{Old: sn.other, New: sn.network})
+	}
+	for _, sn := range bmaSn {
+		res.Subnets = append(res.Subnets, SubnetDiff{Old: sn.network, New: sn.other})
+	}
+	res.Records = ambRec
+
+	return res, nil
+}
+
+// subnetDiff is a network of the database being walked by doDiff, and the
+// network holding its address in the other database.
+type subnetDiff struct {
+	network netip.Prefix
+	other   netip.Prefix
+}
+
+// doDiff walks the networks in dbA, collecting those which are split
+// differently in dbB, and those whose data differs in dbB.
+func doDiff(
+	ctx context.Context,
+	dbA *maxminddb.Reader,
+	dbAStr string,
+	dbB *maxminddb.Reader,
+	dbBStr string,
+	prog *progress,
+) ([]subnetDiff, []RecordDiff, error) {
+	// the node count is an upper bound estimate of the network count.
+	prog.Phase("diff "+dbAStr, "networks", int64(dbA.Metadata.NodeCount))
+	defer prog.Stop()
+
+	var modifiedSubnets []subnetDiff
+	var modifiedRecords []RecordDiff
+	for result := range dbA.Networks() {
+		if err := ctxError(ctx); err != nil {
+			return nil, nil, err
+		}
+		prog.Add(1)
+
+		var recordA interface{}
+		var recordB interface{}
+
+		if err := result.Decode(&recordA); err != nil {
+			return nil, nil, invalidDBError(fmt.Errorf(
+				"failed to get record for subnet from %v: %w",
+				dbAStr, err,
+			))
+		}
+		subnetA := result.Prefix()
+
+		lookupResult := dbB.Lookup(subnetA.Addr())
+		if err := lookupResult.Decode(&recordB); err != nil {
+			return nil, nil, invalidDBError(fmt.Errorf(
+				"failed to get record for IP %v from %v: %w",
+				subnetA.Addr(), dbBStr, err,
+			))
+		}
+		subnetB := lookupResult.Prefix()
+
+		// unequal subnets?
+		if subnetA != subnetB {
+			modifiedSubnets = append(modifiedSubnets, subnetDiff{
+				network: subnetA,
+				other:   subnetB,
+			})
+			continue
+		}
+
+		// different data for same subnet?
+		if !reflect.DeepEqual(recordA, recordB) {
+			modifiedRecords = append(modifiedRecords, RecordDiff{
+				Network: subnetA,
+				Old:     recordB,
+				New:     recordA,
+			})
+		}
+	}
+	prog.Done()
+
+	return modifiedSubnets, modifiedRecords, nil
+}
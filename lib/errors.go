@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// Exit codes used by the mmdbctl commands.
+const (
+	// ExitOK means the command succeeded.
+	ExitOK = 0
+
+	// ExitFailure means the command failed for an unclassified reason.
+	ExitFailure = 1
+
+	// ExitUsage means the flags or arguments were invalid.
+	ExitUsage = 2
+
+	// ExitIO means a file couldn't be opened, read or written.
+	ExitIO = 3
+
+	// ExitInvalidDB means an mmdb file is corrupt or otherwise invalid.
+	ExitInvalidDB = 4
+
+	// ExitDiffFound means `diff` found differences between the files.
+	ExitDiffFound = 5
+
+	// ExitPartial means the command completed, but some of its inputs failed
+	// and were skipped.
+	ExitPartial = 6
+
+	// ExitInterrupted means the command was cancelled, e.g. by SIGINT or
+	// SIGTERM, before it completed.
+	ExitInterrupted = 130
+)
+
+// exitCodeNames are the machine-readable names of the exit codes.
+var exitCodeNames = map[int]string{
+	ExitOK:          "ok",
+	ExitFailure:     "failure",
+	ExitUsage:       "usage",
+	ExitIO:          "io",
+	ExitInvalidDB:   "invalid_database",
+	ExitDiffFound:   "differences_found",
+	ExitPartial:     "partial_failure",
+	ExitInterrupted: "interrupted",
+}
+
+// CmdError is an error returned by the Cmd* functions which carries the exit
+// code the process should end with.
+//
+// Err may be nil, in which case the command already reported everything it
+// had to say and only the exit code is relevant.
+type CmdError struct {
+	Code int
+	Err  error
+}
+
+func (e *CmdError) Error() string {
+	if e.Err == nil {
+		return ""
+	}
+	return e.Err.Error()
+}
+
+func (e *CmdError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code the process should end with after a command
+// returned err.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var cmdErr *CmdError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code
+	}
+	return ExitFailure
+}
+
+// ExitCodeName returns the machine-readable name of an exit code.
+func ExitCodeName(code int) string {
+	if name, ok := exitCodeNames[code]; ok {
+		return name
+	}
+	return exitCodeNames[ExitFailure]
+}
+
+func usageError(err error) error {
+	return &CmdError{Code: ExitUsage, Err: err}
+}
+
+func ioError(err error) error {
+	return &CmdError{Code: ExitIO, Err: err}
+}
+
+func invalidDBError(err error) error {
+	return &CmdError{Code: ExitInvalidDB, Err: err}
+}
+
+// openDBError classifies an error from opening an mmdb file: failing to
+// access the file is an I/O error, anything else means it isn't valid.
+func openDBError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return ioError(err)
+	}
+	return invalidDBError(err)
+}
+
+// ctxError returns an interrupted error wrapping the cause of ctx being done,
+// e.g. context.Canceled, if it is, and nil otherwise.
+func ctxError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &CmdError{Code: ExitInterrupted, Err: fmt.Errorf("interrupted: %w", err)}
+	}
+	return nil
+}
+
+// ctxWriter is a writer which fails once its context is done, for aborting
+// writes done by code that doesn't take a context.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(b []byte) (int, error) {
+	if err := ctxError(w.ctx); err != nil {
+		return 0, err
+	}
+	return w.w.Write(b)
+}
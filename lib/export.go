@@ -0,0 +1,740 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"slices"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// ExportOptions are options for Export.
+type ExportOptions struct {
+	// Format is the output format: "csv", "tsv", "json", "parquet", "sql",
+	// "pgcopy", "clickhouse", "es-bulk", "geojson", "nginx-geo",
+	// "haproxy-map", "ipset" or "nftables-set".
+	//
+	// Parquet, SQL and ClickHouse columns are typed after the MMDB types of
+	// the values of each field, which takes an extra pass over the database
+	// to discover. Fields whose values don't share a type are written as
+	// strings. Nested maps become Parquet groups, and arrays lists; in SQL,
+	// both are JSON.
+	//
+	// "sql" writes a CREATE TABLE statement followed by batched INSERT
+	// statements, and "pgcopy" a psql script loading the rows with COPY.
+	// Networks are typed cidr and IPs inet for PostgreSQL.
+	//
+	// "clickhouse" writes TSV to load into a ClickHouse ip_trie dictionary,
+	// with the network in a prefix column; see DDL.
+	//
+	// "es-bulk" writes Elasticsearch bulk API requests indexing a document
+	// per network into Index, with the network in an ip_range field named
+	// "range".
+	//
+	// "geojson" writes a FeatureCollection of a Point feature per network
+	// at the Coords of its record, with the range and fields as properties
+	// as for JSON. Networks without coordinates are left out.
+	//
+	// "nginx-geo", "haproxy-map", "ipset" and "nftables-set" write proxy
+	// and firewall configs from the ValueField of each network, aggregating
+	// adjacent networks with the same value into the fewest CIDRs. nginx-geo
+	// writes the entries of a geo block, and haproxy-map a map file. ipset
+	// writes an "ipset restore" script, and nftables-set set declarations,
+	// of SetName with "_v4" and "_v6" appended for each IP version.
+	Format string
+
+	// Index is the name of the index documents are indexed into by the
+	// "es-bulk" format. Defaults to "networks".
+	Index string
+
+	// DocID is the document ID of the "es-bulk" format: "prefix" for the
+	// network, or start and end IPs of a range, or "none" to have
+	// Elasticsearch generate them. Defaults to "prefix".
+	DocID string
+
+	// Coords are the fields holding the coordinates of records for the
+	// "geojson" format, each a field spec as in Fields: either a single field
+	// of "lat,lon" text, like the loc field of ipinfo databases, or a
+	// latitude and a longitude field. If empty, they're detected in each
+	// record from common names: loc, latitude and longitude, lat and lng,
+	// lat and lon, or location.latitude and location.longitude.
+	Coords []string
+
+	// GeoJSONSeq writes the features of the "geojson" format as a GeoJSON
+	// text sequence (RFC 8142) rather than a FeatureCollection, for
+	// streaming.
+	GeoJSONSeq bool
+
+	// PerLocation aggregates the "geojson" format into a feature per unique
+	// location, with the networks found at it and their count as
+	// properties, in place of a feature per network.
+	PerLocation bool
+
+	// Mapping, if set with the "es-bulk" format, receives the index mapping
+	// of the documents, typed after the MMDB types of the values of each
+	// field, which takes an extra pass over the database to discover.
+	Mapping io.Writer
+
+	// ValueField is the field spec, as in Fields, of the value networks
+	// are mapped to by the nginx-geo and haproxy-map formats, which require
+	// it; networks without a value are left out. For the ipset and
+	// nftables-set formats, it restricts the members to the networks whose
+	// value is set and not empty, zero or false.
+	ValueField string
+
+	// SetName is the name the sets of the ipset and nftables-set formats
+	// are named after. Defaults to "networks".
+	SetName string
+
+	// Dialect is the SQL dialect of the "sql" format: "postgres", "sqlite"
+	// or "mysql". Defaults to "postgres".
+	Dialect string
+
+	// Table is the name of the table for the "sql" and "pgcopy" formats, or
+	// of the dictionary for the "clickhouse" format. Defaults to "networks".
+	Table string
+
+	// DDL, if set with the "clickhouse" format, receives the CREATE
+	// DICTIONARY statement of an ip_trie dictionary, with attributes typed
+	// after the MMDB types of the values of each field, loading the output
+	// from DictSource.
+	DDL io.Writer
+
+	// DictSource is the path of the file the dictionary of DDL loads,
+	// relative to the user_files directory of the ClickHouse server.
+	// Defaults to Table with a ".tsv" extension.
+	DictSource string
+
+	// NoHdr leaves out the header for formats which have one. For SQL, the
+	// header is the CREATE TABLE statement, and for pgcopy also the COPY
+	// command, leaving only the rows.
+	NoHdr bool
+
+	// Fields are the fields to export, in order, after the range. Each is
+	// a spec of the form "path[:name]": path names a field, with nested
+	// fields and array elements separated by ".", e.g. "location.latitude",
+	// and name is the column or key to export it as, which defaults to the
+	// path. Only the selected paths are decoded.
+	//
+	// If empty, all fields are exported. For CSV/TSV, the columns are then
+	// the keys of all records in the database, sorted, which takes an extra
+	// pass over the database to discover.
+	Fields []string
+
+	// Flatten expands nested maps and arrays in CSV/TSV output into columns
+	// named by their dotted paths, e.g. "country.names.en", instead of JSON
+	// strings in a single column. Array elements are indexed, e.g. "a.0",
+	// unless ArrayDelim is set.
+	Flatten bool
+
+	// ArrayDelim, if set with Flatten, joins arrays of scalars by it into a
+	// single column instead of indexing them.
+	ArrayDelim string
+
+	// TypedHeader annotates the columns of the CSV/TSV header with the MMDB
+	// types of their values, e.g. "asn:uint32", which takes an extra pass
+	// over the database to discover, and writes the values so that they
+	// can be parsed back exactly: floats with all their precision, bytes as
+	// base64, and nested maps and arrays as JSON, annotated with the types
+	// of their fields and elements, e.g. "tags:slice[string]". Importing
+	// the output with ImportOptions.TypedHeader restores the types. Fields
+	// whose values don't share a type are annotated as "mixed", and are
+	// imported as strings. Empty strings, and strings beginning with a
+	// quote, are written quoted as JSON, as empty values are fields missing
+	// from a record.
+	TypedHeader bool
+
+	// TSVEscape escapes backslashes, tabs, newlines and carriage returns in
+	// TSV fields as \\, \t, \n and \r, so that values containing them
+	// don't shift columns or split rows. Import the output with
+	// ImportOptions.TSVEscape.
+	TSVEscape bool
+
+	// Ranges merges adjacent networks which share the same record into a
+	// single row, written as start_ip and end_ip in place of a range.
+	Ranges bool
+
+	// DecimalRanges writes start_ip and end_ip as decimal integers.
+	DecimalRanges bool
+
+	// Computed are extra columns to export after the range, computed from
+	// the network of each record:
+	//
+	//   - start_ip, end_ip: the first and last IP of the network.
+	//   - prefix_len: the prefix length of the network; empty for ranges
+	//     which aren't a single network.
+	//   - num_addresses: the number of IPs in the network.
+	//   - ip_version: 4 or 6.
+	//   - start_ip_decimal, end_ip_decimal: start_ip and end_ip as decimal
+	//     integers.
+	//   - offset: the offset of the record in the data section.
+	//
+	// They take the place of record fields with the same names.
+	Computed []string
+
+	// Within restricts the export to networks within these prefixes.
+	// Networks larger than a prefix are clipped to it. If empty, the whole
+	// database is exported.
+	Within []netip.Prefix
+
+	// IPv4Only restricts the export to IPv4 networks.
+	IPv4Only bool
+
+	// IPv6Only restricts the export to IPv6 networks.
+	IPv6Only bool
+
+	// IncludeAliased includes networks which alias the IPv4 networks in an
+	// IPv6 database, e.g. ::ffff:0:0/96 and 2002::/16. It can't be combined
+	// with IPv4Format.
+	IncludeAliased bool
+
+	// IncludeEmpty includes networks without data, as records with no
+	// fields.
+	IncludeEmpty bool
+
+	// IPv4Format normalizes how IPv4 networks are written: "mapped" writes
+	// them as IPv4-mapped IPv6 networks, e.g. ::ffff:1.0.0.0/120, and
+	// "native" writes IPv4-mapped IPv6 networks as IPv4 networks. If empty,
+	// networks are written as found, which for IPv6 databases is IPv4 for
+	// the IPv4 subtree and IPv6 for its aliases.
+	IPv4Format string
+
+	// Where restricts the export to networks whose record satisfies a
+	// predicate on its fields, e.g. `country == "US" && asn != 0`.
+	//
+	// Comparisons are `==`, `!=`, `<`, `<=`, `>` and `>=` against a quoted
+	// string, a number, true, false or null, and may be combined with `&&`,
+	// `||`, `!` and parentheses. Integer fields are compared with numbers
+	// exactly, and float fields as floats. Nested fields are named by their
+	// dotted paths, e.g. `location.latitude`. A field on its own checks that
+	// it's set and not empty, zero or false.
+	Where string
+
+	// NormalizedRecords, if set, normalizes a CSV, TSV or JSON export:
+	// each unique record is written to it once, with a record_id, and the
+	// networks are written with just the record_id of their record in place
+	// of its fields. The record_id of a network without data is empty.
+	NormalizedRecords io.Writer
+
+	// CacheSize is the number of decoded records kept in memory, for the
+	// many networks which share a record; the least recently used are
+	// evicted. Defaults to 65536.
+	CacheSize int
+
+	// Workers is the number of goroutines decoding and formatting records
+	// for the CSV, TSV and JSON formats, which are still written in network
+	// order. Defaults to 1, decoding and formatting them on the calling
+	// goroutine.
+	Workers int
+
+	// Shards splits the address space into this many non-overlapping
+	// prefixes, exported concurrently and written out in order, as for an
+	// unsharded export. Parts without networks aren't made shards, nor are
+	// single networks split, so sparse databases may have fewer. Unless
+	// ShardOutput is set, only the CSV, TSV and JSON formats can be sharded,
+	// and the shards after the first are buffered in temporary files.
+	// Defaults to 1, walking the whole database at once.
+	Shards int
+
+	// ShardOutput, if set, returns the writer of each shard, numbered from
+	// 0, which is written a whole export of its networks, with its own
+	// header; nothing is written to the writer passed to Export. It's called
+	// once the shards are known.
+	ShardOutput func(shard int) (io.Writer, error)
+
+	// SplitBy, if set, is the field spec, as in Fields, of the value the
+	// CSV, TSV or JSON export is split by: the networks of each value are
+	// written to the output SplitOutput opens for it, each with its own
+	// header, and nothing to the writer passed to Export. Networks without
+	// a value are left out.
+	SplitBy string
+
+	// SplitOutput opens the output of the networks with value, which is
+	// reopened to append to, without a header, if it was closed to keep
+	// under MaxOpenSplits.
+	SplitOutput func(value string, appending bool) (io.WriteCloser, error)
+
+	// MaxOpenSplits is the number of outputs of SplitBy kept open at once;
+	// the least recently written is closed once more are needed. Defaults to
+	// 128.
+	MaxOpenSplits int
+
+	// Progress receives progress reports. If nil, none are made.
+	Progress io.Writer
+}
+
+// ExportStats are statistics about a finished Export.
+type ExportStats struct {
+	// Networks is the number of networks written.
+	Networks int
+
+	// Records is the number of unique records written by a normalized
+	// export.
+	Records int
+}
+
+// Export writes the networks in db, along with their data, to w.
+//
+// If ctx is cancelled, the networks written so far are flushed to w and an
+// error with the ExitInterrupted code is returned.
+func Export(
+	ctx context.Context,
+	db *maxminddb.Reader,
+	opts ExportOptions,
+	w io.Writer,
+) (ExportStats, error) {
+	var stats ExportStats
+
+	if err := opts.validate(); err != nil {
+		return stats, err
+	}
+	src, err := newExportSource(db, &opts)
+	if err != nil {
+		return stats, err
+	}
+	prog := newProgress(opts.Progress)
+
+	// the columns of delimited formats must be known before the first row.
+	var hdrKeys []string
+	fields, err := parseExportFields(opts.Fields)
+	if err != nil {
+		return stats, err
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+	cache := newRecordStrCache(fields, opts.Flatten, opts.ArrayDelim, opts.CacheSize)
+	cache.lossless = opts.TypedHeader
+	var hdrTypes []string
+	if opts.Format == "csv" || opts.Format == "tsv" {
+		// typed headers discover the types of the fields up front, which
+		// also gives the fields unless they're flattened.
+		var types map[string]*fieldType
+		if opts.TypedHeader {
+			types, err = discoverFieldTypes(ctx, src, newTypedRecordCache(fields, opts.CacheSize), prog)
+			if err != nil {
+				return stats, err
+			}
+		}
+		switch {
+		case fields != nil:
+			hdrKeys = exportFieldNames(fields)
+		case opts.TypedHeader && !opts.Flatten:
+			hdrKeys = slices.Sorted(maps.Keys(types))
+		default:
+			hdrKeys, err = discoverHdrKeys(ctx, src, cache, prog)
+			if err != nil {
+				return stats, err
+			}
+		}
+		if fields == nil {
+			hdrKeys = slices.DeleteFunc(hdrKeys, func(k string) bool {
+				if opts.NormalizedRecords != nil {
+					return k == "record_id"
+				}
+				return slices.Contains(opts.Computed, k)
+			})
+		}
+		if opts.TypedHeader {
+			hdrTypes = typedHeaderTypes(hdrKeys, types, opts.Flatten)
+		}
+	}
+
+	layout := opts.rangeLayout()
+
+	// typed formats discover the types of the fields up front.
+	var typedCache *typedRecordCache
+	var types map[string]*fieldType
+	switch opts.Format {
+	case "parquet", "sql", "pgcopy", "clickhouse", "es-bulk":
+		if opts.Format == "es-bulk" && opts.Mapping == nil {
+			break
+		}
+		typedCache = newTypedRecordCache(fields, opts.CacheSize)
+		types, err = discoverFieldTypes(ctx, src, typedCache, prog)
+		if err != nil {
+			return stats, err
+		}
+	}
+	var table *sqlTable
+	switch opts.Format {
+	case "sql", "pgcopy", "clickhouse":
+		var names []string
+		if fields != nil {
+			names = exportFieldNames(fields)
+		} else {
+			names = slices.Sorted(maps.Keys(types))
+		}
+		// the range and computed columns take the place of record fields;
+		// for ClickHouse, the range is named prefix.
+		layoutKeys := layout.keys()
+		if opts.Format == "clickhouse" {
+			layoutKeys[0] = "prefix"
+		}
+		names = slices.DeleteFunc(names, func(k string) bool {
+			return slices.Contains(layoutKeys, k)
+		})
+		table, err = newSQLTable(opts.Table, opts.sqlDialect(), layout, names, types)
+		if err != nil {
+			return stats, err
+		}
+		if opts.Format == "clickhouse" {
+			table.cols[0] = "prefix"
+			if opts.DDL != nil {
+				source := opts.DictSource
+				if source == "" {
+					source = table.name + ".tsv"
+				}
+				stmt := table.dictionaryStmt(source, opts.NoHdr)
+				if _, err := io.WriteString(opts.DDL, stmt); err != nil {
+					return stats, ioError(fmt.Errorf("failed to write DDL: %w", err))
+				}
+			}
+		}
+	case "es-bulk":
+		if opts.Mapping != nil {
+			if err := writeESMapping(opts.Mapping, opts.Computed, types); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	// newExp returns the exporter writing to w; shards each have their own.
+	newExp := func(w io.Writer, noHdr bool) (exporter, error) {
+		switch opts.Format {
+		case "csv", "tsv", "json":
+			if opts.NormalizedRecords == nil {
+				return newTextExporter(opts.Format, w, noHdr, hdrKeys, hdrTypes, cache, fields, layout, opts.Workers, opts.TSVEscape), nil
+			}
+			// networks only refer to their records, so decode none of
+			// their fields.
+			noFields := []exportField{}
+			netLayout := layout
+			netLayout.recordID = true
+			return newNormalizedExporter(
+				newTextExporter(opts.Format, w, noHdr, nil, nil,
+					newRecordStrCache(noFields, false, "", opts.CacheSize), noFields, netLayout, opts.Workers, opts.TSVEscape),
+				newTextExporter(opts.Format, opts.NormalizedRecords, noHdr, hdrKeys, hdrTypes,
+					cache, fields, rangeLayout{omitSpan: true, recordID: true}, opts.Workers, opts.TSVEscape),
+			), nil
+		case "parquet":
+			return newParquetExporter(w, types, typedCache, layout), nil
+		case "sql":
+			return newSQLExporter(w, noHdr, table, typedCache), nil
+		case "pgcopy":
+			return newPGCopyExporter(w, noHdr, table, typedCache), nil
+		case "clickhouse":
+			return newClickHouseExporter(w, noHdr, table, typedCache), nil
+		case "es-bulk":
+			exp, err := newESBulkExporter(w, opts.Index, opts.DocID, fields, layout, opts.CacheSize)
+			if err != nil {
+				return nil, err
+			}
+			return exp, nil
+		case "geojson":
+			exp, err := newGeoJSONExporter(w, opts.Coords, fields, layout, opts.GeoJSONSeq, opts.PerLocation, opts.CacheSize)
+			if err != nil {
+				return nil, err
+			}
+			return exp, nil
+		default:
+			return opts.newConfigExporter(w, noHdr)
+		}
+	}
+
+	if opts.SplitBy != "" {
+		splitField, err := parseExportFields([]string{opts.SplitBy})
+		if err != nil {
+			return stats, err
+		}
+		exp := newSplitExporter(
+			newConfigValues(splitField, opts.CacheSize), opts.SplitOutput, newExp, opts.NoHdr, opts.MaxOpenSplits,
+		)
+		err = exportNetworks(ctx, src, exp, opts.Ranges, prog, &stats)
+		return stats, err
+	}
+	if opts.Shards > 1 || opts.ShardOutput != nil {
+		err = exportShards(ctx, src, &opts, w, newExp, prog, &stats)
+		return stats, err
+	}
+	exp, err := newExp(w, opts.NoHdr)
+	if err != nil {
+		return stats, err
+	}
+	err = exportNetworks(ctx, src, exp, opts.Ranges, prog, &stats)
+	// normalized exports are never split or sharded.
+	if norm, ok := exp.(*normalizedExporter); ok {
+		stats.Records = len(norm.seen)
+	}
+	return stats, err
+}
+
+// validate checks the options, resolving the defaults of those left empty.
+func (o *ExportOptions) validate() error {
+	if !slices.Contains(exportFormats, o.Format) {
+		return usageError(fmt.Errorf("format must be one of %v", exportFormats))
+	}
+	if o.ValueField != "" && !slices.Contains(exportConfigFormats, o.Format) {
+		return usageError(fmt.Errorf("value field only applies to the %v formats", exportConfigFormats))
+	}
+	if slices.Contains(exportConfigFormats, o.Format) &&
+		(len(o.Fields) > 0 || o.Flatten || o.Ranges || len(o.Computed) > 0) {
+		return usageError(fmt.Errorf(
+			"fields, ranges and computed columns don't apply to the %v format; it writes the value field", o.Format,
+		))
+	}
+	if (len(o.Coords) > 0 || o.GeoJSONSeq || o.PerLocation) && o.Format != "geojson" {
+		return usageError(errors.New("coordinates, sequences and locations only apply to the geojson format"))
+	}
+	if (o.Index != "" || o.DocID != "" || o.Mapping != nil) && o.Format != "es-bulk" {
+		return usageError(errors.New("index, document IDs and mappings only apply to the es-bulk format"))
+	}
+	if o.SetName != "" && o.Format != "ipset" && o.Format != "nftables-set" {
+		return usageError(errors.New("set name only applies to the ipset and nftables-set formats"))
+	}
+
+	if o.NormalizedRecords != nil && o.Format != "csv" && o.Format != "tsv" && o.Format != "json" {
+		return usageError(errors.New("normalized exports only apply to csv, tsv and json formats"))
+	}
+
+	if o.Dialect != "" && o.Format != "sql" {
+		return usageError(errors.New("dialect only applies to the sql format"))
+	}
+	if o.Table != "" && o.Format != "sql" && o.Format != "pgcopy" && o.Format != "clickhouse" {
+		return usageError(errors.New("table name only applies to the sql, pgcopy and clickhouse formats"))
+	}
+	if (o.DDL != nil || o.DictSource != "") && o.Format != "clickhouse" {
+		return usageError(errors.New("dictionary DDL only applies to the clickhouse format"))
+	}
+
+	if o.CacheSize < 0 {
+		return usageError(errors.New("cache size can't be negative"))
+	}
+	if o.CacheSize == 0 {
+		o.CacheSize = defaultCacheSize
+	}
+	if o.Workers < 0 {
+		return usageError(errors.New("workers can't be negative"))
+	}
+	if o.Workers > 1 && o.Format != "csv" && o.Format != "tsv" && o.Format != "json" {
+		return usageError(errors.New("workers only apply to csv, tsv and json formats"))
+	}
+
+	if o.Shards < 0 {
+		return usageError(errors.New("shards can't be negative"))
+	}
+	if o.Shards > 1 || o.ShardOutput != nil {
+		if o.NormalizedRecords != nil {
+			return usageError(errors.New("normalized exports can't be sharded"))
+		}
+		if o.ShardOutput == nil && o.Format != "csv" && o.Format != "tsv" && o.Format != "json" {
+			return usageError(errors.New("only csv, tsv and json shards can be merged into one output; write a file per shard instead"))
+		}
+		// networks sharing a record on both sides of a shard boundary
+		// would be written as two ranges.
+		if o.ShardOutput == nil && o.Ranges {
+			return usageError(errors.New("ranges can't be merged across shards; write a file per shard instead"))
+		}
+	}
+
+	if o.SplitBy != "" {
+		if o.Format != "csv" && o.Format != "tsv" && o.Format != "json" {
+			return usageError(errors.New("only csv, tsv and json exports can be split"))
+		}
+		if o.SplitOutput == nil {
+			return usageError(errors.New("split exports require an output per value"))
+		}
+		if o.NormalizedRecords != nil || o.Shards > 1 || o.ShardOutput != nil {
+			return usageError(errors.New("split exports can't be normalized or sharded"))
+		}
+		if _, err := parseExportFields([]string{o.SplitBy}); err != nil {
+			return err
+		}
+	} else if o.SplitOutput != nil {
+		return usageError(errors.New("split outputs require a field to split by"))
+	}
+	if o.MaxOpenSplits < 0 {
+		return usageError(errors.New("max open splits can't be negative"))
+	}
+	if o.MaxOpenSplits == 0 {
+		o.MaxOpenSplits = defaultMaxOpenSplits
+	}
+
+	if o.TSVEscape && o.Format != "tsv" {
+		return usageError(errors.New("tsv escaping only applies to the tsv format"))
+	}
+
+	if o.Flatten && o.Format != "csv" && o.Format != "tsv" {
+		return usageError(errors.New("flattening only applies to csv and tsv formats"))
+	}
+	if o.ArrayDelim != "" && !o.Flatten {
+		return usageError(errors.New("array delimiter requires flattening"))
+	}
+	if o.TypedHeader {
+		if o.Format != "csv" && o.Format != "tsv" {
+			return usageError(errors.New("typed headers only apply to csv and tsv formats"))
+		}
+		if o.ArrayDelim != "" {
+			return usageError(errors.New("typed headers can't be used with an array delimiter"))
+		}
+	}
+
+	if o.DecimalRanges && !o.Ranges {
+		return usageError(errors.New("decimal ranges require exporting ranges"))
+	}
+	seen := make(map[string]bool, len(o.Computed))
+	for _, col := range o.Computed {
+		if _, ok := computedCols[col]; !ok {
+			return usageError(fmt.Errorf(
+				"computed column %q must be one of %v", col, computedColNames,
+			))
+		}
+		if seen[col] || (o.Ranges && (col == "start_ip" || col == "end_ip")) {
+			return usageError(fmt.Errorf("column %q specified more than once", col))
+		}
+		seen[col] = true
+	}
+
+	if o.IPv4Format != "" && o.IPv4Format != "mapped" && o.IPv4Format != "native" {
+		return usageError(errors.New("ipv4 format must be \"mapped\" or \"native\""))
+	}
+	// aliases would be written as the IPv4 networks they alias, twice.
+	if o.IPv4Format != "" && o.IncludeAliased {
+		return usageError(errors.New("aliased networks can't be included when formatting IPv4 networks"))
+	}
+	if o.IPv4Only && o.IPv6Only {
+		return usageError(errors.New("can't export only IPv4 and only IPv6 networks"))
+	}
+
+	if o.Flatten && len(o.Fields) > 0 {
+		return usageError(errors.New(
+			"flattening can't be combined with selecting fields; select nested values by their paths instead",
+		))
+	}
+	fields, err := parseExportFields(o.Fields)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if seen[field.name] {
+			return usageError(fmt.Errorf("field %q conflicts with a computed column", field.name))
+		}
+	}
+
+	return o.checkExporter()
+}
+
+// checkExporter checks the options of the exporter of the format, which its
+// constructor validates, by building one up front, so that invalid options
+// fail before anything is written.
+func (o *ExportOptions) checkExporter() error {
+	fields, err := parseExportFields(o.Fields)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+	layout := o.rangeLayout()
+	switch o.Format {
+	case "sql", "pgcopy", "clickhouse":
+		_, err = newSQLTable(o.Table, o.sqlDialect(), layout, nil, nil)
+	case "es-bulk":
+		_, err = newESBulkExporter(io.Discard, o.Index, o.DocID, fields, layout, o.CacheSize)
+	case "geojson":
+		_, err = newGeoJSONExporter(io.Discard, o.Coords, fields, layout, o.GeoJSONSeq, o.PerLocation, o.CacheSize)
+	case "nginx-geo", "haproxy-map", "ipset", "nftables-set":
+		_, err = o.newConfigExporter(io.Discard, o.NoHdr)
+	}
+	return err
+}
+
+// rangeLayout returns the layout of the range and computed columns.
+func (o *ExportOptions) rangeLayout() rangeLayout {
+	return rangeLayout{
+		ranges:   o.Ranges,
+		decimal:  o.DecimalRanges,
+		computed: o.Computed,
+	}
+}
+
+// sqlDialect returns the dialect of the table of the sql, pgcopy and
+// clickhouse formats; pgcopy and clickhouse imply theirs.
+func (o *ExportOptions) sqlDialect() string {
+	switch o.Format {
+	case "pgcopy":
+		return "postgres"
+	case "clickhouse":
+		return "clickhouse"
+	}
+	return o.Dialect
+}
+
+// newConfigExporter returns the exporter of the proxy and firewall config
+// formats.
+func (o *ExportOptions) newConfigExporter(w io.Writer, noHdr bool) (exporter, error) {
+	var valueField []exportField
+	if o.ValueField != "" {
+		var err error
+		valueField, err = parseExportFields([]string{o.ValueField})
+		if err != nil {
+			return nil, err
+		}
+	}
+	values := newConfigValues(valueField, o.CacheSize)
+	if o.Format == "ipset" || o.Format == "nftables-set" {
+		exp, err := newSetConfigExporter(w, o.Format, o.SetName, noHdr, values)
+		if err != nil {
+			return nil, err
+		}
+		return exp, nil
+	}
+	exp, err := newMapConfigExporter(w, o.Format, values)
+	if err != nil {
+		return nil, err
+	}
+	return exp, nil
+}
+
+// exportFormats are the formats Export writes.
+var exportFormats = []string{
+	"csv", "tsv", "json", "parquet", "sql", "pgcopy", "clickhouse", "es-bulk",
+	"geojson", "nginx-geo", "haproxy-map", "ipset", "nftables-set",
+}
+
+// exportConfigFormats are the formats of proxy and firewall configs, which
+// write the networks with just their value field.
+var exportConfigFormats = []string{"nginx-geo", "haproxy-map", "ipset", "nftables-set"}
+
+// newTextExporter returns the exporter of the "csv", "tsv" or "json" format,
+// formatting rows on workers goroutines if there's more than one.
+func newTextExporter(
+	format string,
+	w io.Writer,
+	noHdr bool,
+	hdrKeys []string,
+	hdrTypes []string,
+	cache *recordStrCache,
+	fields []exportField,
+	layout rangeLayout,
+	workers int,
+	tsvEscape bool,
+) exporter {
+	var exp rowFormatter
+	switch format {
+	case "csv":
+		exp = newCSVExporter(w, noHdr, hdrKeys, hdrTypes, cache, layout)
+	case "tsv":
+		exp = newTSVExporter(w, noHdr, hdrKeys, hdrTypes, cache, layout, tsvEscape)
+	default:
+		exp = newJSONExporter(w, fields, layout, cache.recs.size)
+	}
+	if workers > 1 {
+		return newParallelExporter(exp, workers)
+	}
+	return exp
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// exportField is a field selected for export by a spec like "country",
+// "country:cc" or "location.latitude:lat".
+type exportField struct {
+	// path is the path to the value within the record, as passed to
+	// Result.DecodePath: strings index maps and ints index arrays.
+	path []any
+
+	// name is the name the value is exported under.
+	name string
+}
+
+// parseExportFields parses field specs of the form "path[:name]", where path
+// is a field name, with nested fields and array elements separated by ".".
+// The name defaults to the path as given.
+func parseExportFields(specs []string) ([]exportField, error) {
+	fields := make([]exportField, 0, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		pathStr, name, renamed := strings.Cut(spec, ":")
+		if !renamed {
+			name = pathStr
+		}
+		if pathStr == "" || name == "" {
+			return nil, usageError(fmt.Errorf("invalid field %q", spec))
+		}
+		if seen[name] {
+			return nil, usageError(fmt.Errorf("field %q specified more than once", name))
+		}
+		seen[name] = true
+
+		var path []any
+		for _, k := range strings.Split(pathStr, ".") {
+			if k == "" {
+				return nil, usageError(fmt.Errorf("invalid field path %q", pathStr))
+			}
+			if i, err := strconv.Atoi(k); err == nil && i >= 0 {
+				path = append(path, i)
+			} else {
+				path = append(path, k)
+			}
+		}
+		fields = append(fields, exportField{path: path, name: name})
+	}
+	return fields, nil
+}
+
+// exportFieldNames returns the names of fields, in order.
+func exportFieldNames(fields []exportField) []string {
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.name
+	}
+	return names
+}
+
+// decodeFields decodes only the selected fields of the record of result,
+// keyed by their names. Fields which are missing from the record, or whose
+// path doesn't match its structure, are left out.
+func decodeFields(result maxminddb.Result, fields []exportField) (map[string]any, error) {
+	record := make(map[string]any, len(fields))
+	for _, field := range fields {
+		var v any
+		if err := result.DecodePath(&v, field.path...); err != nil {
+			var invalidErr maxminddb.InvalidDatabaseError
+			if errors.As(err, &invalidErr) {
+				return nil, invalidDBError(fmt.Errorf("failed to decode record: %w", err))
+			}
+			continue
+		}
+		if v != nil {
+			record[field.name] = v
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"math/big"
+	"net/netip"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// exportSpan is the span of addresses a record is exported for: a single
+// network, or a range of adjacent networks sharing the same record.
+type exportSpan struct {
+	// prefix is the network, if the span is exactly one network.
+	prefix netip.Prefix
+
+	start netip.Addr
+	end   netip.Addr
+}
+
+func spanOfPrefix(prefix netip.Prefix) exportSpan {
+	return exportSpan{
+		prefix: prefix,
+		start:  prefix.Addr(),
+		end:    prefixLastAddr(prefix),
+	}
+}
+
+// computedCols are the columns which can be computed from the span of a
+// record, and whether their JSON values are numbers rather than strings.
+var computedCols = map[string]bool{
+	"start_ip":         false,
+	"end_ip":           false,
+	"prefix_len":       true,
+	"num_addresses":    false,
+	"ip_version":       true,
+	"start_ip_decimal": false,
+	"end_ip_decimal":   false,
+	"offset":           true,
+}
+
+// computedColNames are the names of computedCols, in the order they're
+// documented in.
+var computedColNames = []string{
+	"start_ip",
+	"end_ip",
+	"prefix_len",
+	"num_addresses",
+	"ip_version",
+	"start_ip_decimal",
+	"end_ip_decimal",
+	"offset",
+}
+
+// rangeLayout is how the span of a record, and the columns computed from it,
+// are laid out in the exported columns or keys.
+type rangeLayout struct {
+	// ranges lays the span out as start_ip and end_ip, rather than a single
+	// CIDR in range.
+	ranges bool
+
+	// decimal writes start_ip and end_ip as decimal integers.
+	decimal bool
+
+	// computed are the computedCols to add after the span.
+	computed []string
+
+	// recordID adds a record_id column after the computed ones, holding
+	// the offset of the record, which identifies it in normalized exports.
+	recordID bool
+
+	// omitSpan leaves out the span, for records exported on their own.
+	omitSpan bool
+}
+
+// keys returns the names of the columns or keys holding the span, the
+// computed columns and the record ID.
+func (l rangeLayout) keys() []string {
+	var keys []string
+	switch {
+	case l.omitSpan:
+	case l.ranges:
+		keys = []string{"start_ip", "end_ip"}
+	default:
+		keys = []string{"range"}
+	}
+	keys = append(keys, l.computed...)
+	if l.recordID {
+		keys = append(keys, "record_id")
+	}
+	return keys
+}
+
+// spanLen returns the number of keys holding the span.
+func (l rangeLayout) spanLen() int {
+	switch {
+	case l.omitSpan:
+		return 0
+	case l.ranges:
+		return 2
+	}
+	return 1
+}
+
+// numeric reports whether the value of the i'th key is a number.
+func (l rangeLayout) numeric(i int) bool {
+	switch {
+	case i < l.spanLen():
+		return false
+	case i-l.spanLen() < len(l.computed):
+		return computedCols[l.computed[i-l.spanLen()]]
+	}
+	return true
+}
+
+// vals returns the values of the span, the computed columns and the record
+// ID for the record of result, in the order of keys(). Values which don't
+// apply, like the prefix length of a range which isn't a single network or
+// the offset of a network without data, are empty.
+func (l rangeLayout) vals(span exportSpan, result maxminddb.Result) []string {
+	var vals []string
+	switch {
+	case l.omitSpan:
+	case !l.ranges:
+		vals = []string{span.prefix.String()}
+	case l.decimal:
+		vals = []string{addrToDecimalStr(span.start), addrToDecimalStr(span.end)}
+	default:
+		vals = []string{span.start.String(), span.end.String()}
+	}
+
+	for _, col := range l.computed {
+		var val string
+		switch col {
+		case "start_ip":
+			val = span.start.String()
+		case "end_ip":
+			val = span.end.String()
+		case "prefix_len":
+			if span.prefix.IsValid() {
+				val = strconv.Itoa(span.prefix.Bits())
+			}
+		case "num_addresses":
+			start := new(big.Int).SetBytes(span.start.AsSlice())
+			end := new(big.Int).SetBytes(span.end.AsSlice())
+			val = end.Sub(end, start).Add(end, big.NewInt(1)).String()
+		case "ip_version":
+			if span.start.Is4() {
+				val = "4"
+			} else {
+				val = "6"
+			}
+		case "start_ip_decimal":
+			val = addrToDecimalStr(span.start)
+		case "end_ip_decimal":
+			val = addrToDecimalStr(span.end)
+		case "offset":
+			if result.Found() {
+				val = strconv.FormatUint(uint64(result.Offset()), 10)
+			}
+		}
+		vals = append(vals, val)
+	}
+
+	if l.recordID {
+		var val string
+		if result.Found() {
+			val = strconv.FormatUint(uint64(result.Offset()), 10)
+		}
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// rangeCollapser merges adjacent networks with the same record into a
+// single span, which is written once it can't be extended any further.
+type rangeCollapser struct {
+	write func(span exportSpan, result maxminddb.Result) error
+
+	pending bool
+	span    exportSpan
+	result  maxminddb.Result
+}
+
+// add adds the next network, in ascending address order.
+func (c *rangeCollapser) add(network netip.Prefix, result maxminddb.Result) error {
+	if c.pending && result.Offset() == c.result.Offset() {
+		if next := c.span.end.Next(); next.IsValid() && next == network.Addr() {
+			c.span.end = prefixLastAddr(network)
+			c.span.prefix = netip.Prefix{}
+			return nil
+		}
+	}
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+	c.pending = true
+	c.span = spanOfPrefix(network)
+	c.result = result
+	return nil
+}
+
+// flush writes the pending span, if any.
+func (c *rangeCollapser) flush() error {
+	if !c.pending {
+		return nil
+	}
+	c.pending = false
+	return c.write(c.span, c.result)
+}
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+)
+
+// shards splits the networks selected by s into at most n shards, each a
+// list of prefixes to walk, in the order they're walked by s.
+//
+// The widest prefix is halved until there are n, leaving out halves without
+// networks and not splitting prefixes within a single network, which would
+// split the network in the output. If s walks more than n prefixes, they're
+// grouped into n shards instead.
+func (s *exportSource) shards(n int) ([][]netip.Prefix, error) {
+	roots := s.within
+	if len(roots) == 0 {
+		if s.db.Metadata.IPVersion == 6 {
+			roots = []netip.Prefix{netip.MustParsePrefix("::/0")}
+		} else {
+			roots = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+		}
+	}
+
+	type shard struct {
+		prefix netip.Prefix
+		leaf   bool
+	}
+	var shards []shard
+	for _, prefix := range roots {
+		empty, leaf, err := s.probe(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			shards = append(shards, shard{prefix, leaf})
+		}
+	}
+
+	if len(shards) >= n {
+		groups := make([][]netip.Prefix, n)
+		for i, sh := range shards {
+			g := i * n / len(shards)
+			groups[g] = append(groups[g], sh.prefix)
+		}
+		return groups, nil
+	}
+
+	for len(shards) < n {
+		widest := -1
+		for i, sh := range shards {
+			if !sh.leaf && (widest < 0 || sh.prefix.Bits() < shards[widest].prefix.Bits()) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break
+		}
+
+		var halves []shard
+		for _, half := range splitPrefix(shards[widest].prefix) {
+			empty, leaf, err := s.probe(half)
+			if err != nil {
+				return nil, err
+			}
+			if !empty {
+				halves = append(halves, shard{half, leaf})
+			}
+		}
+		shards = slices.Replace(shards, widest, widest+1, halves...)
+	}
+
+	groups := make([][]netip.Prefix, len(shards))
+	for i, sh := range shards {
+		groups[i] = []netip.Prefix{sh.prefix}
+	}
+	return groups, nil
+}
+
+// probe reports whether there are no networks within prefix, and whether
+// it's within a single network, or can't be split further.
+func (s *exportSource) probe(prefix netip.Prefix) (empty bool, leaf bool, err error) {
+	for result := range s.db.NetworksWithin(prefix, s.opts...) {
+		if err := result.Err(); err != nil {
+			return false, false, invalidDBError(fmt.Errorf("failed networks traversal: %w", err))
+		}
+		// the networks of the IPv4 subtree are IPv4 even within IPv6
+		// prefixes.
+		return false, prefixBits128(result.Prefix()) <= prefixBits128(prefix) ||
+			prefix.Bits() == prefix.Addr().BitLen(), nil
+	}
+	return true, false, nil
+}
+
+// prefixBits128 returns the prefix length of prefix in the IPv6 address
+// space, where IPv4 networks are in ::/96.
+func prefixBits128(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return prefix.Bits() + 96
+	}
+	return prefix.Bits()
+}
+
+// splitPrefix returns the two halves of prefix. The IPv4 subtree of IPv6
+// databases, ::/96, is returned as 0.0.0.0/0, which the networks within it
+// are written as.
+func splitPrefix(prefix netip.Prefix) []netip.Prefix {
+	bits := prefix.Bits()
+	lo := netip.PrefixFrom(prefix.Addr(), bits+1)
+	b := prefix.Addr().AsSlice()
+	b[bits/8] |= 1 << (7 - bits%8)
+	hiAddr, _ := netip.AddrFromSlice(b)
+	hi := netip.PrefixFrom(hiAddr, bits+1)
+
+	if lo == netip.MustParsePrefix("::/96") {
+		lo = netip.MustParsePrefix("0.0.0.0/0")
+	}
+	return []netip.Prefix{lo, hi}
+}
+
+// exportShards exports the shards of the networks selected by src
+// concurrently, each with an exporter from newExp, to the writers returned by
+// opts.ShardOutput, or merged into w in order.
+//
+// Merged shards after the first are buffered in temporary files until the
+// shards before them are written. On error, those aren't written.
+func exportShards(
+	ctx context.Context,
+	src *exportSource,
+	opts *ExportOptions,
+	w io.Writer,
+	newExp func(w io.Writer, noHdr bool) (exporter, error),
+	prog *progress,
+	stats *ExportStats,
+) error {
+	shards, err := src.shards(max(opts.Shards, 1))
+	if err != nil {
+		return err
+	}
+
+	outs := make([]io.Writer, len(shards))
+	var tmps []*os.File
+	defer func() {
+		for _, tmp := range tmps {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	for i := range shards {
+		switch {
+		case opts.ShardOutput != nil:
+			outs[i], err = opts.ShardOutput(i)
+			if err != nil {
+				return err
+			}
+		case i == 0:
+			outs[i] = w
+		default:
+			tmp, err := os.CreateTemp("", "mmdbctl-shard-*")
+			if err != nil {
+				return ioError(fmt.Errorf("could not create shard file: %w", err))
+			}
+			tmps = append(tmps, tmp)
+			outs[i] = tmp
+		}
+	}
+	exps := make([]exporter, len(shards))
+	for i := range shards {
+		// merged shards share the header of the first.
+		noHdr := opts.NoHdr || (opts.ShardOutput == nil && i > 0)
+		exps[i], err = newExp(outs[i], noHdr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the node count is an upper bound estimate of the network count.
+	prog.Phase("export", "networks", int64(src.db.Metadata.NodeCount))
+	defer prog.Stop()
+
+	// the first error stops the other shards.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	shardStats := make([]ExportStats, len(shards))
+	for i, within := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shardSrc := *src
+			shardSrc.within = within
+			err := writeNetworks(ctx, &shardSrc, exps[i], opts.Ranges, prog, &shardStats[i])
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	for _, shardStat := range shardStats {
+		stats.Networks += shardStat.Networks
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for _, tmp := range tmps {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return ioError(fmt.Errorf("failed to read shard file: %w", err))
+		}
+		if _, err := io.Copy(w, tmp); err != nil {
+			return ioError(fmt.Errorf("failed to write shard: %w", err))
+		}
+	}
+	prog.Done()
+	return nil
+}
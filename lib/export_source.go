@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net/netip"
+	"sort"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// exportSource walks the networks of a database which are selected for
+// export by the network, address family and field filters.
+type exportSource struct {
+	db       *maxminddb.Reader
+	within   []netip.Prefix
+	ipv4Only bool
+	ipv6Only bool
+	where    whereExpr
+	ipv4Fmt  string
+	opts     []maxminddb.NetworksOption
+
+	// matches caches the result of where by record offset.
+	matches *lruCache[bool]
+}
+
+func newExportSource(db *maxminddb.Reader, opts *ExportOptions) (*exportSource, error) {
+	src := &exportSource{
+		db:       db,
+		ipv4Only: opts.IPv4Only,
+		ipv6Only: opts.IPv6Only,
+		ipv4Fmt:  opts.IPv4Format,
+		matches:  newLRUCache[bool](opts.CacheSize),
+	}
+	if opts.IncludeAliased {
+		src.opts = append(src.opts, maxminddb.IncludeAliasedNetworks())
+	}
+	if opts.IncludeEmpty {
+		src.opts = append(src.opts, maxminddb.IncludeNetworksWithoutData())
+	}
+
+	for _, prefix := range opts.Within {
+		if !prefix.IsValid() {
+			return nil, usageError(errors.New("invalid network to export within"))
+		}
+		if db.Metadata.IPVersion == 4 && !prefix.Addr().Is4() {
+			return nil, usageError(fmt.Errorf(
+				"can't export within %v from an IPv4 database", prefix,
+			))
+		}
+	}
+	src.within = collapsePrefixes(opts.Within)
+
+	// walking the IPv4 subtree only is much cheaper than filtering.
+	if len(src.within) == 0 && src.ipv4Only && db.Metadata.IPVersion == 6 {
+		src.within = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+	}
+
+	if opts.Where != "" {
+		where, err := parseWhere(opts.Where)
+		if err != nil {
+			return nil, usageError(err)
+		}
+		src.where = where
+	}
+
+	return src, nil
+}
+
+// collapsePrefixes masks prefixes and drops those contained in others, so
+// that walking each of them visits no network twice, and sorts them by
+// address, so that the networks are walked in order.
+//
+// IPv4 prefixes are compared as the prefixes of ::/96 they're stored at in
+// IPv6 databases, so that they're dropped if an IPv6 prefix contains them.
+func collapsePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	type collapsedPrefix struct {
+		prefix netip.Prefix
+		is4    bool
+	}
+	sorted := make([]collapsedPrefix, len(prefixes))
+	for i, prefix := range prefixes {
+		prefix = prefix.Masked()
+		sorted[i] = collapsedPrefix{prefix, prefix.Addr().Is4()}
+		if sorted[i].is4 {
+			var addr [16]byte
+			v4 := prefix.Addr().As4()
+			copy(addr[12:], v4[:])
+			sorted[i].prefix = netip.PrefixFrom(netip.AddrFrom16(addr), prefix.Bits()+96)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].prefix.Bits() < sorted[j].prefix.Bits()
+	})
+
+	var collapsed []collapsedPrefix
+outer:
+	for _, p := range sorted {
+		for _, kept := range collapsed {
+			if kept.prefix.Contains(p.prefix.Addr()) {
+				continue outer
+			}
+		}
+		collapsed = append(collapsed, p)
+	}
+	sort.Slice(collapsed, func(i, j int) bool {
+		if c := collapsed[i].prefix.Addr().Compare(collapsed[j].prefix.Addr()); c != 0 {
+			return c < 0
+		}
+		return collapsed[i].prefix.Bits() < collapsed[j].prefix.Bits()
+	})
+
+	result := make([]netip.Prefix, len(collapsed))
+	for i, p := range collapsed {
+		result[i] = p.prefix
+		if p.is4 {
+			v4 := p.prefix.Addr().As16()
+			result[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte(v4[12:])), p.prefix.Bits()-96)
+		}
+	}
+	return result
+}
+
+// walk calls fn for each selected network, along with its record.
+//
+// Networks larger than the prefix they were found within are clipped to it,
+// as the whole network isn't being exported.
+func (s *exportSource) walk(
+	ctx context.Context,
+	prog *progress,
+	fn func(network netip.Prefix, result maxminddb.Result) error,
+) error {
+	type root struct {
+		prefix netip.Prefix
+		seq    iter.Seq[maxminddb.Result]
+	}
+	var roots []root
+	if len(s.within) == 0 {
+		roots = append(roots, root{seq: s.db.Networks(s.opts...)})
+	}
+	for _, prefix := range s.within {
+		roots = append(roots, root{prefix, s.db.NetworksWithin(prefix, s.opts...)})
+	}
+
+	for _, r := range roots {
+		for result := range r.seq {
+			if err := ctxError(ctx); err != nil {
+				return err
+			}
+			if err := result.Err(); err != nil {
+				return invalidDBError(fmt.Errorf("failed networks traversal: %w", err))
+			}
+			prog.Add(1)
+
+			network := result.Prefix()
+			if r.prefix.IsValid() && network.Bits() < r.prefix.Bits() &&
+				network.Contains(r.prefix.Addr()) {
+				network = r.prefix
+			}
+
+			is4 := network.Addr().Is4()
+			if (s.ipv4Only && !is4) || (s.ipv6Only && is4) {
+				continue
+			}
+
+			network = formatIPv4Prefix(network, s.ipv4Fmt)
+
+			if s.where != nil {
+				matches, err := s.match(result)
+				if err != nil {
+					return err
+				}
+				if !matches {
+					continue
+				}
+			}
+
+			if err := fn(network, result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatIPv4Prefix formats IPv4 networks as IPv4-mapped IPv6 networks if
+// format is "mapped", and the reverse if format is "native". Otherwise, the
+// network is returned as is.
+func formatIPv4Prefix(network netip.Prefix, format string) netip.Prefix {
+	addr := network.Addr()
+	switch {
+	case format == "mapped" && addr.Is4():
+		return netip.PrefixFrom(netip.AddrFrom16(addr.As16()), network.Bits()+96)
+	case format == "native" && addr.Is4In6() && network.Bits() >= 96:
+		return netip.PrefixFrom(addr.Unmap(), network.Bits()-96)
+	}
+	return network
+}
+
+// match evaluates the where predicate against the record of result.
+func (s *exportSource) match(result maxminddb.Result) (bool, error) {
+	offset := result.Offset()
+	if matches, ok := s.matches.get(offset); ok {
+		return matches, nil
+	}
+
+	record := make(map[string]any)
+	if err := result.Decode(&record); err != nil {
+		return false, invalidDBError(fmt.Errorf("failed to decode record: %w", err))
+	}
+	matches := s.where.eval(record)
+	s.matches.add(offset, matches)
+	return matches, nil
+}
@@ -1,26 +1,200 @@
 package lib
 
 import (
+	"context"
 	"fmt"
+	"net/netip"
 
 	"github.com/oschwald/maxminddb-golang/v2"
 )
 
 // exporter defines the interface for exporting MMDB records.
 type exporter interface {
-	WriteRecord(result maxminddb.Result) error
+	// WriteRecord writes span along with the record of result. span is
+	// usually result.Prefix(), but may be narrower, or a range of networks.
+	WriteRecord(span exportSpan, result maxminddb.Result) error
 	Flush() error
 }
 
-// exportNetworks iterates over all networks in the database and writes them using the exporter.
-func exportNetworks(db *maxminddb.Reader, exp exporter) error {
-	for result := range db.Networks() {
-		if err := result.Err(); err != nil {
-			return fmt.Errorf("failed networks traversal: %w", err)
+// aborter is implemented by exporters whose output ends with a terminator
+// which would make a partial export load as a complete one.
+type aborter interface {
+	// Abort writes out the records written so far without the terminator;
+	// no records can be written after it.
+	Abort() error
+}
+
+// exportNetworks iterates over the networks selected by src and writes them using the exporter.
+func exportNetworks(
+	ctx context.Context,
+	src *exportSource,
+	exp exporter,
+	collapse bool,
+	prog *progress,
+	stats *ExportStats,
+) error {
+	// the node count is an upper bound estimate of the network count.
+	prog.Phase("export", "networks", int64(src.db.Metadata.NodeCount))
+	defer prog.Stop()
+
+	if err := writeNetworks(ctx, src, exp, collapse, prog, stats); err != nil {
+		return err
+	}
+	prog.Done()
+	return nil
+}
+
+// writeNetworks writes the networks selected by src using the exporter, and
+// flushes it, counting them in stats.
+func writeNetworks(
+	ctx context.Context,
+	src *exportSource,
+	exp exporter,
+	collapse bool,
+	prog *progress,
+	stats *ExportStats,
+) error {
+	write := func(span exportSpan, result maxminddb.Result) error {
+		if err := exp.WriteRecord(span, result); err != nil {
+			return err
+		}
+		stats.Networks += 1
+		return nil
+	}
+
+	var err error
+	if collapse {
+		collapser := &rangeCollapser{write: write}
+		err = src.walk(ctx, prog, collapser.add)
+		if err == nil {
+			err = collapser.flush()
 		}
-		if err := exp.WriteRecord(result); err != nil {
+	} else {
+		err = src.walk(ctx, prog, func(network netip.Prefix, result maxminddb.Result) error {
+			return write(spanOfPrefix(network), result)
+		})
+	}
+	if err != nil {
+		// whole records were written so far; keep them, which also stops
+		// the workers of parallel exporters.
+		if a, ok := exp.(aborter); ok {
+			a.Abort()
+		} else {
+			exp.Flush()
+		}
+		return err
+	}
+	if err := exp.Flush(); err != nil {
+		return ioError(fmt.Errorf("failed to flush output: %w", err))
+	}
+	return nil
+}
+
+// recordStrCache decodes records with their values converted to strings,
+// caching them by their offset in the data section, as many networks usually
+// share the same record. It's safe for concurrent use.
+type recordStrCache struct {
+	recs *lruCache[map[string]string]
+
+	// fields, if set, are the only fields decoded.
+	fields []exportField
+
+	// flatten expands nested values into dotted keys; see flattenRecord.
+	flatten    bool
+	arrayDelim string
+
+	// lossless converts values to strings of a typed header; see
+	// losslessStr.
+	lossless bool
+}
+
+func newRecordStrCache(
+	fields []exportField,
+	flatten bool,
+	arrayDelim string,
+	cacheSize int,
+) *recordStrCache {
+	return &recordStrCache{
+		recs:       newLRUCache[map[string]string](cacheSize),
+		fields:     fields,
+		flatten:    flatten,
+		arrayDelim: arrayDelim,
+	}
+}
+
+// has reports whether the record at offset is cached.
+func (c *recordStrCache) has(offset uintptr) bool {
+	_, ok := c.recs.get(offset)
+	return ok
+}
+
+// decode returns the record of result.
+func (c *recordStrCache) decode(result maxminddb.Result) (map[string]string, error) {
+	offset := result.Offset()
+	if cached, ok := c.recs.get(offset); ok {
+		return cached, nil
+	}
+
+	var record map[string]any
+	if c.fields != nil {
+		var err error
+		record, err = decodeFields(result, c.fields)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		record = make(map[string]any)
+		if err := result.Decode(&record); err != nil {
+			return nil, invalidDBError(fmt.Errorf("failed to decode record: %w", err))
+		}
+	}
+	toStr := mapInterfaceToStr
+	if c.lossless {
+		toStr = mapInterfaceToLosslessStr
+	}
+	var recordStr map[string]string
+	if c.flatten {
+		recordStr = toStr(flattenLeaves(record, c.arrayDelim))
+	} else {
+		recordStr = toStr(record)
+	}
+	c.recs.add(offset, recordStr)
+	return recordStr, nil
+}
+
+// discoverHdrKeys does a pass over the networks selected by src and returns
+// the union of the keys of their records, sorted.
+//
+// The decoded records are left in cache for the export pass to reuse.
+func discoverHdrKeys(
+	ctx context.Context,
+	src *exportSource,
+	cache *recordStrCache,
+	prog *progress,
+) ([]string, error) {
+	prog.Phase("discover fields", "networks", int64(src.db.Metadata.NodeCount))
+	defer prog.Stop()
+
+	keySet := make(map[string]string)
+	err := src.walk(ctx, prog, func(_ netip.Prefix, result maxminddb.Result) error {
+		// only new records can contribute new keys; those evicted from the
+		// cache are merely decoded again.
+		if cache.has(result.Offset()) {
+			return nil
+		}
+		recordStr, err := cache.decode(result)
+		if err != nil {
 			return err
 		}
+		for k := range recordStr {
+			keySet[k] = ""
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return exp.Flush()
+	prog.Done()
+
+	return sortedMapKeys(keySet), nil
 }
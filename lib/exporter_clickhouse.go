@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// clickHouseExporter exports records as TSV for a ClickHouse ip_trie
+// dictionary: a prefix column holding the network, followed by the computed
+// columns and a column per record field, typed as in the dictionary
+// statement of the table.
+//
+// The header names the columns, as the TabSeparatedWithNames format
+// expects; without it, the rows are in the TabSeparated format.
+type clickHouseExporter struct {
+	bw    *bufio.Writer
+	table *sqlTable
+	cache *typedRecordCache
+	noHdr bool
+
+	hdrWritten bool
+
+	// vals caches the rendered field values of records by their offset.
+	vals *lruCache[[]string]
+}
+
+func newClickHouseExporter(
+	w io.Writer,
+	noHdr bool,
+	table *sqlTable,
+	cache *typedRecordCache,
+) *clickHouseExporter {
+	return &clickHouseExporter{
+		bw:    bufio.NewWriter(w),
+		table: table,
+		cache: cache,
+		noHdr: noHdr,
+		vals:  newLRUCache[[]string](cache.recs.size),
+	}
+}
+
+// clickHouseFormat returns the ClickHouse input format of the rows.
+func clickHouseFormat(noHdr bool) string {
+	if noHdr {
+		return "TabSeparated"
+	}
+	return "TabSeparatedWithNames"
+}
+
+// dictionaryStmt returns the CREATE DICTIONARY statement of an ip_trie
+// dictionary loading the table from the file at source, relative to the
+// user_files directory of the server.
+func (t *sqlTable) dictionaryStmt(source string, noHdr bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE DICTIONARY %s\n(\n", t.quoteIdent(t.name))
+	for i, col := range t.cols {
+		fmt.Fprintf(&b, "  %s %s", t.quoteIdent(col), sqlTypes["clickhouse"][t.kinds[i]])
+		if i < len(t.cols)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(")\n")
+	fmt.Fprintf(&b, "PRIMARY KEY %s\n", t.quoteIdent(t.cols[0]))
+	fmt.Fprintf(&b, "SOURCE(FILE(path '%s' format '%s'))\n",
+		strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(source), clickHouseFormat(noHdr))
+	b.WriteString("LAYOUT(IP_TRIE)\n")
+	b.WriteString("LIFETIME(0);\n")
+	return b.String()
+}
+
+// clickHouseValue returns v in the TSV format for a column of kind. Missing
+// values are NULL, which ClickHouse loads as the default of the column.
+func clickHouseValue(kind string, v mmdbtype.DataType) string {
+	if v == nil {
+		return `\N`
+	}
+	switch kind {
+	case "mixed", "map", "slice":
+		// pgCopyEscaper escapes the same characters ClickHouse does.
+		return pgCopyEscaper.Replace(typedToStr(v))
+	}
+
+	switch v := v.(type) {
+	case mmdbtype.String:
+		return pgCopyEscaper.Replace(string(v))
+	case mmdbtype.Bytes:
+		return pgCopyEscaper.Replace(string(v))
+	case mmdbtype.Bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	}
+	if n, ok := sqlNumber(v); ok {
+		return n
+	}
+	switch pgNonFinite(v) {
+	case "Infinity":
+		return "inf"
+	case "-Infinity":
+		return "-inf"
+	}
+	return "nan"
+}
+
+func (e *clickHouseExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	if !e.hdrWritten {
+		e.hdrWritten = true
+		if !e.noHdr {
+			hdr := make([]string, len(e.table.cols))
+			for i, col := range e.table.cols {
+				hdr[i] = pgCopyEscaper.Replace(col)
+			}
+			if _, err := e.bw.WriteString(strings.Join(hdr, "\t") + "\n"); err != nil {
+				return ioError(fmt.Errorf("failed to write header: %w", err))
+			}
+		}
+	}
+
+	offset := result.Offset()
+	vals, ok := e.vals.get(offset)
+	if !ok {
+		record, _, err := e.cache.decode(result)
+		if err != nil {
+			return err
+		}
+		fieldCols := e.table.cols[len(e.table.cols)-len(e.table.fields):]
+		vals = make([]string, len(fieldCols))
+		for i, col := range fieldCols {
+			vals[i] = clickHouseValue(e.table.fields[i].kind, record[mmdbtype.String(col)])
+		}
+		e.vals.add(offset, vals)
+	}
+
+	line := make([]string, 0, len(e.table.cols))
+	for _, v := range e.table.layout.vals(span, result) {
+		if v == "" {
+			v = `\N`
+		}
+		line = append(line, v)
+	}
+	line = append(line, vals...)
+	if _, err := e.bw.WriteString(strings.Join(line, "\t") + "\n"); err != nil {
+		return ioError(fmt.Errorf("failed to write row: %w", err))
+	}
+	return nil
+}
+
+func (e *clickHouseExporter) Flush() error {
+	return e.bw.Flush()
+}
@@ -0,0 +1,342 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// cidrAggregator merges adjacent spans with the same value, and writes each
+// merged range as the fewest CIDRs covering it once it can't be extended any
+// further.
+type cidrAggregator struct {
+	write func(prefix netip.Prefix, value string) error
+
+	pending bool
+	start   netip.Addr
+	end     netip.Addr
+	value   string
+}
+
+// add adds the next span, in ascending address order.
+func (a *cidrAggregator) add(span exportSpan, value string) error {
+	if a.pending && value == a.value {
+		if next := a.end.Next(); next.IsValid() && next == span.start {
+			a.end = span.end
+			return nil
+		}
+	}
+
+	if err := a.flush(); err != nil {
+		return err
+	}
+	a.pending = true
+	a.start = span.start
+	a.end = span.end
+	a.value = value
+	return nil
+}
+
+// flush writes the pending range, if any.
+func (a *cidrAggregator) flush() error {
+	if !a.pending {
+		return nil
+	}
+	a.pending = false
+	for _, prefix := range rangeToPrefixes(a.start, a.end) {
+		if err := a.write(prefix, a.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configValues decodes the value field of records, caching it by their
+// offset.
+type configValues struct {
+	// field is the value field, or nil if there's none.
+	field []exportField
+
+	vals *lruCache[configValue]
+}
+
+// configValue is the value field of a record.
+type configValue struct {
+	str string
+
+	// truthy is whether the value is set and not empty, zero or false, the
+	// same as a bare field in a where expression.
+	truthy bool
+}
+
+func newConfigValues(field []exportField, cacheSize int) *configValues {
+	return &configValues{
+		field: field,
+		vals:  newLRUCache[configValue](cacheSize),
+	}
+}
+
+// decode returns the value field of the record of result.
+func (c *configValues) decode(result maxminddb.Result) (configValue, error) {
+	offset := result.Offset()
+	if val, ok := c.vals.get(offset); ok {
+		return val, nil
+	}
+
+	var val configValue
+	if c.field != nil {
+		record, err := decodeFields(result, c.field)
+		if err != nil {
+			return val, err
+		}
+		name := c.field[0].name
+		val.str = mapInterfaceToStr(record)[name]
+		val.truthy = whereTruthy{path: []string{name}}.eval(record)
+	} else {
+		val.truthy = true
+	}
+	c.vals.add(offset, val)
+	return val, nil
+}
+
+// haproxyValueEscaper keeps HAProxy map values on a single line.
+var haproxyValueEscaper = strings.NewReplacer("\r", " ", "\n", " ")
+
+// nginxQuote returns s as an nginx config token, quoted if needed.
+func nginxQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n;{}\"'\\#$") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// mapConfigExporter exports the value field of records as an nginx geo or
+// HAProxy map file, mapping networks to their values.
+//
+// Adjacent networks with the same value are aggregated into the fewest CIDRs
+// covering them. Networks without a value are left out, so that they get the
+// default of the map.
+type mapConfigExporter struct {
+	bw     *bufio.Writer
+	format string
+	values *configValues
+	agg    cidrAggregator
+
+	flushed bool
+}
+
+// newMapConfigExporter returns the exporter of the "nginx-geo" or
+// "haproxy-map" format, which requires a value field.
+func newMapConfigExporter(
+	w io.Writer,
+	format string,
+	values *configValues,
+) (*mapConfigExporter, error) {
+	if values.field == nil {
+		return nil, usageError(fmt.Errorf("the %v format requires a value field", format))
+	}
+
+	e := &mapConfigExporter{
+		bw:     bufio.NewWriter(w),
+		format: format,
+		values: values,
+	}
+	e.agg.write = e.writeLine
+	return e, nil
+}
+
+func (e *mapConfigExporter) writeLine(prefix netip.Prefix, value string) error {
+	var line string
+	if e.format == "nginx-geo" {
+		line = prefix.String() + " " + nginxQuote(value) + ";\n"
+	} else {
+		line = prefix.String() + " " + haproxyValueEscaper.Replace(value) + "\n"
+	}
+	if _, err := e.bw.WriteString(line); err != nil {
+		return ioError(fmt.Errorf("failed to write line %q: %w", line, err))
+	}
+	return nil
+}
+
+func (e *mapConfigExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	val, err := e.values.decode(result)
+	if err != nil {
+		return err
+	}
+	if val.str == "" {
+		return nil
+	}
+	return e.agg.add(span, val.str)
+}
+
+func (e *mapConfigExporter) Flush() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	if err := e.agg.flush(); err != nil {
+		return err
+	}
+	return e.bw.Flush()
+}
+
+// setConfigExporter exports networks as ipset or nftables sets, one for
+// IPv4 networks named "<name>_v4" and one for IPv6 networks named
+// "<name>_v6". If there's a value field, only the networks whose value is
+// set and not empty, zero or false are members.
+//
+// Adjacent member networks are aggregated into the fewest CIDRs covering
+// them.
+//
+// For ipset, the output is for "ipset restore": the header creates the sets,
+// followed by a line adding each member. For nftables, the output declares
+// the sets, to be included in a table; as a set is declared with all of its
+// elements, they're held in memory until the end. Without the header, only
+// the elements are written, one per line, each followed by a comma.
+type setConfigExporter struct {
+	bw     *bufio.Writer
+	format string
+	name   string
+	noHdr  bool
+	values *configValues
+	agg    cidrAggregator
+
+	hdrWritten bool
+	flushed    bool
+
+	// elems are the elements of the nftables IPv4 and IPv6 sets.
+	elems [2]bytes.Buffer
+}
+
+// newSetConfigExporter returns the exporter of the "ipset" or "nftables-set"
+// format, whose sets are named after name, which defaults to "networks".
+func newSetConfigExporter(
+	w io.Writer,
+	format string,
+	name string,
+	noHdr bool,
+	values *configValues,
+) (*setConfigExporter, error) {
+	if name == "" {
+		name = "networks"
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return nil, usageError(fmt.Errorf("set name %q must only have letters, digits and underscores", name))
+		}
+	}
+
+	e := &setConfigExporter{
+		bw:     bufio.NewWriter(w),
+		format: format,
+		name:   name,
+		noHdr:  noHdr,
+		values: values,
+	}
+	e.agg.write = e.writeMember
+	return e, nil
+}
+
+// setNames returns the names of the IPv4 and IPv6 sets.
+func (e *setConfigExporter) setNames() [2]string {
+	return [2]string{e.name + "_v4", e.name + "_v6"}
+}
+
+// writeHdr writes the ipset commands creating the sets.
+func (e *setConfigExporter) writeHdr() error {
+	e.hdrWritten = true
+	if e.noHdr || e.format != "ipset" {
+		return nil
+	}
+	names := e.setNames()
+	hdr := "create " + names[0] + " hash:net family inet -exist\n" +
+		"create " + names[1] + " hash:net family inet6 -exist\n"
+	if _, err := e.bw.WriteString(hdr); err != nil {
+		return ioError(fmt.Errorf("failed to write header: %w", err))
+	}
+	return nil
+}
+
+func (e *setConfigExporter) writeMember(prefix netip.Prefix, _ string) error {
+	family := 0
+	if !prefix.Addr().Is4() {
+		family = 1
+	}
+	if e.format == "nftables-set" {
+		if e.noHdr {
+			e.elems[family].WriteString(prefix.String() + ",\n")
+		} else {
+			e.elems[family].WriteString("\t\t" + prefix.String() + ",\n")
+		}
+		return nil
+	}
+
+	line := prefix.String() + "\n"
+	if !e.noHdr {
+		line = "add " + e.setNames()[family] + " " + prefix.String() + " -exist\n"
+	}
+	if _, err := e.bw.WriteString(line); err != nil {
+		return ioError(fmt.Errorf("failed to write line %q: %w", line, err))
+	}
+	return nil
+}
+
+func (e *setConfigExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	if !e.hdrWritten {
+		if err := e.writeHdr(); err != nil {
+			return err
+		}
+	}
+
+	val, err := e.values.decode(result)
+	if err != nil {
+		return err
+	}
+	if !val.truthy {
+		return nil
+	}
+	return e.agg.add(span, "")
+}
+
+// writeNftSets writes the nftables set declarations with their elements.
+func (e *setConfigExporter) writeNftSets() {
+	types := [2]string{"ipv4_addr", "ipv6_addr"}
+	for family, name := range e.setNames() {
+		if e.noHdr {
+			e.bw.Write(e.elems[family].Bytes())
+			continue
+		}
+		fmt.Fprintf(e.bw, "set %s {\n\ttype %s\n\tflags interval\n", name, types[family])
+		// nftables doesn't accept an empty list of elements.
+		if e.elems[family].Len() > 0 {
+			e.bw.WriteString("\telements = {\n")
+			e.bw.Write(e.elems[family].Bytes())
+			e.bw.WriteString("\t}\n")
+		}
+		e.bw.WriteString("}\n")
+	}
+}
+
+func (e *setConfigExporter) Flush() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	if !e.hdrWritten {
+		if err := e.writeHdr(); err != nil {
+			return err
+		}
+	}
+	if err := e.agg.flush(); err != nil {
+		return err
+	}
+	if e.format == "nftables-set" {
+		e.writeNftSets()
+	}
+	return e.bw.Flush()
+}
@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"io"
@@ -9,46 +11,47 @@ import (
 )
 
 // csvExporter exports records in CSV format.
+//
+// The columns are fixed up front by hdrKeys; keys missing from a record are
+// left empty and keys not in hdrKeys are left out. hdrTypes, if set,
+// annotates them in a typed header.
 type csvExporter struct {
-	wr      *csv.Writer
-	cache   map[uintptr]map[string]string
-	hdrKeys []string
-	noHdr   bool
+	bw         *bufio.Writer
+	wr         *csv.Writer
+	cache      *recordStrCache
+	hdrKeys    []string
+	hdrTypes   []string
+	noHdr      bool
+	hdrWritten bool
+	layout     rangeLayout
 }
 
-func newCSVExporter(w io.Writer, noHdr bool) *csvExporter {
+func newCSVExporter(
+	w io.Writer,
+	noHdr bool,
+	hdrKeys []string,
+	hdrTypes []string,
+	cache *recordStrCache,
+	layout rangeLayout,
+) *csvExporter {
+	// the CSV writer buffers into bw, which formatted rows are written to.
+	bw := bufio.NewWriter(w)
 	return &csvExporter{
-		wr:    csv.NewWriter(w),
-		cache: make(map[uintptr]map[string]string),
-		noHdr: noHdr,
+		bw:       bw,
+		wr:       csv.NewWriter(bw),
+		cache:    cache,
+		hdrKeys:  hdrKeys,
+		hdrTypes: hdrTypes,
+		noHdr:    noHdr,
+		layout:   layout,
 	}
 }
 
-func (e *csvExporter) WriteRecord(result maxminddb.Result) error {
-	offset := result.Offset()
-	prefix := result.Prefix()
-
-	var recordStr map[string]string
-	if cached, ok := e.cache[offset]; ok {
-		recordStr = cached
-	} else {
-		record := make(map[string]any)
-		if err := result.Decode(&record); err != nil {
-			return fmt.Errorf("failed to decode record: %w", err)
-		}
-		recordStr = mapInterfaceToStr(record)
-		e.cache[offset] = recordStr
-	}
-
-	// Write header on first record.
-	if e.hdrKeys == nil {
-		e.hdrKeys = sortedMapKeys(recordStr)
-		if !e.noHdr {
-			hdr := append([]string{"range"}, e.hdrKeys...)
-			if err := e.wr.Write(hdr); err != nil {
-				return fmt.Errorf("failed to write header %v: %w", hdr, err)
-			}
-		}
+// row returns the values of the row of span and the record of result.
+func (e *csvExporter) row(span exportSpan, result maxminddb.Result) ([]string, error) {
+	recordStr, err := e.cache.decode(result)
+	if err != nil {
+		return nil, err
 	}
 
 	// Build values in header key order.
@@ -56,10 +59,58 @@ func (e *csvExporter) WriteRecord(result maxminddb.Result) error {
 	for i, k := range e.hdrKeys {
 		vals[i] = recordStr[k]
 	}
+	return append(e.layout.vals(span, result), vals...), nil
+}
+
+// writeHdr writes the header before the first row.
+func (e *csvExporter) writeHdr() error {
+	if e.hdrWritten {
+		return nil
+	}
+	e.hdrWritten = true
+	if e.noHdr {
+		return nil
+	}
+	hdr := append(e.layout.keys(), typedHeader(e.hdrKeys, e.hdrTypes)...)
+	if err := e.wr.Write(hdr); err != nil {
+		return ioError(fmt.Errorf("failed to write header %v: %w", hdr, err))
+	}
+	return nil
+}
 
-	line := append([]string{prefix.String()}, vals...)
+func (e *csvExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	line, err := e.row(span, result)
+	if err != nil {
+		return err
+	}
+	if err := e.writeHdr(); err != nil {
+		return err
+	}
 	if err := e.wr.Write(line); err != nil {
-		return fmt.Errorf("failed to write line %v: %w", line, err)
+		return ioError(fmt.Errorf("failed to write line %v: %w", line, err))
+	}
+	return nil
+}
+
+func (e *csvExporter) formatRows(buf *bytes.Buffer, rows []exportRow) error {
+	wr := csv.NewWriter(buf)
+	for _, row := range rows {
+		line, err := e.row(row.span, row.result)
+		if err != nil {
+			return err
+		}
+		wr.Write(line)
+	}
+	wr.Flush()
+	return wr.Error()
+}
+
+func (e *csvExporter) writeFormatted(formatted []byte) error {
+	if err := e.writeHdr(); err != nil {
+		return err
+	}
+	if _, err := e.bw.Write(formatted); err != nil {
+		return ioError(fmt.Errorf("failed to write lines: %w", err))
 	}
 	return nil
 }
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// esDocIDs are the document IDs esBulkExporter can write: the prefix or
+// range of the network, or none, letting Elasticsearch generate them. IDs
+// must be unique to each network, as later documents with the same ID
+// replace earlier ones.
+var esDocIDs = []string{"prefix", "none"}
+
+// esBulkExporter exports records as Elasticsearch bulk API requests: NDJSON
+// pairs of an index action and a document. Each document has the network in
+// a "range" field of type ip_range, as a CIDR or, for ranges which aren't a
+// single network, a {"gte", "lte"} object, followed by the computed columns
+// and the fields as in JSON exports.
+type esBulkExporter struct {
+	bw    *bufio.Writer
+	docs  *jsonExporter
+	index string
+	docID string
+}
+
+// newESBulkExporter returns the exporter of documents into index, which
+// defaults to "networks", with IDs of the kind docID, one of esDocIDs, which
+// defaults to "prefix".
+func newESBulkExporter(
+	w io.Writer,
+	index string,
+	docID string,
+	fields []exportField,
+	layout rangeLayout,
+	cacheSize int,
+) (*esBulkExporter, error) {
+	if layout.decimal {
+		return nil, usageError(errors.New("decimal ranges don't apply to the es-bulk format; ranges are ip_range values"))
+	}
+
+	if index == "" {
+		index = "networks"
+	}
+	// see the index name restrictions of Elasticsearch.
+	if strings.ToLower(index) != index ||
+		strings.ContainsAny(index, `\/*?"<>| ,#:`) ||
+		strings.IndexAny(index, "-_+") == 0 ||
+		index == "." || index == ".." {
+		return nil, usageError(fmt.Errorf("invalid index name %q", index))
+	}
+
+	if docID == "" {
+		docID = "prefix"
+	} else if !slices.Contains(esDocIDs, docID) {
+		return nil, usageError(fmt.Errorf("document ID must be one of %v", esDocIDs))
+	}
+
+	docs := newJSONExporter(io.Discard, fields, rangeLayout{computed: layout.computed}, cacheSize)
+	docs.spanVal = esRange
+	return &esBulkExporter{
+		bw:    bufio.NewWriter(w),
+		docs:  docs,
+		index: index,
+		docID: docID,
+	}, nil
+}
+
+// esRange returns the ip_range value of span.
+func esRange(span exportSpan) []byte {
+	if span.prefix.IsValid() {
+		encoded, _ := json.Marshal(span.prefix.String())
+		return encoded
+	}
+	return []byte(`{"gte":"` + span.start.String() + `","lte":"` + span.end.String() + `"}`)
+}
+
+func (e *esBulkExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	doc, err := e.docs.encodeLine(span, result)
+	if err != nil {
+		return err
+	}
+
+	action := map[string]string{"_index": e.index}
+	switch e.docID {
+	case "prefix":
+		if span.prefix.IsValid() {
+			action["_id"] = span.prefix.String()
+		} else {
+			action["_id"] = span.start.String() + "-" + span.end.String()
+		}
+	}
+	encoded, err := json.Marshal(map[string]any{"index": action})
+	if err != nil {
+		return fmt.Errorf("failed to encode action: %w", err)
+	}
+
+	e.bw.Write(encoded)
+	e.bw.WriteByte('\n')
+	e.bw.Write(doc)
+	e.bw.WriteByte('\n')
+	return nil
+}
+
+func (e *esBulkExporter) Flush() error {
+	return e.bw.Flush()
+}
+
+// esFieldTypes are the Elasticsearch field types of the MMDB types of
+// fields. Values which don't share a type are mapped as keywords, which
+// Elasticsearch coerces scalars to.
+var esFieldTypes = map[string]string{
+	"string":  "keyword",
+	"bytes":   "binary",
+	"float32": "float",
+	"float64": "double",
+	"bool":    "boolean",
+	"int32":   "integer",
+	"uint16":  "integer",
+	"uint32":  "long",
+	"uint64":  "unsigned_long",
+	"uint128": "keyword",
+	"mixed":   "keyword",
+}
+
+// esComputedTypes are the Elasticsearch field types of the computed columns.
+var esComputedTypes = map[string]string{
+	"start_ip":         "ip",
+	"end_ip":           "ip",
+	"prefix_len":       "integer",
+	"num_addresses":    "keyword",
+	"ip_version":       "integer",
+	"start_ip_decimal": "keyword",
+	"end_ip_decimal":   "keyword",
+	"offset":           "long",
+}
+
+// esMapping returns the Elasticsearch mapping of a field of type ft.
+func (ft *fieldType) esMapping() map[string]any {
+	switch ft.kind {
+	case "map":
+		props := make(map[string]any, len(ft.fields))
+		for name, field := range ft.fields {
+			props[name] = field.esMapping()
+		}
+		return map[string]any{"properties": props}
+	case "slice":
+		// arrays are implicit; their elements are mapped.
+		if ft.elem == nil {
+			return map[string]any{"type": "keyword"}
+		}
+		return ft.elem.esMapping()
+	}
+	return map[string]any{"type": esFieldTypes[ft.kind]}
+}
+
+// writeESMapping writes the Elasticsearch index mapping of the documents of
+// esBulkExporter, for the computed columns and fields of types.
+func writeESMapping(w io.Writer, computed []string, types map[string]*fieldType) error {
+	props := make(map[string]any, 1+len(computed)+len(types))
+	for name, ft := range types {
+		props[name] = ft.esMapping()
+	}
+	// the range and computed columns take the place of record fields.
+	props["range"] = map[string]any{"type": "ip_range"}
+	for _, col := range computed {
+		props[col] = map[string]any{"type": esComputedTypes[col]}
+	}
+
+	mapping := map[string]any{"mappings": map[string]any{"properties": props}}
+	encoded, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode mapping: %w", err)
+	}
+	if _, err := w.Write(append(encoded, '\n')); err != nil {
+		return ioError(fmt.Errorf("failed to write mapping: %w", err))
+	}
+	return nil
+}
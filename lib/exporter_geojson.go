@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// geoCoordCandidates are the fields coordinates are looked for in, in
+// order, unless chosen: ipinfo's "lat,lng" loc text, and common latitude and
+// longitude field pairs.
+var geoCoordCandidates = [][]string{
+	{"loc"},
+	{"latitude", "longitude"},
+	{"lat", "lng"},
+	{"lat", "lon"},
+	{"location.latitude", "location.longitude"},
+}
+
+// geoCoords decodes the coordinates of records, caching them by their
+// offset.
+type geoCoords struct {
+	// candidates are the fields coordinates are decoded from, each either a
+	// single field of "lat,lon" text, or a latitude and a longitude field.
+	// The first which has valid coordinates is used.
+	candidates [][]exportField
+
+	points *lruCache[*geoPoint]
+}
+
+// geoPoint is a position, in GeoJSON coordinate order.
+type geoPoint [2]float64
+
+// newGeoCoords returns the decoder of the coordinates in the fields of
+// specs, as in ExportOptions.Coords, or of geoCoordCandidates if it's empty.
+func newGeoCoords(specs []string, cacheSize int) (*geoCoords, error) {
+	candidates := [][]string{specs}
+	if len(specs) == 0 {
+		candidates = geoCoordCandidates
+	}
+	c := &geoCoords{points: newLRUCache[*geoPoint](cacheSize)}
+	for _, candidate := range candidates {
+		fields, err := parseExportFields(candidate)
+		if err != nil {
+			return nil, err
+		}
+		c.candidates = append(c.candidates, fields)
+	}
+	return c, nil
+}
+
+// decode returns the coordinates of the record of result, or nil if it has
+// none.
+func (c *geoCoords) decode(result maxminddb.Result) (*geoPoint, error) {
+	offset := result.Offset()
+	if pt, ok := c.points.get(offset); ok {
+		return pt, nil
+	}
+
+	var pt *geoPoint
+	for _, fields := range c.candidates {
+		record, err := decodeFields(result, fields)
+		if err != nil {
+			return nil, err
+		}
+		var lat, lon whereNum
+		var latOK, lonOK bool
+		if len(fields) == 1 {
+			loc, _ := record[fields[0].name].(string)
+			latStr, lonStr, _ := strings.Cut(loc, ",")
+			lat, latOK = whereNumber(strings.TrimSpace(latStr))
+			lon, lonOK = whereNumber(strings.TrimSpace(lonStr))
+		} else {
+			lat, latOK = whereNumber(record[fields[0].name])
+			lon, lonOK = whereNumber(record[fields[1].name])
+		}
+		if !latOK || !lonOK {
+			continue
+		}
+		if lat, lon := lat.float(), lon.float(); lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180 {
+			pt = &geoPoint{lon, lat}
+			break
+		}
+	}
+	c.points.add(offset, pt)
+	return pt, nil
+}
+
+// geoJSON returns the GeoJSON Point geometry of p.
+func (p geoPoint) geoJSON() string {
+	return `{"type":"Point","coordinates":[` +
+		strconv.FormatFloat(p[0], 'f', -1, 64) + "," +
+		strconv.FormatFloat(p[1], 'f', -1, 64) + "]}"
+}
+
+// geoLocation is the networks found at a location, for features aggregated
+// per location.
+type geoLocation struct {
+	point    geoPoint
+	networks []string
+}
+
+// geoJSONExporter exports records with coordinates as GeoJSON Point
+// features, as a FeatureCollection or, for streaming, a GeoJSON text
+// sequence (RFC 8142). Records without coordinates are left out.
+//
+// The properties of a feature are the range, computed columns and fields of
+// its record, as for JSON exports. Aggregated per location, there's a
+// feature per unique location instead, with the networks found at it and
+// their count, which are held in memory until the end.
+type geoJSONExporter struct {
+	bw          *bufio.Writer
+	coords      *geoCoords
+	props       *jsonExporter
+	seq         bool
+	perLocation bool
+
+	written int
+	flushed bool
+
+	// locs are the locations found so far, in order, when aggregating per
+	// location, and locIdx their indexes by point.
+	locs   []*geoLocation
+	locIdx map[geoPoint]int
+}
+
+// newGeoJSONExporter returns the exporter of features at the coordinates in
+// the fields of coordSpecs, as in ExportOptions.Coords.
+func newGeoJSONExporter(
+	w io.Writer,
+	coordSpecs []string,
+	fields []exportField,
+	layout rangeLayout,
+	seq bool,
+	perLocation bool,
+	cacheSize int,
+) (*geoJSONExporter, error) {
+	if len(coordSpecs) > 2 {
+		return nil, usageError(errors.New("coordinates must be a single field, or a latitude and a longitude field"))
+	}
+	coords, err := newGeoCoords(coordSpecs, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	if perLocation && (len(fields) > 0 || len(layout.computed) > 0) {
+		return nil, usageError(errors.New(
+			"fields and computed columns don't apply per location; its properties are its networks",
+		))
+	}
+
+	return &geoJSONExporter{
+		bw:          bufio.NewWriter(w),
+		coords:      coords,
+		props:       newJSONExporter(io.Discard, fields, layout, coords.points.size),
+		seq:         seq,
+		perLocation: perLocation,
+		locIdx:      make(map[geoPoint]int),
+	}, nil
+}
+
+// writeFeature writes the feature at pt with the encoded properties.
+func (e *geoJSONExporter) writeFeature(pt geoPoint, props []byte) error {
+	switch {
+	case e.seq:
+		e.bw.WriteByte(0x1e)
+	case e.written == 0:
+		e.bw.WriteString(`{"type":"FeatureCollection","features":[` + "\n")
+	default:
+		e.bw.WriteString(",\n")
+	}
+	e.written += 1
+
+	e.bw.WriteString(`{"type":"Feature","geometry":` + pt.geoJSON() + `,"properties":`)
+	e.bw.Write(props)
+	end := "}"
+	if e.seq {
+		end += "\n"
+	}
+	if _, err := e.bw.WriteString(end); err != nil {
+		return ioError(fmt.Errorf("failed to write feature: %w", err))
+	}
+	return nil
+}
+
+func (e *geoJSONExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	pt, err := e.coords.decode(result)
+	if err != nil || pt == nil {
+		return err
+	}
+
+	if e.perLocation {
+		network := span.prefix.String()
+		if !span.prefix.IsValid() {
+			network = span.start.String() + "-" + span.end.String()
+		}
+		i, ok := e.locIdx[*pt]
+		if !ok {
+			i = len(e.locs)
+			e.locIdx[*pt] = i
+			e.locs = append(e.locs, &geoLocation{point: *pt})
+		}
+		e.locs[i].networks = append(e.locs[i].networks, network)
+		return nil
+	}
+
+	props, err := e.props.encodeLine(span, result)
+	if err != nil {
+		return err
+	}
+	return e.writeFeature(*pt, props)
+}
+
+func (e *geoJSONExporter) Flush() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+
+	for _, loc := range e.locs {
+		props, err := json.Marshal(map[string]any{
+			"networks":      loc.networks,
+			"network_count": len(loc.networks),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode feature: %w", err)
+		}
+		if err := e.writeFeature(loc.point, props); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case e.seq:
+	case e.written == 0:
+		e.bw.WriteString(`{"type":"FeatureCollection","features":[]}` + "\n")
+	default:
+		e.bw.WriteString("\n]}\n")
+	}
+	return e.bw.Flush()
+}
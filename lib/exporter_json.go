@@ -6,48 +6,164 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/oschwald/maxminddb-golang/v2"
 )
 
-const rangePlaceholder = "__RANGE__"
-
 // jsonExporter exports records in JSON Lines format.
+//
+// If fields are set, each object has the range followed by just those
+// fields, in order; otherwise it has all fields, with keys sorted.
 type jsonExporter struct {
-	bw    *bufio.Writer
-	cache map[uintptr][]byte
+	bw     *bufio.Writer
+	cache  *lruCache[[]byte]
+	fields []exportField
+	layout rangeLayout
+
+	// placeholders stand in for the JSON values of the span keys in cached
+	// records.
+	placeholders []string
+
+	// spanVal, if set, encodes the values of the span keys in place of
+	// their layout values, for formats with their own encoding of spans.
+	spanVal func(span exportSpan) []byte
 }
 
-func newJSONExporter(w io.Writer) *jsonExporter {
+func newJSONExporter(
+	w io.Writer,
+	fields []exportField,
+	layout rangeLayout,
+	cacheSize int,
+) *jsonExporter {
+	keys := layout.keys()
+	placeholders := make([]string, len(keys))
+	for i, k := range keys {
+		placeholders[i] = `"__` + strings.ToUpper(k) + `__"`
+	}
 	return &jsonExporter{
-		bw:    bufio.NewWriter(w),
-		cache: make(map[uintptr][]byte),
+		bw:           bufio.NewWriter(w),
+		cache:        newLRUCache[[]byte](cacheSize),
+		fields:       fields,
+		layout:       layout,
+		placeholders: placeholders,
+	}
+}
+
+func (e *jsonExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	line, err := e.encodeLine(span, result)
+	if err != nil {
+		return err
 	}
+	e.bw.Write(line)
+	e.bw.WriteByte('\n')
+	return nil
 }
 
-func (e *jsonExporter) WriteRecord(result maxminddb.Result) error {
+// encodeLine returns the JSON object of span along with the record of
+// result.
+func (e *jsonExporter) encodeLine(span exportSpan, result maxminddb.Result) ([]byte, error) {
 	offset := result.Offset()
-	prefix := result.Prefix()
 
-	cached, ok := e.cache[offset]
+	cached, ok := e.cache.get(offset)
 	if !ok {
-		record := make(map[string]any)
-		if err := result.Decode(&record); err != nil {
-			return fmt.Errorf("failed to decode record: %w", err)
+		var encoded []byte
+		var err error
+		if e.fields != nil {
+			encoded, err = e.encodeFields(result)
+		} else {
+			encoded, err = e.encodeAll(result)
 		}
-		record["range"] = rangePlaceholder
-
-		encoded, err := json.Marshal(record)
 		if err != nil {
-			return fmt.Errorf("failed to encode record: %w", err)
+			return nil, err
 		}
 		cached = encoded
-		e.cache[offset] = cached
+		e.cache.add(offset, cached)
 	}
 
-	line := bytes.Replace(cached, []byte(rangePlaceholder), []byte(prefix.String()), 1)
-	e.bw.Write(line)
-	e.bw.WriteByte('\n')
+	line := cached
+	for i, val := range e.layout.vals(span, result) {
+		var encoded []byte
+		if e.spanVal != nil && i < e.layout.spanLen() {
+			encoded = e.spanVal(span)
+		} else if !e.layout.numeric(i) {
+			encoded, _ = json.Marshal(val)
+		} else if val == "" {
+			encoded = []byte("null")
+		} else {
+			encoded = []byte(val)
+		}
+		line = bytes.Replace(line, []byte(e.placeholders[i]), encoded, 1)
+	}
+	return line, nil
+}
+
+func (e *jsonExporter) encodeAll(result maxminddb.Result) ([]byte, error) {
+	record := make(map[string]any)
+	if err := result.Decode(&record); err != nil {
+		return nil, invalidDBError(fmt.Errorf("failed to decode record: %w", err))
+	}
+	for i, k := range e.layout.keys() {
+		record[k] = json.RawMessage(e.placeholders[i])
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+	return encoded, nil
+}
+
+// encodeFields encodes the selected fields in order, which a map can't keep.
+func (e *jsonExporter) encodeFields(result maxminddb.Result) ([]byte, error) {
+	record, err := decodeFields(result, e.fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range e.layout.keys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"` + k + `":` + e.placeholders[i])
+	}
+	for _, field := range e.fields {
+		v, ok := record[field.name]
+		if !ok {
+			continue
+		}
+		key, _ := json.Marshal(field.name)
+		val, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode record: %w", err)
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (e *jsonExporter) formatRows(buf *bytes.Buffer, rows []exportRow) error {
+	for _, row := range rows {
+		line, err := e.encodeLine(row.span, row.result)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return nil
+}
+
+func (e *jsonExporter) writeFormatted(formatted []byte) error {
+	if _, err := e.bw.Write(formatted); err != nil {
+		return ioError(fmt.Errorf("failed to write lines: %w", err))
+	}
 	return nil
 }
 
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// normalizedExporter exports networks and their records separately: each
+// record is written once, the first time a network refers to it, and the
+// networks are written with just the ID of their record.
+type normalizedExporter struct {
+	networks exporter
+	records  exporter
+
+	// seen are the offsets of the records written so far.
+	seen map[uintptr]bool
+}
+
+func newNormalizedExporter(networks exporter, records exporter) *normalizedExporter {
+	return &normalizedExporter{
+		networks: networks,
+		records:  records,
+		seen:     make(map[uintptr]bool),
+	}
+}
+
+func (e *normalizedExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	if offset := result.Offset(); result.Found() && !e.seen[offset] {
+		e.seen[offset] = true
+		if err := e.records.WriteRecord(span, result); err != nil {
+			return err
+		}
+	}
+	return e.networks.WriteRecord(span, result)
+}
+
+func (e *normalizedExporter) Flush() error {
+	if err := e.records.Flush(); err != nil {
+		return err
+	}
+	return e.networks.Flush()
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// parallelBatchRows is the number of rows formatted at once by a worker of
+// parallelExporter.
+const parallelBatchRows = 256
+
+// exportRow is a span to export along with its record.
+type exportRow struct {
+	span   exportSpan
+	result maxminddb.Result
+}
+
+// rowFormatter is implemented by exporters whose rows can be formatted
+// independently of each other, and so concurrently.
+type rowFormatter interface {
+	exporter
+
+	// formatRows appends the formatted rows to buf. It's called
+	// concurrently.
+	formatRows(buf *bytes.Buffer, rows []exportRow) error
+
+	// writeFormatted writes rows formatted by formatRows, in order.
+	writeFormatted(formatted []byte) error
+}
+
+// parallelBatch is a batch of rows formatted by a worker.
+type parallelBatch struct {
+	rows []exportRow
+	buf  bytes.Buffer
+	err  error
+
+	// done is closed once the rows are formatted.
+	done chan struct{}
+}
+
+// parallelExporter decodes and formats rows on worker goroutines, in
+// batches, while a writer goroutine writes them out in order. Only a few
+// batches per worker are in flight at once.
+//
+// A write error is returned by the next WriteRecord or Flush.
+type parallelExporter struct {
+	fmtr  rowFormatter
+	batch *parallelBatch
+
+	// work sends batches to the workers, and order sends them to the
+	// writer in the order they're to be written.
+	work  chan *parallelBatch
+	order chan *parallelBatch
+
+	workers    sync.WaitGroup
+	writerDone chan struct{}
+
+	mu      sync.Mutex
+	err     error
+	flushed bool
+}
+
+func newParallelExporter(fmtr rowFormatter, workers int) *parallelExporter {
+	e := &parallelExporter{
+		fmtr:       fmtr,
+		work:       make(chan *parallelBatch, workers),
+		order:      make(chan *parallelBatch, 2*workers),
+		writerDone: make(chan struct{}),
+	}
+	for range workers {
+		e.workers.Add(1)
+		go e.format()
+	}
+	go e.write()
+	return e
+}
+
+// format formats the batches sent to the workers.
+func (e *parallelExporter) format() {
+	defer e.workers.Done()
+	for b := range e.work {
+		b.err = e.fmtr.formatRows(&b.buf, b.rows)
+		close(b.done)
+	}
+}
+
+// write writes the formatted batches in order. After an error, the rest are
+// only drained.
+func (e *parallelExporter) write() {
+	defer close(e.writerDone)
+	for b := range e.order {
+		<-b.done
+		if e.firstErr() != nil {
+			continue
+		}
+		err := b.err
+		if err == nil {
+			err = e.fmtr.writeFormatted(b.buf.Bytes())
+		}
+		if err != nil {
+			e.mu.Lock()
+			e.err = err
+			e.mu.Unlock()
+		}
+	}
+}
+
+// firstErr returns the first error formatting or writing rows, if any.
+func (e *parallelExporter) firstErr() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// dispatch sends the current batch to be formatted and written.
+func (e *parallelExporter) dispatch() {
+	b := e.batch
+	e.batch = nil
+	e.order <- b
+	e.work <- b
+}
+
+func (e *parallelExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	if err := e.firstErr(); err != nil {
+		return err
+	}
+	if e.batch == nil {
+		e.batch = &parallelBatch{
+			rows: make([]exportRow, 0, parallelBatchRows),
+			done: make(chan struct{}),
+		}
+	}
+	e.batch.rows = append(e.batch.rows, exportRow{span: span, result: result})
+	if len(e.batch.rows) == parallelBatchRows {
+		e.dispatch()
+	}
+	return nil
+}
+
+// Flush waits for the rows written so far to be formatted and written, and
+// flushes them; no records can be written after it.
+func (e *parallelExporter) Flush() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	if e.batch != nil {
+		e.dispatch()
+	}
+	close(e.work)
+	close(e.order)
+	e.workers.Wait()
+	<-e.writerDone
+
+	if err := e.firstErr(); err != nil {
+		return err
+	}
+	return e.fmtr.Flush()
+}
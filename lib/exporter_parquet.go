@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"strconv"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	// parquetRowGroupRows caps the rows per row group, which are buffered
+	// in memory until written out.
+	parquetRowGroupRows = 128 * 1024
+
+	// parquetBatchRows is the number of rows handed to the writer at once.
+	parquetBatchRows = 1024
+)
+
+// parquetNode returns the parquet type of a column of the field.
+func (c *fieldType) parquetNode() parquet.Node {
+	switch c.kind {
+	case "string", "mixed":
+		return parquet.String()
+	case "bytes":
+		return parquet.Leaf(parquet.ByteArrayType)
+	case "float32":
+		return parquet.Leaf(parquet.FloatType)
+	case "float64":
+		return parquet.Leaf(parquet.DoubleType)
+	case "bool":
+		return parquet.Leaf(parquet.BooleanType)
+	case "int32":
+		return parquet.Int(32)
+	case "uint16":
+		return parquet.Uint(16)
+	case "uint32":
+		return parquet.Uint(32)
+	case "uint64":
+		return parquet.Uint(64)
+	case "uint128":
+		// big-endian, which is what import recognizes as a uint128.
+		return parquet.Leaf(parquet.FixedLenByteArrayType(16))
+	case "map":
+		return parquetGroup(c.fields)
+	case "slice":
+		if c.elem == nil {
+			return parquet.List(parquet.String())
+		}
+		return parquet.List(c.elem.parquetNode())
+	}
+	panic("unknown parquet column kind " + c.kind)
+}
+
+// parquetGroup returns a group of optional fields of the types of cols.
+func parquetGroup(cols map[string]*fieldType) parquet.Group {
+	group := make(parquet.Group, len(cols))
+	for name, col := range cols {
+		group[name] = parquet.Optional(col.parquetNode())
+	}
+	return group
+}
+
+// parquetValue converts v to the Go value written to a column of the field.
+func (c *fieldType) parquetValue(v mmdbtype.DataType) any {
+	switch c.kind {
+	case "mixed":
+		return typedToStr(v)
+	case "uint32":
+		switch v := v.(type) {
+		case mmdbtype.Uint16:
+			return uint32(v)
+		case mmdbtype.Uint32:
+			return uint32(v)
+		}
+	case "uint64":
+		switch v := v.(type) {
+		case mmdbtype.Uint16:
+			return uint64(v)
+		case mmdbtype.Uint32:
+			return uint64(v)
+		case mmdbtype.Uint64:
+			return uint64(v)
+		}
+	case "float64":
+		switch v := v.(type) {
+		case mmdbtype.Float32:
+			return float64(v)
+		case mmdbtype.Float64:
+			return float64(v)
+		}
+	case "uint128":
+		var b [16]byte
+		(*big.Int)(v.(*mmdbtype.Uint128)).FillBytes(b[:])
+		return b
+	case "map":
+		m := make(map[string]any, len(c.fields))
+		for k, fv := range v.(mmdbtype.Map) {
+			m[string(k)] = c.fields[string(k)].parquetValue(fv)
+		}
+		return m
+	case "slice":
+		s := v.(mmdbtype.Slice)
+		elems := make([]any, len(s))
+		for i, ev := range s {
+			elems[i] = c.elem.parquetValue(ev)
+		}
+		return elems
+	}
+
+	switch v := v.(type) {
+	case mmdbtype.String:
+		return string(v)
+	case mmdbtype.Bytes:
+		return []byte(v)
+	case mmdbtype.Float32:
+		return float32(v)
+	case mmdbtype.Bool:
+		return bool(v)
+	case mmdbtype.Int32:
+		return int32(v)
+	case mmdbtype.Uint16:
+		return uint16(v)
+	}
+	panic(fmt.Sprintf("can't write %T to a %v column", v, c.kind))
+}
+
+// parquetExporter exports records in Parquet format.
+//
+// The schema is fixed up front by cols, with a column per record field,
+// typed after the MMDB types of its values. Nested maps become groups and
+// arrays become lists. Fields missing from a record are null.
+type parquetExporter struct {
+	wr     *parquet.GenericWriter[map[string]any]
+	cache  *typedRecordCache
+	cols   map[string]*fieldType
+	layout rangeLayout
+	keys   []string
+
+	// vals caches the column values of records by their offset.
+	vals *lruCache[map[string]any]
+
+	batch  []map[string]any
+	closed bool
+}
+
+func newParquetExporter(
+	w io.Writer,
+	cols map[string]*fieldType,
+	cache *typedRecordCache,
+	layout rangeLayout,
+) *parquetExporter {
+	keys := layout.keys()
+	cols = maps.Clone(cols)
+	group := make(parquet.Group, len(cols)+len(keys))
+	for i, k := range keys {
+		// the range and computed columns take the place of record fields.
+		delete(cols, k)
+		if layout.numeric(i) {
+			group[k] = parquet.Optional(parquet.Int(64))
+		} else {
+			group[k] = parquet.String()
+		}
+	}
+	maps.Copy(group, parquetGroup(cols))
+
+	schema := parquet.NewSchema("mmdb", group)
+	return &parquetExporter{
+		wr: parquet.NewGenericWriter[map[string]any](
+			w,
+			schema,
+			parquet.Compression(&parquet.Zstd),
+			parquet.MaxRowsPerRowGroup(parquetRowGroupRows),
+		),
+		cache:  cache,
+		cols:   cols,
+		layout: layout,
+		keys:   keys,
+		vals:   newLRUCache[map[string]any](cache.recs.size),
+		batch:  make([]map[string]any, 0, parquetBatchRows),
+	}
+}
+
+func (e *parquetExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	offset := result.Offset()
+	vals, ok := e.vals.get(offset)
+	if !ok {
+		record, _, err := e.cache.decode(result)
+		if err != nil {
+			return err
+		}
+		vals = make(map[string]any, len(record))
+		for k, v := range record {
+			if col, ok := e.cols[string(k)]; ok {
+				vals[string(k)] = col.parquetValue(v)
+			}
+		}
+		e.vals.add(offset, vals)
+	}
+
+	row := maps.Clone(vals)
+	for i, v := range e.layout.vals(span, result) {
+		k := e.keys[i]
+		if !e.layout.numeric(i) {
+			row[k] = v
+		} else if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			row[k] = n
+		} else {
+			row[k] = nil
+		}
+	}
+
+	e.batch = append(e.batch, row)
+	if len(e.batch) == cap(e.batch) {
+		return e.writeBatch()
+	}
+	return nil
+}
+
+// writeBatch hands the batched rows to the writer.
+func (e *parquetExporter) writeBatch() error {
+	if _, err := e.wr.Write(e.batch); err != nil {
+		return ioError(fmt.Errorf("failed to write rows: %w", err))
+	}
+	e.batch = e.batch[:0]
+	return nil
+}
+
+// Flush writes out the remaining rows and the file footer; no records can
+// be written after it.
+func (e *parquetExporter) Flush() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if err := e.writeBatch(); err != nil {
+		return err
+	}
+	return e.wr.Close()
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// pgCopyEscaper escapes values in the PostgreSQL COPY text format.
+var pgCopyEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"\t", `\t`,
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// pgCopyExporter exports records as a PostgreSQL COPY script: a CREATE TABLE
+// statement and a COPY ... FROM stdin command, followed by the rows in the
+// COPY text format. psql runs it as is.
+//
+// If the header is left out, only the rows are written, to be loaded with
+// COPY or \copy into an existing table.
+//
+// The columns are fixed up front by the table, the same as sqlExporter's.
+type pgCopyExporter struct {
+	bw    *bufio.Writer
+	table *sqlTable
+	cache *typedRecordCache
+	noHdr bool
+
+	hdrWritten bool
+	flushed    bool
+
+	// vals caches the rendered field values of records by their offset.
+	vals *lruCache[[]string]
+}
+
+func newPGCopyExporter(
+	w io.Writer,
+	noHdr bool,
+	table *sqlTable,
+	cache *typedRecordCache,
+) *pgCopyExporter {
+	return &pgCopyExporter{
+		bw:    bufio.NewWriter(w),
+		table: table,
+		cache: cache,
+		noHdr: noHdr,
+		vals:  newLRUCache[[]string](cache.recs.size),
+	}
+}
+
+// pgCopyValue returns v in the COPY text format for a column of kind.
+func pgCopyValue(kind string, v mmdbtype.DataType) string {
+	if v == nil {
+		return `\N`
+	}
+	switch kind {
+	case "mixed", "map", "slice":
+		return pgCopyEscaper.Replace(typedToStr(v))
+	}
+
+	switch v := v.(type) {
+	case mmdbtype.String:
+		return pgCopyEscaper.Replace(string(v))
+	case mmdbtype.Bytes:
+		return `\\x` + hex.EncodeToString(v)
+	case mmdbtype.Bool:
+		if v {
+			return "t"
+		}
+		return "f"
+	}
+	if n, ok := sqlNumber(v); ok {
+		return n
+	}
+	return pgNonFinite(v)
+}
+
+// writeHdr writes the CREATE TABLE statement and the COPY command.
+func (e *pgCopyExporter) writeHdr() error {
+	e.hdrWritten = true
+	if e.noHdr {
+		return nil
+	}
+	hdr := e.table.createStmt() + "COPY " + e.table.quoteIdent(e.table.name) +
+		" " + e.table.colList() + " FROM stdin;\n"
+	if _, err := e.bw.WriteString(hdr); err != nil {
+		return ioError(fmt.Errorf("failed to write header: %w", err))
+	}
+	return nil
+}
+
+func (e *pgCopyExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	if !e.hdrWritten {
+		if err := e.writeHdr(); err != nil {
+			return err
+		}
+	}
+
+	offset := result.Offset()
+	vals, ok := e.vals.get(offset)
+	if !ok {
+		record, _, err := e.cache.decode(result)
+		if err != nil {
+			return err
+		}
+		fieldCols := e.table.cols[len(e.table.cols)-len(e.table.fields):]
+		vals = make([]string, len(fieldCols))
+		for i, col := range fieldCols {
+			vals[i] = pgCopyValue(e.table.fields[i].kind, record[mmdbtype.String(col)])
+		}
+		e.vals.add(offset, vals)
+	}
+
+	line := make([]string, 0, len(e.table.cols))
+	for _, v := range e.table.layout.vals(span, result) {
+		if v == "" {
+			v = `\N`
+		}
+		line = append(line, v)
+	}
+	line = append(line, vals...)
+	if _, err := e.bw.WriteString(strings.Join(line, "\t") + "\n"); err != nil {
+		return ioError(fmt.Errorf("failed to write row: %w", err))
+	}
+	return nil
+}
+
+// Flush ends the COPY data; no records can be written after it.
+func (e *pgCopyExporter) Flush() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	if !e.hdrWritten {
+		if err := e.writeHdr(); err != nil {
+			return err
+		}
+	}
+	if !e.noHdr {
+		e.bw.WriteString("\\.\n")
+	}
+	return e.bw.Flush()
+}
+
+// Abort writes out the rows so far without ending the COPY data, so that a
+// partial export fails to load rather than loading some of the networks.
+func (e *pgCopyExporter) Abort() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	return e.bw.Flush()
+}
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// defaultMaxOpenSplits is the number of outputs of a split export kept open
+// by default.
+const defaultMaxOpenSplits = 128
+
+// splitExporter routes networks to an exporter per value of a field, each
+// writing to its own output. Networks without a value are left out.
+//
+// At most maxOpen outputs are open at once: once full, the least recently
+// written one is flushed and closed, and reopened to append to when written
+// again, without a header.
+type splitExporter struct {
+	values  *configValues
+	open    func(value string, appending bool) (io.WriteCloser, error)
+	newExp  func(w io.Writer, noHdr bool) (exporter, error)
+	noHdr   bool
+	maxOpen int
+
+	// outputs are the outputs of all values found so far, and recent the
+	// open ones, most recently written first.
+	outputs map[string]*splitOutput
+	recent  *list.List
+}
+
+// splitOutput is the output of a value of a split export.
+type splitOutput struct {
+	value string
+
+	// w and exp are nil while the output is closed.
+	w   io.WriteCloser
+	exp exporter
+
+	// opened is whether the output was opened before.
+	opened bool
+	elem   *list.Element
+}
+
+func newSplitExporter(
+	values *configValues,
+	open func(value string, appending bool) (io.WriteCloser, error),
+	newExp func(w io.Writer, noHdr bool) (exporter, error),
+	noHdr bool,
+	maxOpen int,
+) *splitExporter {
+	return &splitExporter{
+		values:  values,
+		open:    open,
+		newExp:  newExp,
+		noHdr:   noHdr,
+		maxOpen: maxOpen,
+		outputs: make(map[string]*splitOutput),
+		recent:  list.New(),
+	}
+}
+
+func (e *splitExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	val, err := e.values.decode(result)
+	if err != nil {
+		return err
+	}
+	if val.str == "" {
+		return nil
+	}
+
+	out, ok := e.outputs[val.str]
+	if !ok {
+		out = &splitOutput{value: val.str}
+		e.outputs[val.str] = out
+	}
+	if out.exp != nil {
+		e.recent.MoveToFront(out.elem)
+		return out.exp.WriteRecord(span, result)
+	}
+
+	if e.recent.Len() >= e.maxOpen {
+		if err := e.close(e.recent.Back().Value.(*splitOutput)); err != nil {
+			return err
+		}
+	}
+	w, err := e.open(out.value, out.opened)
+	if err != nil {
+		return err
+	}
+	// reopened outputs already have their header.
+	exp, err := e.newExp(w, e.noHdr || out.opened)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	out.w, out.exp, out.opened = w, exp, true
+	out.elem = e.recent.PushFront(out)
+	return out.exp.WriteRecord(span, result)
+}
+
+// close flushes and closes an open output.
+func (e *splitExporter) close(out *splitOutput) error {
+	e.recent.Remove(out.elem)
+	err := out.exp.Flush()
+	if closeErr := out.w.Close(); err == nil && closeErr != nil {
+		err = ioError(fmt.Errorf("failed to close output of %q: %w", out.value, closeErr))
+	}
+	out.w, out.exp, out.elem = nil, nil, nil
+	return err
+}
+
+// Flush flushes and closes the open outputs.
+func (e *splitExporter) Flush() error {
+	var err error
+	for e.recent.Len() > 0 {
+		if closeErr := e.close(e.recent.Front().Value.(*splitOutput)); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,471 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// sqlBatchRows is the number of rows per INSERT statement.
+const sqlBatchRows = 500
+
+// sqlDialects are the SQL dialects which can be exported to.
+var sqlDialects = []string{"postgres", "sqlite", "mysql"}
+
+// sqlTypes are the column types of each dialect, and of ClickHouse, by kind: the kinds of
+// fieldType, and those of the range and computed columns, which are "cidr"
+// for networks, "inet" for IPs, "decimal" for integers which may not fit 64
+// bits and "int" for those that do.
+var sqlTypes = map[string]map[string]string{
+	"postgres": {
+		"cidr":    "cidr",
+		"inet":    "inet",
+		"decimal": "numeric(39)",
+		"int":     "bigint",
+		"string":  "text",
+		"mixed":   "text",
+		"bytes":   "bytea",
+		"float32": "real",
+		"float64": "double precision",
+		"bool":    "boolean",
+		"int32":   "integer",
+		"uint16":  "integer",
+		"uint32":  "bigint",
+		"uint64":  "numeric(20)",
+		"uint128": "numeric(39)",
+		"map":     "jsonb",
+		"slice":   "jsonb",
+	},
+	"sqlite": {
+		"cidr":    "TEXT",
+		"inet":    "TEXT",
+		"decimal": "TEXT",
+		"int":     "INTEGER",
+		"string":  "TEXT",
+		"mixed":   "TEXT",
+		"bytes":   "BLOB",
+		"float32": "REAL",
+		"float64": "REAL",
+		"bool":    "INTEGER",
+		"int32":   "INTEGER",
+		"uint16":  "INTEGER",
+		"uint32":  "INTEGER",
+		"uint64":  "INTEGER",
+		"uint128": "TEXT",
+		"map":     "TEXT",
+		"slice":   "TEXT",
+	},
+	"mysql": {
+		"cidr":    "VARCHAR(43)",
+		"inet":    "VARCHAR(39)",
+		"decimal": "DECIMAL(39,0)",
+		"int":     "BIGINT",
+		"string":  "TEXT",
+		"mixed":   "TEXT",
+		"bytes":   "BLOB",
+		"float32": "FLOAT",
+		"float64": "DOUBLE",
+		"bool":    "BOOLEAN",
+		"int32":   "INT",
+		"uint16":  "SMALLINT UNSIGNED",
+		"uint32":  "INT UNSIGNED",
+		"uint64":  "BIGINT UNSIGNED",
+		"uint128": "DECIMAL(39,0)",
+		"map":     "JSON",
+		"slice":   "JSON",
+	},
+	"clickhouse": {
+		"cidr":    "String",
+		"inet":    "String",
+		"decimal": "String",
+		"int":     "UInt64",
+		"string":  "String",
+		"mixed":   "String",
+		"bytes":   "String",
+		"float32": "Float32",
+		"float64": "Float64",
+		"bool":    "Bool",
+		"int32":   "Int32",
+		"uint16":  "UInt16",
+		"uint32":  "UInt32",
+		"uint64":  "UInt64",
+		"uint128": "UInt128",
+		"map":     "String",
+		"slice":   "String",
+	},
+}
+
+// sqlComputedKinds are the kinds of computedCols.
+var sqlComputedKinds = map[string]string{
+	"start_ip":         "inet",
+	"end_ip":           "inet",
+	"prefix_len":       "int",
+	"num_addresses":    "decimal",
+	"ip_version":       "int",
+	"start_ip_decimal": "decimal",
+	"end_ip_decimal":   "decimal",
+	"offset":           "int",
+}
+
+// sqlTable is the table records are exported into: the range and computed
+// columns of a layout, followed by a column per record field.
+type sqlTable struct {
+	name    string
+	dialect string
+	layout  rangeLayout
+
+	// cols are the names of the columns, and kinds their kinds.
+	cols  []string
+	kinds []string
+
+	// fields are the types of the field columns, in order.
+	fields []*fieldType
+}
+
+// newSQLTable returns the table for layout and the fields named by names,
+// of the given types. The name defaults to "networks" and the dialect, one
+// of sqlDialects or "clickhouse", to "postgres".
+func newSQLTable(
+	name string,
+	dialect string,
+	layout rangeLayout,
+	names []string,
+	types map[string]*fieldType,
+) (*sqlTable, error) {
+	if name == "" {
+		name = "networks"
+	}
+	switch {
+	case dialect == "":
+		dialect = "postgres"
+	case dialect == "clickhouse":
+		// ip_trie dictionaries are keyed by CIDRs.
+		if layout.ranges {
+			return nil, usageError(errors.New("ranges don't apply to the clickhouse format; ip_trie keys are prefixes"))
+		}
+	case !slices.Contains(sqlDialects, dialect):
+		return nil, usageError(fmt.Errorf("dialect must be one of %v", sqlDialects))
+	}
+
+	t := &sqlTable{name: name, dialect: dialect, layout: layout}
+	for i, k := range layout.keys() {
+		kind := "cidr"
+		switch {
+		case i >= layout.spanLen():
+			kind = sqlComputedKinds[k]
+		case layout.ranges && layout.decimal:
+			kind = "decimal"
+		case layout.ranges:
+			kind = "inet"
+		}
+		t.cols = append(t.cols, k)
+		t.kinds = append(t.kinds, kind)
+	}
+	for _, k := range names {
+		ft := types[k]
+		if ft == nil {
+			// a selected field found in no record.
+			ft = &fieldType{kind: "string"}
+		}
+		t.cols = append(t.cols, k)
+		t.kinds = append(t.kinds, ft.kind)
+		t.fields = append(t.fields, ft)
+	}
+	return t, nil
+}
+
+// quoteIdent quotes a table or column name.
+func (t *sqlTable) quoteIdent(name string) string {
+	if t.dialect == "mysql" {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// colList returns the parenthesized list of the column names.
+func (t *sqlTable) colList() string {
+	quoted := make([]string, len(t.cols))
+	for i, col := range t.cols {
+		quoted[i] = t.quoteIdent(col)
+	}
+	return "(" + strings.Join(quoted, ", ") + ")"
+}
+
+// createStmt returns the CREATE TABLE statement for the table.
+func (t *sqlTable) createStmt() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE %s (\n", t.quoteIdent(t.name))
+	for i, col := range t.cols {
+		fmt.Fprintf(&b, "  %s %s", t.quoteIdent(col), sqlTypes[t.dialect][t.kinds[i]])
+		// the span is always set.
+		if i < t.layout.spanLen() {
+			b.WriteString(" NOT NULL")
+		}
+		if i < len(t.cols)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(");\n")
+	return b.String()
+}
+
+// sqlFloat formats a finite float, reporting false for NaN and infinities.
+func sqlFloat(f float64, bitSize int) (string, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'g', -1, bitSize), true
+}
+
+// pgNonFinite returns the PostgreSQL spelling of a NaN or infinite float.
+func pgNonFinite(v mmdbtype.DataType) string {
+	var f float64
+	switch v := v.(type) {
+	case mmdbtype.Float32:
+		f = float64(v)
+	case mmdbtype.Float64:
+		f = float64(v)
+	}
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return "NaN"
+}
+
+// sqlNumber formats a numeric value, reporting false if v isn't one, or is a
+// NaN or infinite float.
+func sqlNumber(v mmdbtype.DataType) (string, bool) {
+	switch v := v.(type) {
+	case mmdbtype.Int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case mmdbtype.Uint16:
+		return strconv.FormatUint(uint64(v), 10), true
+	case mmdbtype.Uint32:
+		return strconv.FormatUint(uint64(v), 10), true
+	case mmdbtype.Uint64:
+		return strconv.FormatUint(uint64(v), 10), true
+	case *mmdbtype.Uint128:
+		return (*big.Int)(v).String(), true
+	case mmdbtype.Float32:
+		return sqlFloat(float64(v), 32)
+	case mmdbtype.Float64:
+		return sqlFloat(float64(v), 64)
+	}
+	return "", false
+}
+
+// sqlExporter exports records as SQL: a CREATE TABLE statement, unless the
+// header is left out, followed by batched INSERT statements in a
+// transaction.
+//
+// The columns are fixed up front by the table, with a column per record
+// field, typed after the MMDB types of its values. Nested maps and arrays
+// are JSON. Fields missing from a record are NULL.
+type sqlExporter struct {
+	bw    *bufio.Writer
+	table *sqlTable
+	cache *typedRecordCache
+	noHdr bool
+
+	hdrWritten bool
+	flushed    bool
+
+	// batched is the number of rows in the current INSERT statement.
+	batched int
+
+	// vals caches the rendered field values of records by their offset.
+	vals *lruCache[[]string]
+}
+
+func newSQLExporter(
+	w io.Writer,
+	noHdr bool,
+	table *sqlTable,
+	cache *typedRecordCache,
+) *sqlExporter {
+	return &sqlExporter{
+		bw:    bufio.NewWriter(w),
+		table: table,
+		cache: cache,
+		noHdr: noHdr,
+		vals:  newLRUCache[[]string](cache.recs.size),
+	}
+}
+
+// literal returns v as an SQL literal for a column of kind.
+func (e *sqlExporter) literal(kind string, v mmdbtype.DataType) string {
+	if v == nil {
+		return "NULL"
+	}
+	dialect := e.table.dialect
+	switch kind {
+	case "mixed", "map", "slice":
+		return e.quote(typedToStr(v))
+	}
+
+	switch v := v.(type) {
+	case mmdbtype.String:
+		return e.quote(string(v))
+	case mmdbtype.Bytes:
+		if dialect == "postgres" {
+			return `'\x` + hex.EncodeToString(v) + "'"
+		}
+		return "X'" + hex.EncodeToString(v) + "'"
+	case mmdbtype.Bool:
+		switch {
+		case dialect == "sqlite" && bool(v):
+			return "1"
+		case dialect == "sqlite":
+			return "0"
+		case bool(v):
+			return "TRUE"
+		default:
+			return "FALSE"
+		}
+	case mmdbtype.Float32, mmdbtype.Float64:
+		if n, ok := sqlNumber(v); ok {
+			return n
+		}
+		if dialect == "postgres" {
+			// postgres is the only one of these with NaN and infinities.
+			return e.quote(pgNonFinite(v))
+		}
+		return "NULL"
+	}
+	n, _ := sqlNumber(v)
+	if _, ok := v.(*mmdbtype.Uint128); ok && dialect == "sqlite" {
+		// sqlite would round numbers beyond 64 bits to floats.
+		return e.quote(n)
+	}
+	return n
+}
+
+// quote returns s as a string literal.
+func (e *sqlExporter) quote(s string) string {
+	if e.table.dialect == "mysql" {
+		// backslashes are escapes in MySQL strings by default.
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// writeHdr writes the CREATE TABLE statement, and starts the transaction.
+func (e *sqlExporter) writeHdr() error {
+	e.hdrWritten = true
+	if !e.noHdr {
+		if _, err := e.bw.WriteString(e.table.createStmt()); err != nil {
+			return ioError(fmt.Errorf("failed to write table: %w", err))
+		}
+	}
+	if _, err := e.bw.WriteString("BEGIN;\n"); err != nil {
+		return ioError(fmt.Errorf("failed to write transaction: %w", err))
+	}
+	return nil
+}
+
+func (e *sqlExporter) WriteRecord(span exportSpan, result maxminddb.Result) error {
+	if !e.hdrWritten {
+		if err := e.writeHdr(); err != nil {
+			return err
+		}
+	}
+
+	offset := result.Offset()
+	vals, ok := e.vals.get(offset)
+	if !ok {
+		record, _, err := e.cache.decode(result)
+		if err != nil {
+			return err
+		}
+		fieldCols := e.table.cols[len(e.table.cols)-len(e.table.fields):]
+		vals = make([]string, len(fieldCols))
+		for i, col := range fieldCols {
+			vals[i] = e.literal(e.table.fields[i].kind, record[mmdbtype.String(col)])
+		}
+		e.vals.add(offset, vals)
+	}
+
+	layoutVals := e.table.layout.vals(span, result)
+	line := make([]string, 0, len(e.table.cols))
+	for i, v := range layoutVals {
+		switch kind := e.table.kinds[i]; {
+		case v == "":
+			line = append(line, "NULL")
+		case kind == "cidr" || kind == "inet" || (kind == "decimal" && e.table.dialect == "sqlite"):
+			line = append(line, e.quote(v))
+		default:
+			line = append(line, v)
+		}
+	}
+	line = append(line, vals...)
+
+	var stmt string
+	if e.batched == 0 {
+		stmt = "INSERT INTO " + e.table.quoteIdent(e.table.name) + " " +
+			e.table.colList() + " VALUES\n"
+	} else {
+		stmt = ",\n"
+	}
+	stmt += "(" + strings.Join(line, ", ") + ")"
+	e.batched += 1
+	if e.batched == sqlBatchRows {
+		stmt += ";\n"
+		e.batched = 0
+	}
+	if _, err := e.bw.WriteString(stmt); err != nil {
+		return ioError(fmt.Errorf("failed to write row: %w", err))
+	}
+	return nil
+}
+
+// Flush ends the current INSERT statement and commits the transaction; no
+// records can be written after it.
+func (e *sqlExporter) Flush() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	if !e.hdrWritten {
+		if err := e.writeHdr(); err != nil {
+			return err
+		}
+	}
+	if e.batched > 0 {
+		e.bw.WriteString(";\n")
+		e.batched = 0
+	}
+	e.bw.WriteString("COMMIT;\n")
+	return e.bw.Flush()
+}
+
+// Abort ends the current INSERT statement and rolls the transaction back, so
+// that a partial export loads nothing.
+func (e *sqlExporter) Abort() error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	if !e.hdrWritten {
+		return e.bw.Flush()
+	}
+	if e.batched > 0 {
+		e.bw.WriteString(";\n")
+		e.batched = 0
+	}
+	e.bw.WriteString("ROLLBACK;\n")
+	return e.bw.Flush()
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// flattenSep separates the path components of flattened keys.
+const flattenSep = "."
+
+// flattenRecord expands nested maps and arrays in record into top-level keys
+// made of their paths joined by ".", e.g. "country.names.en", and converts
+// the values to strings.
+//
+// Array elements are keyed by their index, e.g. "subdivisions.0.iso_code".
+// If arrayDelim isn't empty, arrays which only contain scalars are instead
+// joined by it into a single value.
+//
+// Empty maps and arrays have no values, and so produce no keys.
+func flattenRecord(record map[string]any, arrayDelim string) map[string]string {
+	return mapInterfaceToStr(flattenLeaves(record, arrayDelim))
+}
+
+// flattenLeaves is flattenRecord without converting the values to strings.
+func flattenLeaves(record map[string]any, arrayDelim string) map[string]any {
+	leaves := make(map[string]any)
+	for k, v := range record {
+		flattenValue(k, v, arrayDelim, leaves)
+	}
+	return leaves
+}
+
+func flattenValue(path string, v any, arrayDelim string, leaves map[string]any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, elem := range v {
+			flattenValue(path+flattenSep+k, elem, arrayDelim, leaves)
+		}
+	case []any:
+		if arrayDelim != "" && isScalarSlice(v) {
+			elems := make(map[string]any, len(v))
+			for i, elem := range v {
+				elems[strconv.Itoa(i)] = elem
+			}
+			elemsStr := mapInterfaceToStr(elems)
+			joined := make([]string, len(v))
+			for i := range v {
+				joined[i] = elemsStr[strconv.Itoa(i)]
+			}
+			leaves[path] = strings.Join(joined, arrayDelim)
+			return
+		}
+		for i, elem := range v {
+			flattenValue(path+flattenSep+strconv.Itoa(i), elem, arrayDelim, leaves)
+		}
+	default:
+		leaves[path] = v
+	}
+}
+
+func isScalarSlice(s []any) bool {
+	for _, v := range s {
+		switch v.(type) {
+		case map[string]any, []any:
+			return false
+		}
+	}
+	return true
+}
+
+// unflattenRecord is the reverse of flattenRecord with indexed arrays: keys
+// are split on "." into paths of nested maps, and a map whose keys are all
+// indices becomes an array ordered by them.
+//
+// Fields with nil values are left out, as flattened output has empty cells
+// wherever a record lacks a path which other records have.
+func unflattenRecord(fields []string, vals []mmdbtype.DataType) (mmdbtype.Map, error) {
+	root := make(map[string]any)
+	for i, field := range fields {
+		if vals[i] == nil {
+			continue
+		}
+
+		path := strings.Split(field, flattenSep)
+		node := root
+		for _, k := range path[:len(path)-1] {
+			child, ok := node[k]
+			if !ok {
+				m := make(map[string]any)
+				node[k] = m
+				node = m
+				continue
+			}
+			m, ok := child.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("field %q conflicts with a value at %q", field, k)
+			}
+			node = m
+		}
+
+		last := path[len(path)-1]
+		if _, ok := node[last]; ok {
+			return nil, fmt.Errorf("field %q conflicts with another field", field)
+		}
+		node[last] = vals[i]
+	}
+
+	record, ok := unflattenValue(root).(mmdbtype.Map)
+	if !ok {
+		return nil, errors.New("record can't be an array")
+	}
+	return record, nil
+}
+
+func unflattenValue(v any) mmdbtype.DataType {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return v.(mmdbtype.DataType)
+	}
+
+	// all-index keys make an array; gaps left by empty cells are closed up.
+	indices := make([]int, 0, len(m))
+	for k := range m {
+		idx, err := strconv.Atoi(k)
+		if err != nil || idx < 0 || strconv.Itoa(idx) != k {
+			indices = nil
+			break
+		}
+		indices = append(indices, idx)
+	}
+	if len(indices) > 0 {
+		sort.Ints(indices)
+		s := make(mmdbtype.Slice, len(indices))
+		for i, idx := range indices {
+			s[i] = unflattenValue(m[strconv.Itoa(idx)])
+		}
+		return s
+	}
+
+	out := make(mmdbtype.Map, len(m))
+	for k, elem := range m {
+		out[mmdbtype.String(k)] = unflattenValue(elem)
+	}
+	return out
+}
@@ -0,0 +1,770 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ipinfo/cli/lib/iputil"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/inserter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// ImportOptions are options for Import.
+//
+// Start from ImportOptionsDefaults rather than the zero value.
+type ImportOptions struct {
+	// Format is the input format: "csv", "tsv", "json" or "parquet".
+	//
+	// Parquet columns are read with their types; see importParquet.
+	Format string
+
+	// Fields are the data fields in the input, excluding the network
+	// column(s).
+	Fields []string
+
+	// FieldsFromHdr takes the fields from the header of CSV/TSV input, or
+	// the keys of the first JSON object. It is assumed if neither Fields nor
+	// NoFields are set.
+	FieldsFromHdr bool
+
+	// RangeMultiCol treats the network as two start_ip,end_ip columns.
+	RangeMultiCol bool
+
+	// JoinKeyCol implies RangeMultiCol, with a 3rd join_key column that is
+	// ignored.
+	JoinKeyCol bool
+
+	// NoFields specifies that there are no fields except the network.
+	NoFields bool
+
+	// NoNetwork leaves the network field out of the records. It's implied
+	// for the "parquet" format, whose records are those of the exported
+	// database, unless NoFields is set.
+	NoNetwork bool
+
+	// Unflatten nests CSV/TSV fields with dotted names, e.g.
+	// "country.names.en", into maps, and fields indexed like "a.0" into
+	// arrays. It reverses ExportOptions.Flatten. Empty values are left out.
+	Unflatten bool
+
+	// TypedHeader reads the types of CSV/TSV fields from annotations in the
+	// header, e.g. "asn:uint32", as written by ExportOptions.TypedHeader, in
+	// place of reading all values as strings. As fields missing from a
+	// record are written as empty values, empty values are left out, while
+	// empty strings, written as "", are kept. It implies FieldsFromHdr and
+	// NoNetwork, so that importing an export with a typed header gives the
+	// records of the exported database.
+	TypedHeader bool
+
+	// fieldTypes are the types of Fields read from a typed header; nil for
+	// fields without one.
+	fieldTypes []*fieldType
+
+	// TSVEscape reads \\, \t, \n and \r in TSV fields as a backslash,
+	// tab, newline and carriage return, reversing ExportOptions.TSVEscape.
+	TSVEscape bool
+
+	// Ip is the IP version of the database: 4 or 6.
+	Ip int
+
+	// Size is the record size of the tree: 24, 28 or 32.
+	Size int
+
+	// Merge is the strategy for conflicting entries: "none", "toplevel" or
+	// "recurse".
+	Merge string
+
+	// IgnoreEmptyVals writes empty values for all fields into /0, and
+	// leaves out fields whose value is the empty string.
+	IgnoreEmptyVals bool
+
+	// DisallowReserved disallows reserved networks in the tree.
+	DisallowReserved bool
+
+	// Alias6to4 maps some IPv6 networks into the IPv4 network, e.g.
+	// ::ffff:0:0/96, 2001::/32 & 2002::/16.
+	Alias6to4 bool
+
+	// DisableMetadataPtrs turns off pointers within the metadata, which
+	// some readers fail to handle.
+	DisableMetadataPtrs bool
+
+	// DatabaseType is the database type and English description written
+	// to the metadata.
+	DatabaseType string
+
+	// Log receives warnings about entries that couldn't be inserted. If
+	// nil, warnings are discarded.
+	Log io.Writer
+
+	// Progress receives progress reports. If nil, none are made.
+	Progress io.Writer
+}
+
+// ImportOptionsDefaults are the default options for Import.
+var ImportOptionsDefaults = ImportOptions{
+	Format:              "csv",
+	Ip:                  6,
+	Size:                32,
+	Merge:               "none",
+	DisableMetadataPtrs: true,
+}
+
+// ImportStats are statistics about a finished Import.
+type ImportStats struct {
+	// Entries is the number of entries read from the input.
+	Entries int
+
+	// Failed is the number of entries that couldn't be inserted and were
+	// skipped.
+	Failed int
+}
+
+// validate checks the options, resolving those which are implied by others.
+func (o *ImportOptions) validate() error {
+	// validate format.
+	switch o.Format {
+	case "csv", "tsv", "json", "parquet":
+	default:
+		return usageError(errors.New("input format must be \"csv\", \"tsv\", \"json\" or \"parquet\""))
+	}
+
+	// validate IP version.
+	if o.Ip != 4 && o.Ip != 6 {
+		return usageError(errors.New("ip version must be \"4\" or \"6\""))
+	}
+
+	// validate record size.
+	if o.Size != 24 && o.Size != 28 && o.Size != 32 {
+		return usageError(errors.New("record size must be 24, 28 or 32"))
+	}
+
+	// validate merge strategy.
+	if _, err := o.mergeStrategy(); err != nil {
+		return err
+	}
+
+	// figure out fields.
+	fieldSrcCnt := 0
+	if o.Fields != nil && len(o.Fields) > 0 {
+		fieldSrcCnt += 1
+	}
+	if o.FieldsFromHdr {
+		fieldSrcCnt += 1
+	}
+	if o.NoFields {
+		fieldSrcCnt += 1
+	}
+	if fieldSrcCnt > 1 {
+		return usageError(errors.New("conflicting field sources specified"))
+	}
+	if o.NoFields {
+		o.Fields = []string{}
+		o.NoNetwork = false
+	} else if !o.FieldsFromHdr && (o.Fields == nil || len(o.Fields) == 0) {
+		o.FieldsFromHdr = true
+	}
+
+	if o.JoinKeyCol {
+		o.RangeMultiCol = true
+	}
+
+	if o.TSVEscape && o.Format != "tsv" {
+		return usageError(errors.New("tsv escaping only applies to tsv input"))
+	}
+
+	if o.TypedHeader {
+		if o.Format != "csv" && o.Format != "tsv" {
+			return usageError(errors.New("typed headers only apply to csv and tsv input"))
+		}
+		if !o.FieldsFromHdr {
+			return usageError(errors.New("typed headers require fields from the header"))
+		}
+		if o.IgnoreEmptyVals {
+			return usageError(errors.New("typed headers already leave out empty values"))
+		}
+		o.NoNetwork = true
+	}
+	if o.Format == "parquet" && !o.NoFields {
+		o.NoNetwork = true
+	}
+
+	if o.Unflatten {
+		if o.Format != "csv" && o.Format != "tsv" {
+			return usageError(errors.New("unflattening only applies to csv and tsv input"))
+		}
+		if o.IgnoreEmptyVals {
+			return usageError(errors.New("unflattening already leaves out empty values"))
+		}
+	}
+
+	return nil
+}
+
+func (o *ImportOptions) mergeStrategy() (inserter.FuncGenerator, error) {
+	switch o.Merge {
+	case "none":
+		return inserter.ReplaceWith, nil
+	case "toplevel":
+		return inserter.TopLevelMergeWith, nil
+	case "recurse":
+		return inserter.DeepMergeWith, nil
+	default:
+		return nil, usageError(errors.New("merge strategy must be \"none\", \"toplevel\" or \"recurse\""))
+	}
+}
+
+// Import reads CSV, TSV, JSON or Parquet data from r and writes it as an mmdb
+// file to w.
+//
+// Entries that can't be inserted into the tree are skipped, warned about in
+// opts.Log and counted in the returned stats.
+//
+// If ctx is cancelled, Import stops and returns an error with the
+// ExitInterrupted code; anything already written to w is incomplete.
+func Import(
+	ctx context.Context,
+	opts ImportOptions,
+	r io.Reader,
+	w io.Writer,
+) (ImportStats, error) {
+	var stats ImportStats
+
+	if err := opts.validate(); err != nil {
+		return stats, err
+	}
+	mergeStrategy, _ := opts.mergeStrategy()
+	if opts.Log == nil {
+		opts.Log = io.Discard
+	}
+
+	// init tree.
+	tree, err := mmdbwriter.New(
+		mmdbwriter.Options{
+			DatabaseType: opts.DatabaseType,
+			Description: map[string]string{
+				"en": opts.DatabaseType,
+			},
+			Languages:               []string{"en"},
+			DisableIPv4Aliasing:     !opts.Alias6to4,
+			IncludeReservedNetworks: !opts.DisallowReserved,
+			IPVersion:               opts.Ip,
+			RecordSize:              opts.Size,
+			DisableMetadataPointers: opts.DisableMetadataPtrs,
+			Inserter:                mergeStrategy,
+		},
+	)
+	if err != nil {
+		return stats, fmt.Errorf("could not create tree: %w", err)
+	}
+
+	// report progress against the input size, if known.
+	prog := newProgress(opts.Progress)
+	defer prog.Stop()
+	var inSize int64
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			inSize = fi.Size()
+		}
+	}
+	prog.Phase("insert", "bytes", inSize)
+
+	inBuffered := bufio.NewReaderSize(
+		&progressReader{r: r, p: prog},
+		65536,
+	)
+
+	switch opts.Format {
+	case "json":
+		err = importJSON(ctx, &opts, inBuffered, tree, &stats)
+	case "parquet":
+		err = importParquet(ctx, &opts, r, tree, &stats, prog)
+	default:
+		err = importDelimited(ctx, &opts, inBuffered, tree, &stats)
+	}
+	if err != nil {
+		return stats, err
+	}
+	prog.Done()
+
+	if stats.Entries == 0 {
+		return stats, errors.New("nothing to import")
+	}
+
+	// write out mmdb file, aborting if cancelled mid-way.
+	prog.Phase("write", "bytes", 0)
+	cw := &ctxWriter{ctx: ctx, w: &progressWriter{w: w, p: prog}}
+	if _, err := tree.WriteTo(cw); err != nil {
+		if err := ctxError(ctx); err != nil {
+			return stats, err
+		}
+		return stats, ioError(fmt.Errorf("writing out to tree failed: %w", err))
+	}
+	prog.Done()
+
+	return stats, nil
+}
+
+// importDelimited inserts CSV or TSV input into the tree.
+func importDelimited(
+	ctx context.Context,
+	opts *ImportOptions,
+	r io.Reader,
+	tree *mmdbwriter.Tree,
+	stats *ImportStats,
+) error {
+	var rdr reader
+	var delim rune
+	if opts.Format == "csv" {
+		delim = ','
+		csvrdr := csv.NewReader(r)
+		csvrdr.Comma = delim
+		csvrdr.LazyQuotes = true
+
+		rdr = csvrdr
+	} else {
+		delim = '\t'
+		tsvrdr := NewTsvReader(r)
+		tsvrdr.Unescape = opts.TSVEscape
+
+		rdr = tsvrdr
+	}
+
+	// read from input, scanning & parsing each line according to delim,
+	// then insert that into the tree.
+	dataColStart := 1
+	hdrSeen := false
+	for {
+		if err := ctxError(ctx); err != nil {
+			return err
+		}
+
+		parts, err := rdr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("input scanning failed: %w", err)
+		}
+
+		// on header line?
+		if !hdrSeen {
+			hdrSeen = true
+
+			parseCSVHeaders(parts, opts, &dataColStart)
+
+			// Now that opts.Fields may have been resolved, the preprocessing step can be run
+			if err := preprocess(opts, tree); err != nil {
+				return err
+			}
+
+			// should we skip this first line now?
+			if opts.FieldsFromHdr {
+				continue
+			}
+		}
+
+		inserted, err := appendCSVRecord(opts, dataColStart, delim, parts, tree)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			stats.Failed += 1
+		}
+
+		stats.Entries += 1
+	}
+
+	return nil
+}
+
+// importJSON inserts a stream of JSON objects into the tree.
+func importJSON(
+	ctx context.Context,
+	opts *ImportOptions,
+	r io.Reader,
+	tree *mmdbwriter.Tree,
+	stats *ImportStats,
+) error {
+	dataStream := json.NewDecoder(r)
+
+	// For JSON input, opts.Fields may have been specified explicitly, so preprocessing can be run
+	if err := preprocess(opts, tree); err != nil {
+		return err
+	}
+
+	fieldsResolved := false
+	for {
+		if err := ctxError(ctx); err != nil {
+			return err
+		}
+
+		// Decode one JSON document.
+		var row interface{}
+		err := dataStream.Decode(&row)
+
+		if err != nil {
+			// io.EOF is expected at end of stream.
+			if err != io.EOF {
+				return fmt.Errorf("error in io.EOF: %w", err)
+			}
+			break
+		}
+		mResult := row.(map[string]interface{})
+
+		if !fieldsResolved {
+			fieldsResolved = true
+			parseJSONKeys(mResult, opts)
+		}
+
+		// convert 2 IPs into IP range?
+		var networkStr string
+		if val, ok := mResult["start_ip"].(string); ok {
+			networkStr = val + "-" + mResult["end_ip"].(string)
+			delete(mResult, "start_ip")
+			delete(mResult, "end_ip")
+			if _, ok := mResult["join_key"].(string); ok {
+				delete(mResult, "join_key")
+			}
+		} else if val, ok := mResult["range"].(string); ok {
+			networkStr = val
+			delete(mResult, "range")
+		} else {
+			return errors.New(
+				"couldn't get ip or range from the record",
+			)
+		}
+
+		networkStr, isNetworkRange := resolveNetworkStr(opts, networkStr)
+		subMap := mmdbtype.Map{}
+		if !opts.NoNetwork {
+			subMap["network"] = mmdbtype.String(networkStr)
+		}
+
+		// prep record.
+		errProcessData := processJSONData(mResult, opts, &subMap)
+		if errProcessData != nil {
+			return fmt.Errorf("failed to map to mmdb.type err: %w", errProcessData)
+		}
+
+		inserted, err := insertNetwork(tree, networkStr, isNetworkRange, subMap)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			fmt.Fprintf(
+				opts.Log, "warn: couldn't insert '%v'\n",
+				mResult,
+			)
+			stats.Failed += 1
+		}
+
+		stats.Entries += 1
+	}
+
+	return nil
+}
+
+func preprocess(opts *ImportOptions, tree *mmdbwriter.Tree) error {
+	// insert empty values for all fields in 0.0.0.0/0 if requested.
+	if opts.IgnoreEmptyVals {
+		_, network, _ := net.ParseCIDR("0.0.0.0/0")
+		record := mmdbtype.Map{}
+		for _, field := range opts.Fields {
+			record[mmdbtype.String(field)] = mmdbtype.String("")
+		}
+		if err := tree.Insert(network, record); err != nil {
+			return errors.New(
+				"couldn't insert empty values to 0.0.0.0/0",
+			)
+		}
+	}
+
+	return nil
+}
+
+func parseCSVHeaders(parts []string, opts *ImportOptions, dataColStart *int) {
+	// check if the header has a multi-column range.
+	if len(parts) > 1 && parts[0] == "start_ip" && parts[1] == "end_ip" {
+		opts.RangeMultiCol = true
+
+		// maybe we also have a join key?
+		if len(parts) > 2 && parts[2] == "join_key" {
+			opts.JoinKeyCol = true
+		}
+	}
+
+	if opts.RangeMultiCol {
+		if opts.JoinKeyCol {
+			*dataColStart = 3
+		} else {
+			*dataColStart = 2
+		}
+	}
+
+	// need to get fields from hdr?
+	if opts.FieldsFromHdr {
+		// skip all non-data columns.
+		opts.Fields = parts[*dataColStart:]
+	}
+	if opts.TypedHeader {
+		opts.fieldTypes = make([]*fieldType, len(opts.Fields))
+		for i, col := range opts.Fields {
+			opts.Fields[i], opts.fieldTypes[i] = parseTypedColumn(col)
+		}
+	}
+}
+
+func parseJSONKeys(result map[string]interface{}, opts *ImportOptions) {
+	if _, hasStartIp := result["start_ip"].(string); hasStartIp {
+		if _, hasEndIp := result["end_ip"].(string); hasEndIp {
+			opts.RangeMultiCol = true
+
+			if _, hasJoinKey := result["join_key"].(string); hasJoinKey {
+				opts.JoinKeyCol = true
+			}
+		}
+	}
+
+	// determine fields
+	// NOTE: even though there are no headers for JSON, we reuse that variable to signal the need to extract fields
+	if opts.FieldsFromHdr {
+		for key := range result {
+			switch key {
+			case "start_ip", "end_ip", "join_key", "range":
+				continue
+			default:
+				opts.Fields = append(opts.Fields, key)
+			}
+		}
+	}
+}
+
+// appendCSVRecord inserts a CSV/TSV record into the tree, reporting whether
+// it was inserted; a record which couldn't be inserted is only warned about.
+func appendCSVRecord(
+	opts *ImportOptions,
+	dataColStart int,
+	delim rune,
+	parts []string,
+	tree *mmdbwriter.Tree,
+) (bool, error) {
+	if len(parts) < dataColStart {
+		fmt.Fprintf(
+			opts.Log, "warn: couldn't parse line '%v': %v\n",
+			strings.Join(parts, string(delim)),
+			fmt.Errorf("expected %v fields, got %v", dataColStart+len(opts.Fields), len(parts)),
+		)
+		return false, nil
+	}
+
+	if startIp, _ := iputil.DecimalStrToIP(parts[0], false); startIp != nil {
+		parts[0] = startIp.String()
+	}
+
+	networkStr := parts[0]
+
+	// convert 2 IPs into IP range?
+	if opts.RangeMultiCol {
+		if endIp, _ := iputil.DecimalStrToIP(parts[1], false); endIp != nil {
+			parts[1] = endIp.String()
+		}
+
+		networkStr = parts[0] + "-" + parts[1]
+	}
+
+	networkStr, isNetworkRange := resolveNetworkStr(opts, networkStr)
+
+	// prep record.
+	vals, err := csvRecordValues(opts, parts[dataColStart:])
+	if err != nil {
+		fmt.Fprintf(
+			opts.Log, "warn: couldn't parse line '%v': %v\n",
+			strings.Join(parts, string(delim)), err,
+		)
+		return false, nil
+	}
+	record := mmdbtype.Map{}
+	if opts.Unflatten {
+		record, err = unflattenRecord(opts.Fields, vals)
+		if err != nil {
+			fmt.Fprintf(
+				opts.Log, "warn: couldn't unflatten line '%v': %v\n",
+				strings.Join(parts, string(delim)), err,
+			)
+			return false, nil
+		}
+	} else {
+		for i, field := range opts.Fields {
+			if vals[i] != nil {
+				record[mmdbtype.String(field)] = vals[i]
+			}
+		}
+	}
+	if !opts.NoNetwork {
+		record["network"] = mmdbtype.String(networkStr)
+	}
+
+	inserted, err := insertNetwork(tree, networkStr, isNetworkRange, record)
+	if err != nil {
+		return false, err
+	}
+	if !inserted {
+		fmt.Fprintf(
+			opts.Log, "warn: couldn't insert line '%v'\n",
+			strings.Join(parts, string(delim)),
+		)
+	}
+	return inserted, nil
+}
+
+// csvRecordValues returns the values of the fields of a CSV/TSV line, which
+// are strings unless typed by a typed header. Empty values are nil where
+// they're left out: when unflattening, or with a typed header.
+func csvRecordValues(opts *ImportOptions, cells []string) ([]mmdbtype.DataType, error) {
+	if len(cells) < len(opts.Fields) {
+		return nil, fmt.Errorf("expected %v fields, got %v", len(opts.Fields), len(cells))
+	}
+	vals := make([]mmdbtype.DataType, len(opts.Fields))
+	for i, field := range opts.Fields {
+		cell := cells[i]
+		var ft *fieldType
+		if opts.fieldTypes != nil {
+			ft = opts.fieldTypes[i]
+		}
+		if cell == "" && (opts.Unflatten || opts.TypedHeader) {
+			continue
+		}
+		v, err := typedFromStr(ft, cell)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of field %q: %w", field, err)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// resolveNetworkStr adds the network part to a single IP which is missing
+// it, and reports whether networkStr is a "start-end" range instead.
+func resolveNetworkStr(opts *ImportOptions, networkStr string) (string, bool) {
+	isNetworkRange := strings.Contains(networkStr, "-")
+	if !isNetworkRange && !strings.Contains(networkStr, "/") {
+		if opts.Ip == 6 && strings.Contains(networkStr, ":") {
+			networkStr += "/128"
+		} else {
+			networkStr += "/32"
+		}
+	}
+	return networkStr, isNetworkRange
+}
+
+// insertNetwork inserts record into the tree for the network or range
+// resolved by resolveNetworkStr, reporting whether it was inserted. Only a
+// CIDR which can't be parsed is an error.
+func insertNetwork(
+	tree *mmdbwriter.Tree,
+	networkStr string,
+	isNetworkRange bool,
+	record mmdbtype.Map,
+) (bool, error) {
+	// range insertion or cidr insertion?
+	if isNetworkRange {
+		networkStrParts := strings.Split(networkStr, "-")
+		startIp := net.ParseIP(networkStrParts[0])
+		endIp := net.ParseIP(networkStrParts[1])
+		if err := tree.InsertRange(startIp, endIp, record); err != nil {
+			return false, nil
+		}
+	} else {
+		_, network, err := net.ParseCIDR(networkStr)
+		if err != nil {
+			return false, fmt.Errorf(
+				"couldn't parse cidr \"%v\": %w",
+				networkStr, err,
+			)
+		}
+		if err := tree.Insert(network, record); err != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func processJSONData(
+	data map[string]interface{},
+	opts *ImportOptions,
+	subMap *mmdbtype.Map,
+) error {
+	// Insert each key-value pair into the map
+	for _, field := range opts.Fields {
+		value, ok := data[field]
+		if !ok {
+			continue
+		}
+
+		mmdbValue, err := ConvertToMMDBType(value)
+		if err != nil {
+			return fmt.Errorf("failed to convert value to MMDB type: %v", err)
+		}
+		(*subMap)[mmdbtype.String(field)] = mmdbValue
+	}
+
+	return nil
+}
+
+func ConvertToMMDBType(value interface{}) (mmdbtype.DataType, error) {
+	switch v := value.(type) {
+	case nil:
+		return mmdbtype.String(""), nil
+	case string:
+		return mmdbtype.String(v), nil
+	case float64:
+		return mmdbtype.Float64(v), nil
+	case float32:
+		return mmdbtype.Float32(v), nil
+	case int32:
+		return mmdbtype.Int32(v), nil
+	case uint16:
+		return mmdbtype.Uint16(v), nil
+	case uint32:
+		return mmdbtype.Uint32(v), nil
+	case uint64:
+		return mmdbtype.Uint64(v), nil
+	case bool:
+		return mmdbtype.Bool(v), nil
+	case map[string]interface{}:
+		subMap := mmdbtype.Map{}
+		for key, val := range v {
+			mmdbValue, err := ConvertToMMDBType(val)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert value to MMDB type: %v", err)
+			}
+			subMap[mmdbtype.String(key)] = mmdbValue
+		}
+		return subMap, nil
+	case []interface{}:
+		subSlice := mmdbtype.Slice{}
+		for _, val := range v {
+			mmdbValue, err := ConvertToMMDBType(val)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert value to MMDB type: %v", err)
+			}
+			subSlice = append(subSlice, mmdbValue)
+		}
+		return subSlice, nil
+	default:
+		outJson, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return mmdbtype.String(outJson), nil
+	}
+}
@@ -0,0 +1,287 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"slices"
+
+	"github.com/ipinfo/cli/lib/iputil"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/parquet-go/parquet-go"
+)
+
+// importParquet inserts Parquet input into the tree.
+//
+// The network is taken from a range column, or start_ip and end_ip columns,
+// as written by export. The other columns are the fields, and their values
+// are converted to the MMDB types matching their Parquet types, e.g. an
+// unsigned 32-bit integer column to uint32 and a group to a map. Null values
+// are left out.
+func importParquet(
+	ctx context.Context,
+	opts *ImportOptions,
+	r io.Reader,
+	tree *mmdbwriter.Tree,
+	stats *ImportStats,
+	prog *progress,
+) error {
+	// the schema is at the end of the file, so the input must be seekable;
+	// anything else, like stdin, is read into memory first.
+	var ra io.ReaderAt
+	var size int64
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			ra, size = f, fi.Size()
+		}
+	}
+	if ra == nil {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return ioError(fmt.Errorf("input scanning failed: %w", err))
+		}
+		ra, size = bytes.NewReader(data), int64(len(data))
+	}
+	pf, err := parquet.OpenFile(ra, size)
+	if err != nil {
+		return fmt.Errorf("invalid parquet input: %w", err)
+	}
+
+	// figure out the network and data columns.
+	cols := make(map[string]parquet.Node)
+	var names []string
+	for _, field := range pf.Schema().Fields() {
+		cols[field.Name()] = field
+		names = append(names, field.Name())
+	}
+	if cols["start_ip"] != nil && cols["end_ip"] != nil {
+		opts.RangeMultiCol = true
+		if cols["join_key"] != nil {
+			opts.JoinKeyCol = true
+		}
+	}
+	var netCols []string
+	if opts.RangeMultiCol {
+		netCols = []string{"start_ip", "end_ip"}
+	} else {
+		netCols = []string{"range"}
+	}
+	for _, name := range netCols {
+		if cols[name] == nil {
+			return usageError(fmt.Errorf("parquet input has no %v column", name))
+		}
+	}
+	if opts.FieldsFromHdr {
+		opts.Fields = slices.DeleteFunc(names, func(name string) bool {
+			return slices.Contains(netCols, name) || (opts.JoinKeyCol && name == "join_key")
+		})
+	}
+	for _, field := range opts.Fields {
+		if cols[field] == nil {
+			return usageError(fmt.Errorf("parquet input has no %v column", field))
+		}
+	}
+
+	if err := preprocess(opts, tree); err != nil {
+		return err
+	}
+
+	prog.Phase("insert", "rows", pf.NumRows())
+	rdr := parquet.NewReader(pf)
+	defer rdr.Close()
+	for {
+		if err := ctxError(ctx); err != nil {
+			return err
+		}
+
+		row := make(map[string]any)
+		if err := rdr.Read(&row); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("input scanning failed: %w", err)
+		}
+		prog.Add(1)
+
+		// convert 2 IPs into IP range?
+		netParts := make([]string, len(netCols))
+		for i, name := range netCols {
+			v, err := parquetToMMDB(cols[name], row[name])
+			if err != nil {
+				return fmt.Errorf("invalid %v column: %w", name, err)
+			}
+			s, ok := v.(mmdbtype.String)
+			if !ok {
+				return fmt.Errorf("%v column must be a string, not %v", name, mmdbKind(v))
+			}
+			netParts[i] = string(s)
+			if opts.RangeMultiCol {
+				if ip, _ := iputil.DecimalStrToIP(netParts[i], false); ip != nil {
+					netParts[i] = ip.String()
+				}
+			}
+		}
+		networkStr := netParts[0]
+		if opts.RangeMultiCol {
+			networkStr += "-" + netParts[1]
+		}
+		networkStr, isNetworkRange := resolveNetworkStr(opts, networkStr)
+
+		// prep record.
+		record := mmdbtype.Map{}
+		for _, field := range opts.Fields {
+			v, err := parquetToMMDB(cols[field], row[field])
+			if err != nil {
+				return fmt.Errorf("invalid %v column: %w", field, err)
+			}
+			if v != nil {
+				record[mmdbtype.String(field)] = v
+			}
+		}
+		if !opts.NoNetwork {
+			record["network"] = mmdbtype.String(networkStr)
+		}
+
+		inserted, err := insertNetwork(tree, networkStr, isNetworkRange, record)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			fmt.Fprintf(opts.Log, "warn: couldn't insert '%v'\n", networkStr)
+			stats.Failed += 1
+		}
+
+		stats.Entries += 1
+	}
+
+	return nil
+}
+
+// parquetToMMDB converts v, a value read from a column of type node, to the
+// MMDB type matching node. A null value is nil.
+func parquetToMMDB(node parquet.Node, v any) (mmdbtype.DataType, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	typ := node.Type()
+	lt := typ.LogicalType()
+	if !node.Leaf() {
+		switch {
+		case lt != nil && lt.List != nil:
+			elems, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("unexpected list value %T", v)
+			}
+			// LIST groups wrap a repeated "list" group of an "element".
+			elemNode := node.Fields()[0].Fields()[0]
+			s := make(mmdbtype.Slice, 0, len(elems))
+			for _, elem := range elems {
+				ev, err := parquetToMMDB(elemNode, elem)
+				if err != nil {
+					return nil, err
+				}
+				if ev != nil {
+					s = append(s, ev)
+				}
+			}
+			return s, nil
+		case lt != nil && lt.Map != nil:
+			return nil, errors.New("parquet maps aren't supported")
+		}
+
+		fields, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unexpected group value %T", v)
+		}
+		m := make(mmdbtype.Map, len(fields))
+		for _, field := range node.Fields() {
+			fv, err := parquetToMMDB(field, fields[field.Name()])
+			if err != nil {
+				return nil, err
+			}
+			if fv != nil {
+				m[mmdbtype.String(field.Name())] = fv
+			}
+		}
+		return m, nil
+	}
+
+	switch typ.Kind() {
+	case parquet.Boolean:
+		if b, ok := v.(bool); ok {
+			return mmdbtype.Bool(b), nil
+		}
+	case parquet.Int32, parquet.Int64:
+		n, ok := parquetInt(v)
+		if !ok {
+			break
+		}
+		unsigned := lt != nil && lt.Integer != nil && !lt.Integer.IsSigned
+		switch {
+		case unsigned && typ.Kind() == parquet.Int64:
+			return mmdbtype.Uint64(uint64(n)), nil
+		case unsigned && lt.Integer.BitWidth <= 16:
+			return mmdbtype.Uint16(uint16(n)), nil
+		case unsigned:
+			return mmdbtype.Uint32(uint32(n)), nil
+		case n >= math.MinInt32 && n <= math.MaxInt32:
+			return mmdbtype.Int32(n), nil
+		case n >= 0:
+			return mmdbtype.Uint64(n), nil
+		default:
+			return nil, fmt.Errorf("%v doesn't fit an mmdb integer type", n)
+		}
+	case parquet.Float:
+		if f, ok := v.(float32); ok {
+			return mmdbtype.Float32(f), nil
+		}
+	case parquet.Double:
+		if f, ok := v.(float64); ok {
+			return mmdbtype.Float64(f), nil
+		}
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		var b []byte
+		switch v := v.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		default:
+			return nil, fmt.Errorf("unexpected byte array value %T", v)
+		}
+		switch {
+		case lt != nil && (lt.UTF8 != nil || lt.Json != nil || lt.Enum != nil):
+			return mmdbtype.String(b), nil
+		case typ.Kind() == parquet.FixedLenByteArray && typ.Length() == 16:
+			// export writes uint128 values as 16 big-endian bytes.
+			return (*mmdbtype.Uint128)(new(big.Int).SetBytes(b)), nil
+		}
+		return mmdbtype.Bytes(bytes.Clone(b)), nil
+	default:
+		return nil, fmt.Errorf("parquet type %v isn't supported", typ)
+	}
+	return nil, fmt.Errorf("unexpected %v value %T", typ, v)
+}
+
+// parquetInt returns the integer value v, as read from an integer column.
+func parquetInt(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
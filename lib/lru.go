@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultCacheSize is the number of records exporters keep decoded by
+// default.
+const defaultCacheSize = 1 << 16
+
+// lruCache caches values derived from records, keyed by their offset in the
+// data section, keeping at most size of them: once full, adding a value
+// evicts the least recently used one.
+//
+// Many networks usually share a record, and as networks sharing a record
+// are mostly close together, few records need to be kept at once.
+//
+// It's safe for concurrent use.
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	entries map[uintptr]*list.Element
+	order   *list.List
+}
+
+// lruEntry is an element of the order of an lruCache.
+type lruEntry[V any] struct {
+	offset uintptr
+	val    V
+}
+
+// newLRUCache returns an empty cache of at most size values; size must be
+// positive.
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{
+		size:    size,
+		entries: make(map[uintptr]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the value of the record at offset, if it's cached.
+func (c *lruCache[V]) get(offset uintptr) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[offset]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[V]).val, true
+}
+
+// add caches the value of the record at offset.
+func (c *lruCache[V]) add(offset uintptr, val V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[offset]; ok {
+		elem.Value.(*lruEntry[V]).val = val
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.size {
+		// reuse the evicted element.
+		oldest := c.order.Back()
+		entry := oldest.Value.(*lruEntry[V])
+		delete(c.entries, entry.offset)
+		entry.offset, entry.val = offset, val
+		c.order.MoveToFront(oldest)
+		c.entries[offset] = oldest
+		return
+	}
+	c.entries[offset] = c.order.PushFront(&lruEntry[V]{offset: offset, val: val})
+}
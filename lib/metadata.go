@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+const (
+	MetadataStartMarker = "\xAB\xCD\xEFMaxMind.com"
+)
+
+// MetadataOptions are options for Metadata.
+type MetadataOptions struct {
+	// DataTypes scans the data section for the sizes of each data type.
+	DataTypes bool
+
+	// Progress receives progress reports. If nil, none are made.
+	Progress io.Writer
+}
+
+// MetadataInfo is the metadata of an mmdb file, along with the layout of its
+// sections.
+type MetadataInfo struct {
+	BinaryFormatVsn        string            `json:"binary_format"`
+	DatabaseType           string            `json:"db_type"`
+	IPVersion              uint              `json:"ip"`
+	RecordSize             uint              `json:"record_size"`
+	NodeCount              uint              `json:"node_count"`
+	TreeSize               uint              `json:"tree_size"`
+	DataSectionSize        uint              `json:"data_section_size"`
+	TypeSize               *TypeSizes        `json:"data_type_sizes,omitempty"`
+	DataSectionStartOffset uint              `json:"data_section_start_offset"`
+	DataSectionEndOffset   uint              `json:"data_section_end_offset"`
+	MetadataStartOffset    uint              `json:"metadata_section_start_offset"`
+	Description            map[string]string `json:"description"`
+	Languages              []string          `json:"languages"`
+	BuildEpoch             uint              `json:"build_epoch"`
+}
+
+// Metadata reads the metadata of the mmdb file at mmdbFile.
+//
+// TypeSize is only set if opts.DataTypes is set.
+func Metadata(
+	ctx context.Context,
+	mmdbFile string,
+	opts MetadataOptions,
+) (MetadataInfo, error) {
+	var md MetadataInfo
+
+	// open tree.
+	db, err := maxminddb.Open(mmdbFile)
+	if err != nil {
+		return md, openDBError(fmt.Errorf("couldn't open mmdb file: %w", err))
+	}
+	defer db.Close()
+
+	mdFromLib := db.Metadata
+	treeSize := ((int(mdFromLib.RecordSize) * 2) / 8) * int(mdFromLib.NodeCount)
+	dataSectionStartOffset := treeSize + 16
+
+	// Offset of this separator is used to determine the metadata start section, data section end and data section size.
+	offset, err := findSectionSeparator(mmdbFile, MetadataStartMarker)
+	if err != nil {
+		return md, ioError(fmt.Errorf("couldn't process the mmdb file: %w", err))
+	}
+
+	if offset == -1 {
+		return md, invalidDBError(errors.New("input valid mmdb file required as first argument"))
+	}
+	dataSectionEndOffset := int(offset)
+	dataSectionSize := int(offset) - treeSize - 16
+	if opts.DataTypes {
+		typeSizes, err := traverseDataSection(
+			ctx,
+			mmdbFile,
+			int64(dataSectionStartOffset),
+			int64(dataSectionEndOffset),
+			newProgress(opts.Progress),
+		)
+		if err := ctxError(ctx); err != nil {
+			return md, err
+		}
+		if err != nil {
+			return md, ioError(fmt.Errorf("couldn't process the mmdb file: %w", err))
+		}
+		md.TypeSize = &typeSizes
+	}
+	metadataSectionStartOffset := int(offset) + len(MetadataStartMarker)
+
+	md.BinaryFormatVsn = strconv.Itoa(int(mdFromLib.BinaryFormatMajorVersion)) + "." + strconv.Itoa(int(mdFromLib.BinaryFormatMinorVersion))
+	md.DatabaseType = mdFromLib.DatabaseType
+	md.IPVersion = mdFromLib.IPVersion
+	md.RecordSize = mdFromLib.RecordSize
+	md.NodeCount = mdFromLib.NodeCount
+	md.TreeSize = uint(treeSize)
+	md.DataSectionSize = uint(dataSectionSize)
+	md.DataSectionStartOffset = uint(dataSectionStartOffset)
+	md.DataSectionEndOffset = uint(dataSectionEndOffset)
+	md.MetadataStartOffset = uint(metadataSectionStartOffset)
+	md.Description = mdFromLib.Description
+	md.Languages = mdFromLib.Languages
+	md.BuildEpoch = mdFromLib.BuildEpoch
+
+	return md, nil
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	progressTTYInterval = 200 * time.Millisecond
+	progressLogInterval = 5 * time.Second
+)
+
+// progress reports the advancement of a long-running operation, phase by
+// phase, to a writer (usually stderr).
+//
+// When the writer is a terminal the status line is redrawn in place;
+// otherwise a plain log line is emitted periodically. Nothing is printed for
+// phases that finish before the first report is due.
+//
+// Reports are timed by a timer rather than by checking the clock on every
+// Add, which is called for every record.
+//
+// A nil *progress is valid and reports nothing. It's safe for concurrent use.
+type progress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	tty      bool
+	interval time.Duration
+	phase    string
+	unit     string
+	total    int64
+	cur      int64
+	start    time.Time
+	shown    bool
+
+	// timer sets due once the next report is.
+	timer *time.Timer
+	due   atomic.Bool
+}
+
+// newProgress returns a progress reporter writing to w, or nil if w is nil.
+func newProgress(w io.Writer) *progress {
+	if w == nil {
+		return nil
+	}
+
+	tty := false
+	if f, ok := w.(*os.File); ok {
+		tty = isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+	}
+	interval := progressLogInterval
+	if tty {
+		interval = progressTTYInterval
+	}
+	return &progress{w: w, tty: tty, interval: interval}
+}
+
+// Phase finishes the current phase, if any, and starts a new one named
+// `name` which counts `unit`s. `total` is the expected amount used for the
+// percentage and ETA; if <= 0, only the amount and rate are shown.
+func (p *progress) Phase(name string, unit string, total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done()
+	p.phase = name
+	p.unit = unit
+	p.total = total
+	p.cur = 0
+	p.start = time.Now()
+	p.shown = false
+	p.due.Store(false)
+	p.timer = time.AfterFunc(p.interval, func() { p.due.Store(true) })
+}
+
+// Add advances the current phase by n units.
+func (p *progress) Add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cur += n
+	p.tick()
+}
+
+// Set sets the amount processed in the current phase.
+func (p *progress) Set(cur int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cur = cur
+	p.tick()
+}
+
+// Done finishes the current phase, printing a final report if any report was
+// printed for it.
+func (p *progress) Done() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done()
+}
+
+func (p *progress) done() {
+	if p.phase == "" {
+		return
+	}
+	p.timer.Stop()
+
+	if p.shown {
+		elapsed := time.Since(p.start)
+		line := fmt.Sprintf(
+			"%s: done, %s in %s",
+			p.phase,
+			formatProgressAmount(p.cur, p.unit),
+			elapsed.Round(time.Millisecond),
+		)
+		if p.tty {
+			fmt.Fprintf(p.w, "\r%s\x1b[K\n", line)
+		} else {
+			fmt.Fprintf(p.w, "progress: %s\n", line)
+		}
+	}
+	p.phase = ""
+}
+
+// Stop abandons the current phase without a final report, terminating any
+// in-place status line. It is meant to be deferred to handle early returns.
+func (p *progress) Stop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.phase == "" {
+		return
+	}
+	p.timer.Stop()
+
+	if p.shown && p.tty {
+		fmt.Fprintln(p.w)
+	}
+	p.phase = ""
+}
+
+func (p *progress) tick() {
+	if p.phase == "" || !p.due.Load() {
+		return
+	}
+	p.due.Store(false)
+	p.timer.Reset(p.interval)
+	p.shown = true
+
+	line := p.status(time.Now())
+	if p.tty {
+		fmt.Fprintf(p.w, "\r%s\x1b[K", line)
+	} else {
+		fmt.Fprintf(p.w, "progress: %s\n", line)
+	}
+}
+
+func (p *progress) status(now time.Time) string {
+	elapsed := now.Sub(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.cur) / elapsed
+	}
+
+	parts := []string{
+		formatProgressAmount(p.cur, p.unit),
+		formatProgressAmount(int64(rate), p.unit) + "/s",
+	}
+	if p.total > 0 {
+		pct := float64(p.cur) / float64(p.total) * 100
+		if pct > 99 {
+			// totals are often estimates; never claim completion early.
+			pct = 99
+		}
+		parts = append(parts, fmt.Sprintf("%.0f%%", pct))
+		if rate > 0 && p.cur < p.total {
+			eta := time.Duration(float64(p.total-p.cur) / rate * float64(time.Second))
+			parts = append(parts, "ETA "+eta.Round(time.Second).String())
+		}
+	}
+	return p.phase + ": " + strings.Join(parts, ", ")
+}
+
+func formatProgressAmount(n int64, unit string) string {
+	if unit == "bytes" {
+		const (
+			KB = 1 << 10
+			MB = 1 << 20
+			GB = 1 << 30
+		)
+		switch {
+		case n >= GB:
+			return fmt.Sprintf("%.2f GB", float64(n)/GB)
+		case n >= MB:
+			return fmt.Sprintf("%.2f MB", float64(n)/MB)
+		case n >= KB:
+			return fmt.Sprintf("%.2f KB", float64(n)/KB)
+		default:
+			return fmt.Sprintf("%d B", n)
+		}
+	}
+
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.2fG %s", float64(n)/1e9, unit)
+	case n >= 1e6:
+		return fmt.Sprintf("%.2fM %s", float64(n)/1e6, unit)
+	case n >= 1e3:
+		return fmt.Sprintf("%.2fK %s", float64(n)/1e3, unit)
+	default:
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+}
+
+// progressReader counts bytes read through it towards a progress.
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
+
+// progressWriter counts bytes written through it towards a progress.
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress_Throttled(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf)
+	p.interval = 20 * time.Millisecond
+
+	// a phase done before the first report is due prints nothing.
+	p.Phase("quick", "records", 0)
+	p.Add(10)
+	p.Done()
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output for a quick phase, got %q", buf.String())
+	}
+
+	p.Phase("import", "records", 0)
+	for i := 0; i < 1000; i++ {
+		p.Add(1)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected no report before the interval, got %q", buf.String())
+	}
+
+	// once due, a single report is made until the next interval.
+	time.Sleep(2 * p.interval)
+	for i := 0; i < 1000; i++ {
+		p.Add(1)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "progress: import: 1.00K records, ") {
+		t.Fatalf("expected a single report, got %q", buf.String())
+	}
+
+	p.Done()
+	lines = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "progress: import: done, 2.00K records in ") {
+		t.Fatalf("expected a final report, got %q", buf.String())
+	}
+}
@@ -0,0 +1,359 @@
+package lib
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+var predictReadFmts = []string{
+	"json",
+	"json-compact",
+	"json-pretty",
+	"tsv",
+	"csv",
+}
+
+// ReadOptions are options for Read.
+type ReadOptions struct {
+	// Format is the output format: "json", "json-compact", "json-pretty",
+	// "tsv" or "csv". "json" is short for "json-compact".
+	Format string
+
+	// Flatten expands nested maps and arrays in CSV/TSV output into columns
+	// named by their dotted paths, as for ExportOptions.Flatten.
+	Flatten bool
+
+	// ArrayDelim, if set with Flatten, joins arrays of scalars by it into a
+	// single column instead of indexing them.
+	ArrayDelim string
+
+	// NoNetwork leaves out the network of the database which the data of
+	// each IP was found in. By default it's written as "network", after the
+	// IP for CSV/TSV, unless the record has a network field of its own; see
+	// ReplaceNetwork.
+	NoNetwork bool
+
+	// PrefixLen writes the prefix length of the network which the data of
+	// each IP was found in as "prefix_len", after the network for CSV/TSV,
+	// unless the record has a prefix_len field of its own.
+	PrefixLen bool
+
+	// ReplaceNetwork writes the network and prefix length in place of the
+	// network and prefix_len fields of records which have them, which are
+	// otherwise kept.
+	ReplaceNetwork bool
+
+	// Log receives errors about IPs that couldn't be read, for formats
+	// without a header, and warnings about network and prefix_len fields of
+	// the records kept in place of those of the network, once per field. If
+	// nil, they are discarded.
+	Log io.Writer
+}
+
+// ReadStats are statistics about a finished Read.
+type ReadStats struct {
+	// Found is the number of IPs whose data was written.
+	Found int
+
+	// NotFound is the number of IPs without data.
+	NotFound int
+
+	// Failed is the number of IPs whose data couldn't be read or written.
+	Failed int
+}
+
+// validate checks the options, resolving format aliases.
+func (o *ReadOptions) validate() error {
+	if o.Format == "json" {
+		o.Format = "json-compact"
+	}
+	valid := false
+	for _, f := range predictReadFmts {
+		if o.Format == f {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return usageError(fmt.Errorf("format must be one of %v", predictReadFmts))
+	}
+
+	if o.Flatten && o.Format != "csv" && o.Format != "tsv" {
+		return usageError(errors.New("flattening only applies to csv and tsv formats"))
+	}
+	if o.ArrayDelim != "" && !o.Flatten {
+		return usageError(errors.New("array delimiter requires flattening"))
+	}
+
+	return nil
+}
+
+// leadKeys returns the keys of the columns of the network of each IP, which
+// lead the CSV/TSV columns of the record.
+func (o *ReadOptions) leadKeys() []string {
+	var keys []string
+	if !o.NoNetwork {
+		keys = append(keys, "network")
+	}
+	if o.PrefixLen {
+		keys = append(keys, "prefix_len")
+	}
+	return keys
+}
+
+// ReadQuery is an IP, or a range of IPs, whose data to read.
+type ReadQuery struct {
+	// Start and End are the first and last IP of the range, which are the
+	// same for a single IP.
+	Start netip.Addr
+	End   netip.Addr
+}
+
+// ReadIP returns the query of a single IP.
+func ReadIP(ip netip.Addr) ReadQuery {
+	return ReadQuery{Start: ip, End: ip}
+}
+
+// ReadPrefix returns the query of the IPs of prefix.
+func ReadPrefix(prefix netip.Prefix) ReadQuery {
+	prefix = prefix.Masked()
+	return ReadQuery{Start: prefix.Addr(), End: prefixLastAddr(prefix)}
+}
+
+func (q ReadQuery) String() string {
+	if q.Start == q.End {
+		return q.Start.String()
+	}
+	return q.Start.String() + "-" + q.End.String()
+}
+
+// Read looks up each of queries in db and writes their data to w.
+//
+// A single IP is written with the data of the network it's found in. A range
+// is written with each distinct network overlapping it once, found by walking
+// the networks within the prefixes making up the range rather than looking up
+// each of its IPs; the IP written along with a network is the first IP of the
+// range in it.
+func Read(
+	ctx context.Context,
+	db *maxminddb.Reader,
+	queries []ReadQuery,
+	opts ReadOptions,
+	w io.Writer,
+) (ReadStats, error) {
+	var stats ReadStats
+
+	if err := opts.validate(); err != nil {
+		return stats, err
+	}
+	if opts.Log == nil {
+		opts.Log = io.Discard
+	}
+	for _, q := range queries {
+		if q.Start.BitLen() != q.End.BitLen() || q.End.Less(q.Start) {
+			return stats, usageError(fmt.Errorf("invalid range %v", q))
+		}
+	}
+
+	requiresHdr := opts.Format == "csv" || opts.Format == "tsv"
+	hdrWritten := false
+	var hdrKeys []string
+	var wr writer
+	if opts.Format == "csv" {
+		csvwr := csv.NewWriter(w)
+		wr = csvwr
+	} else if opts.Format == "tsv" {
+		tsvwr := NewTsvWriter(w)
+		wr = tsvwr
+	}
+
+	// setNetworkField sets k of the record of ip to v, unless it has a
+	// value of its own which isn't to be replaced, warning the first time
+	// it keeps a different one.
+	warned := make(map[string]bool)
+	setNetworkField := func(record map[string]any, ip netip.Addr, k string, v any) {
+		own, ok := record[k]
+		if !ok || opts.ReplaceNetwork {
+			record[k] = v
+			return
+		}
+		if !warned[k] && fmt.Sprint(own) != fmt.Sprint(v) {
+			warned[k] = true
+			fmt.Fprintf(opts.Log,
+				"warn: the data of %s has its own %q (%v), which is kept over that of its network (%v)\n",
+				ip.String(), k, own, v,
+			)
+		}
+	}
+
+	// write writes the data of result found for ip, reporting whether it
+	// had any.
+	write := func(ip netip.Addr, result maxminddb.Result) (bool, error) {
+		record := make(map[string]interface{})
+		if err := result.Decode(&record); err != nil {
+			if !requiresHdr {
+				fmt.Fprintf(opts.Log,
+					"err: couldn't get data for %s\n",
+					ip.String(),
+				)
+			}
+			stats.Failed += 1
+			return true, nil
+		}
+		if len(record) == 0 {
+			return false, nil
+		}
+
+		if opts.Format == "json-compact" || opts.Format == "json-pretty" {
+			record["ip"] = ip
+		}
+		if !opts.NoNetwork {
+			setNetworkField(record, ip, "network", result.Prefix().String())
+		}
+		if opts.PrefixLen {
+			setNetworkField(record, ip, "prefix_len", result.Prefix().Bits())
+		}
+
+		var recordStr map[string]string
+		if opts.Flatten {
+			recordStr = flattenRecord(record, opts.ArrayDelim)
+		} else {
+			recordStr = mapInterfaceToStr(record)
+		}
+
+		if !hdrWritten {
+			hdrWritten = true
+
+			if requiresHdr {
+				hdrKeys = opts.leadKeys()
+				for _, k := range sortedMapKeys(recordStr) {
+					if !slices.Contains(hdrKeys, k) {
+						hdrKeys = append(hdrKeys, k)
+					}
+				}
+				hdr := append([]string{"ip"}, hdrKeys...)
+				if err := wr.Write(hdr); err != nil {
+					return true, ioError(fmt.Errorf(
+						"failed to write header %v: %w",
+						hdr, err,
+					))
+				}
+			}
+		}
+
+		if opts.Format == "json-compact" || opts.Format == "json-pretty" {
+			var b []byte
+			var err error
+			if opts.Format == "json-compact" {
+				b, err = json.Marshal(record)
+			} else {
+				b, err = json.MarshalIndent(record, "", "  ")
+			}
+			if err != nil {
+				fmt.Fprintf(opts.Log,
+					"err: couldn't print data for %s\n",
+					ip.String(),
+				)
+				stats.Failed += 1
+				return true, nil
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", b); err != nil {
+				return true, ioError(fmt.Errorf("failed to write data for %s: %w", ip, err))
+			}
+		} else { // if opts.Format == "csv" || opts.Format == "tsv"
+			line := []string{ip.String()}
+			for _, k := range hdrKeys {
+				line = append(line, recordStr[k])
+			}
+			if err := wr.Write(line); err != nil {
+				return true, ioError(fmt.Errorf("failed to write line %v: %w", line, err))
+			}
+		}
+		stats.Found += 1
+		return true, nil
+	}
+
+	for _, q := range queries {
+		found, err := readQuery(ctx, db, q, write)
+		if err != nil {
+			// whole records were written so far; keep them.
+			if wr != nil {
+				wr.Flush()
+			}
+			return stats, err
+		}
+		if !found {
+			if !requiresHdr {
+				fmt.Fprintf(opts.Log,
+					"err: couldn't get data for %s\n",
+					q.String(),
+				)
+			}
+			stats.NotFound += 1
+		}
+	}
+	if wr != nil {
+		wr.Flush()
+		if err := wr.Error(); err != nil {
+			return stats, ioError(fmt.Errorf("writer had failure: %w", err))
+		}
+	}
+
+	return stats, nil
+}
+
+// readQuery writes the data of the networks of q in db using write,
+// reporting whether any had data.
+func readQuery(
+	ctx context.Context,
+	db *maxminddb.Reader,
+	q ReadQuery,
+	write func(ip netip.Addr, result maxminddb.Result) (bool, error),
+) (bool, error) {
+	if err := ctxError(ctx); err != nil {
+		return false, err
+	}
+	if q.Start == q.End {
+		return write(q.Start, db.Lookup(q.Start))
+	}
+
+	found := false
+	var last netip.Prefix
+	for _, prefix := range rangeToPrefixes(q.Start, q.End) {
+		for result := range db.NetworksWithin(prefix) {
+			if err := ctxError(ctx); err != nil {
+				return found, err
+			}
+			if err := result.Err(); err != nil {
+				return found, invalidDBError(fmt.Errorf("failed networks traversal: %w", err))
+			}
+
+			// a network containing a prefix at a boundary of the range is
+			// also found within the prefixes next to it.
+			network := result.Prefix()
+			if network == last {
+				continue
+			}
+			last = network
+
+			ip := network.Addr()
+			if network.Contains(q.Start) {
+				ip = q.Start
+			}
+			ok, err := write(ip, result)
+			if err != nil {
+				return found, err
+			}
+			found = found || ok
+		}
+	}
+	return found, nil
+}
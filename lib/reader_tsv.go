@@ -7,6 +7,11 @@ import (
 )
 
 type TsvReader struct {
+	// Unescape reverses TsvWriter.Escape in fields: \\, \t, \n and \r are
+	// read as a backslash, tab, newline and carriage return. Other
+	// backslashes are kept as is.
+	Unescape bool
+
 	r *bufio.Reader
 }
 
@@ -28,5 +33,42 @@ func (r *TsvReader) Read() (record []string, err error) {
 		err = nil
 	}
 
-	return strings.Split(line, "\t"), err
+	record = strings.Split(line, "\t")
+	if r.Unescape {
+		for i, field := range record {
+			record[i] = tsvUnescape(field)
+		}
+	}
+	return record, err
+}
+
+// tsvUnescape reverses tsvEscaper.
+func tsvUnescape(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var b strings.Builder
+	b.Grow(len(field))
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c == '\\' && i+1 < len(field) {
+			switch field[i+1] {
+			case '\\':
+				c = '\\'
+			case 't':
+				c = '\t'
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			default:
+				b.WriteByte(c)
+				continue
+			}
+			i++
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
 }
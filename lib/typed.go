@@ -0,0 +1,358 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/oschwald/maxminddb-golang/v2/mmdbdata"
+)
+
+// typedValue is a value decoded along with its exact MMDB type, which
+// decoding into `any` loses, e.g. uint16 and uint32 both become uint64.
+//
+// The value is one of the mmdbtype types, so it can be written back into a
+// database as is. A missing value is nil.
+type typedValue struct {
+	v mmdbtype.DataType
+}
+
+func (t *typedValue) UnmarshalMaxMindDB(d *mmdbdata.Decoder) error {
+	v, err := decodeTyped(d)
+	if err != nil {
+		return err
+	}
+	t.v = v
+	return nil
+}
+
+// decodeTyped decodes the value at the current position of d.
+func decodeTyped(d *mmdbdata.Decoder) (mmdbtype.DataType, error) {
+	kind, err := d.PeekKind()
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case mmdbdata.KindString:
+		v, err := d.ReadString()
+		return mmdbtype.String(v), err
+	case mmdbdata.KindBytes:
+		v, err := d.ReadBytes()
+		return mmdbtype.Bytes(v), err
+	case mmdbdata.KindFloat32:
+		v, err := d.ReadFloat32()
+		return mmdbtype.Float32(v), err
+	case mmdbdata.KindFloat64:
+		v, err := d.ReadFloat64()
+		return mmdbtype.Float64(v), err
+	case mmdbdata.KindBool:
+		v, err := d.ReadBool()
+		return mmdbtype.Bool(v), err
+	case mmdbdata.KindInt32:
+		v, err := d.ReadInt32()
+		return mmdbtype.Int32(v), err
+	case mmdbdata.KindUint16:
+		v, err := d.ReadUint16()
+		return mmdbtype.Uint16(v), err
+	case mmdbdata.KindUint32:
+		v, err := d.ReadUint32()
+		return mmdbtype.Uint32(v), err
+	case mmdbdata.KindUint64:
+		v, err := d.ReadUint64()
+		return mmdbtype.Uint64(v), err
+	case mmdbdata.KindUint128:
+		hi, lo, err := d.ReadUint128()
+		if err != nil {
+			return nil, err
+		}
+		v := new(big.Int).SetUint64(hi)
+		v.Lsh(v, 64).Or(v, new(big.Int).SetUint64(lo))
+		return (*mmdbtype.Uint128)(v), nil
+	case mmdbdata.KindMap:
+		entries, size, err := d.ReadMap()
+		if err != nil {
+			return nil, err
+		}
+		m := make(mmdbtype.Map, size)
+		for key, err := range entries {
+			if err != nil {
+				return nil, err
+			}
+			// the key is only valid until the next iteration.
+			k := mmdbtype.String(key)
+			v, err := decodeTyped(d)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case mmdbdata.KindSlice:
+		elems, size, err := d.ReadSlice()
+		if err != nil {
+			return nil, err
+		}
+		s := make(mmdbtype.Slice, 0, size)
+		for err := range elems {
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeTyped(d)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unexpected value of kind %v", kind)
+	}
+}
+
+// decodeTypedRecord decodes the record of result with its exact types. The
+// record of a network without data is an empty map.
+func decodeTypedRecord(result maxminddb.Result) (mmdbtype.Map, error) {
+	var t typedValue
+	if err := result.Decode(&t); err != nil {
+		return nil, invalidDBError(fmt.Errorf("failed to decode record: %w", err))
+	}
+	if t.v == nil {
+		return mmdbtype.Map{}, nil
+	}
+	record, ok := t.v.(mmdbtype.Map)
+	if !ok {
+		return nil, invalidDBError(fmt.Errorf("record is a %T, not a map", t.v))
+	}
+	return record, nil
+}
+
+// decodeTypedFields is like decodeFields, but keeps the exact types of the
+// values.
+func decodeTypedFields(result maxminddb.Result, fields []exportField) (mmdbtype.Map, error) {
+	record := make(mmdbtype.Map, len(fields))
+	for _, field := range fields {
+		var t typedValue
+		if err := result.DecodePath(&t, field.path...); err != nil {
+			var invalidErr maxminddb.InvalidDatabaseError
+			if errors.As(err, &invalidErr) {
+				return nil, invalidDBError(fmt.Errorf("failed to decode record: %w", err))
+			}
+			continue
+		}
+		if t.v != nil {
+			record[mmdbtype.String(field.name)] = t.v
+		}
+	}
+	return record, nil
+}
+
+// typedToAny converts a typed value to the plain Go value decoding it into
+// `any` would have given.
+func typedToAny(v mmdbtype.DataType) any {
+	switch v := v.(type) {
+	case mmdbtype.String:
+		return string(v)
+	case mmdbtype.Bytes:
+		return []byte(v)
+	case mmdbtype.Float32:
+		return float32(v)
+	case mmdbtype.Float64:
+		return float64(v)
+	case mmdbtype.Bool:
+		return bool(v)
+	case mmdbtype.Int32:
+		return int(v)
+	case mmdbtype.Uint16:
+		return uint64(v)
+	case mmdbtype.Uint32:
+		return uint64(v)
+	case mmdbtype.Uint64:
+		return uint64(v)
+	case *mmdbtype.Uint128:
+		return (*big.Int)(v)
+	case mmdbtype.Map:
+		m := make(map[string]any, len(v))
+		for k, fv := range v {
+			m[string(k)] = typedToAny(fv)
+		}
+		return m
+	case mmdbtype.Slice:
+		s := make([]any, len(v))
+		for i, ev := range v {
+			s[i] = typedToAny(ev)
+		}
+		return s
+	}
+	return nil
+}
+
+// typedToStr converts a typed value to a string the way CSV export does:
+// strings as is, and other values as JSON.
+func typedToStr(v mmdbtype.DataType) string {
+	if s, ok := v.(mmdbtype.String); ok {
+		return string(s)
+	}
+	out, _ := json.Marshal(typedToAny(v))
+	return string(out)
+}
+
+// typedRecordCache decodes records with their exact types, caching them by
+// their offset in the data section.
+type typedRecordCache struct {
+	recs *lruCache[mmdbtype.Map]
+
+	// fields, if set, are the only fields decoded.
+	fields []exportField
+}
+
+func newTypedRecordCache(fields []exportField, cacheSize int) *typedRecordCache {
+	return &typedRecordCache{
+		recs:   newLRUCache[mmdbtype.Map](cacheSize),
+		fields: fields,
+	}
+}
+
+// decode returns the record of result, and whether it was already cached.
+func (c *typedRecordCache) decode(result maxminddb.Result) (mmdbtype.Map, bool, error) {
+	offset := result.Offset()
+	if cached, ok := c.recs.get(offset); ok {
+		return cached, true, nil
+	}
+
+	var record mmdbtype.Map
+	var err error
+	if c.fields != nil {
+		record, err = decodeTypedFields(result, c.fields)
+	} else {
+		record, err = decodeTypedRecord(result)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	c.recs.add(offset, record)
+	return record, false, nil
+}
+
+// fieldType is the type of a field, or of a value nested in one, merged over
+// the values of all records.
+type fieldType struct {
+	// kind is the MMDB type of the values, e.g. "uint32" or "map", or
+	// "mixed" if they don't share one, in which case they're written as
+	// strings.
+	kind string
+
+	// fields are the types of the fields of a map.
+	fields map[string]*fieldType
+
+	// elem is the type of the elements of a slice; nil if all slices were
+	// empty.
+	elem *fieldType
+}
+
+// mmdbKind returns the name of the MMDB type of v.
+func mmdbKind(v mmdbtype.DataType) string {
+	switch v.(type) {
+	case mmdbtype.String:
+		return "string"
+	case mmdbtype.Bytes:
+		return "bytes"
+	case mmdbtype.Float32:
+		return "float32"
+	case mmdbtype.Float64:
+		return "float64"
+	case mmdbtype.Bool:
+		return "bool"
+	case mmdbtype.Int32:
+		return "int32"
+	case mmdbtype.Uint16:
+		return "uint16"
+	case mmdbtype.Uint32:
+		return "uint32"
+	case mmdbtype.Uint64:
+		return "uint64"
+	case *mmdbtype.Uint128:
+		return "uint128"
+	case mmdbtype.Map:
+		return "map"
+	case mmdbtype.Slice:
+		return "slice"
+	}
+	return "mixed"
+}
+
+// widerKinds are the kinds whose values can be widened into another kind
+// without loss, along with the kind they widen to.
+var widerKinds = map[[2]string]string{
+	{"uint16", "uint32"}:   "uint32",
+	{"uint16", "uint64"}:   "uint64",
+	{"uint32", "uint64"}:   "uint64",
+	{"float32", "float64"}: "float64",
+}
+
+// mergeFieldType returns ft, which may be nil, merged with the type of v.
+func mergeFieldType(ft *fieldType, v mmdbtype.DataType) *fieldType {
+	kind := mmdbKind(v)
+	if ft == nil {
+		ft = &fieldType{kind: kind}
+		if kind == "map" {
+			ft.fields = make(map[string]*fieldType)
+		}
+	} else if ft.kind != kind {
+		if wider, ok := widerKinds[[2]string{ft.kind, kind}]; ok {
+			ft.kind = wider
+		} else if _, ok := widerKinds[[2]string{kind, ft.kind}]; !ok {
+			ft.kind = "mixed"
+		}
+		return ft
+	}
+
+	switch v := v.(type) {
+	case mmdbtype.Map:
+		for k, fv := range v {
+			ft.fields[string(k)] = mergeFieldType(ft.fields[string(k)], fv)
+		}
+	case mmdbtype.Slice:
+		for _, ev := range v {
+			ft.elem = mergeFieldType(ft.elem, ev)
+		}
+	}
+	return ft
+}
+
+// discoverFieldTypes does a pass over the networks selected by src and
+// returns the types of the fields of their records, merged.
+//
+// The decoded records are left in cache for the export pass to reuse.
+func discoverFieldTypes(
+	ctx context.Context,
+	src *exportSource,
+	cache *typedRecordCache,
+	prog *progress,
+) (map[string]*fieldType, error) {
+	prog.Phase("discover schema", "networks", int64(src.db.Metadata.NodeCount))
+	defer prog.Stop()
+
+	types := make(map[string]*fieldType)
+	err := src.walk(ctx, prog, func(_ netip.Prefix, result maxminddb.Result) error {
+		record, cached, err := cache.decode(result)
+		if err != nil || cached {
+			return err
+		}
+		for k, v := range record {
+			types[string(k)] = mergeFieldType(types[string(k)], v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	prog.Done()
+
+	return types, nil
+}
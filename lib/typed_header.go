@@ -0,0 +1,420 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// A typed header annotates each column of CSV/TSV output with the MMDB type
+// of its values, e.g. "asn:uint32" or "is_anycast:bool", so that importing
+// it restores the types. Nested values have the types of their fields and
+// elements, e.g. "country:map{geoname_id:uint32,iso_code:string}" or
+// "tags:slice[string]", and are written as JSON. Fields whose values don't
+// share a type are annotated as "mixed", and imported as strings.
+//
+// Fields missing from a record are written as empty values, so empty
+// strings are written quoted as JSON, as are strings beginning with a quote
+// to tell them apart.
+
+// typedKinds are the kinds of a typed header.
+var typedKinds = []string{
+	"string", "bytes", "float32", "float64", "bool", "int32", "uint16",
+	"uint32", "uint64", "uint128", "map", "slice", "mixed",
+}
+
+// annotation returns the annotation of values of type ft in a typed header.
+func (ft *fieldType) annotation() string {
+	switch ft.kind {
+	case "map":
+		names := slices.Sorted(func(yield func(string) bool) {
+			for name := range ft.fields {
+				if !yield(name) {
+					return
+				}
+			}
+		})
+		fields := make([]string, len(names))
+		for i, name := range names {
+			fields[i] = annotationName(name) + ":" + ft.fields[name].annotation()
+		}
+		return "map{" + strings.Join(fields, ",") + "}"
+	case "slice":
+		if ft.elem == nil {
+			return "slice[]"
+		}
+		return "slice[" + ft.elem.annotation() + "]"
+	}
+	return ft.kind
+}
+
+// annotationName returns the name of a map field in an annotation, quoted as
+// JSON if it has characters of the annotation syntax.
+func annotationName(name string) string {
+	if name == "" || strings.ContainsAny(name, `{}[],:"\`) {
+		quoted, _ := json.Marshal(name)
+		return string(quoted)
+	}
+	return name
+}
+
+// typeAtPath returns the type of the value at the flattened path of a field
+// of types, or nil if it's unknown.
+func typeAtPath(types map[string]*fieldType, path []string) *fieldType {
+	ft := types[path[0]]
+	for _, k := range path[1:] {
+		if ft == nil {
+			return nil
+		}
+		switch ft.kind {
+		case "map":
+			ft = ft.fields[k]
+		case "slice":
+			ft = ft.elem
+		default:
+			return nil
+		}
+	}
+	return ft
+}
+
+// typedHeaderTypes returns the annotations of the columns of hdrKeys, from
+// the types of the fields; columns of unknown type, which are imported as
+// strings, have none.
+func typedHeaderTypes(hdrKeys []string, types map[string]*fieldType, flatten bool) []string {
+	annotations := make([]string, len(hdrKeys))
+	for i, k := range hdrKeys {
+		// fields selected by path aren't flattened further.
+		ft := types[k]
+		if ft == nil && flatten {
+			ft = typeAtPath(types, strings.Split(k, flattenSep))
+		}
+		if ft != nil {
+			annotations[i] = ft.annotation()
+		}
+	}
+	return annotations
+}
+
+// typedHeader returns the cells of a header of keys annotated with types,
+// which are either nil or one per key.
+func typedHeader(keys []string, types []string) []string {
+	hdr := slices.Clone(keys)
+	for i, typ := range types {
+		if typ != "" {
+			hdr[i] += ":" + typ
+		}
+	}
+	return hdr
+}
+
+// parseTypedColumn returns the name and type of a column of a typed header.
+// A column without a valid annotation has a nil type.
+func parseTypedColumn(col string) (string, *fieldType) {
+	for i := 0; i < len(col); i++ {
+		if col[i] != ':' {
+			continue
+		}
+		if ft, err := parseAnnotation(col[i+1:]); err == nil {
+			return col[:i], ft
+		}
+	}
+	return col, nil
+}
+
+// parseAnnotation parses the annotation of a column of a typed header.
+func parseAnnotation(s string) (*fieldType, error) {
+	p := annotationParser{s: s}
+	ft, err := p.parseType()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(s) {
+		return nil, fmt.Errorf("unexpected %q after type", s[p.pos:])
+	}
+	return ft, nil
+}
+
+// annotationParser parses annotations by recursive descent.
+type annotationParser struct {
+	s   string
+	pos int
+}
+
+func (p *annotationParser) consume(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *annotationParser) parseType() (*fieldType, error) {
+	end := p.pos
+	for end < len(p.s) && p.s[end] >= 'a' && p.s[end] <= 'z' || end < len(p.s) && p.s[end] >= '0' && p.s[end] <= '9' {
+		end++
+	}
+	kind := p.s[p.pos:end]
+	if !slices.Contains(typedKinds, kind) {
+		return nil, fmt.Errorf("unknown type %q", kind)
+	}
+	p.pos = end
+	ft := &fieldType{kind: kind}
+
+	switch kind {
+	case "map":
+		ft.fields = make(map[string]*fieldType)
+		if !p.consume('{') {
+			return nil, errors.New("expected { after map")
+		}
+		for !p.consume('}') {
+			if len(ft.fields) > 0 && !p.consume(',') {
+				return nil, errors.New("expected , between map fields")
+			}
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			if !p.consume(':') {
+				return nil, fmt.Errorf("expected : after map field %q", name)
+			}
+			field, err := p.parseType()
+			if err != nil {
+				return nil, err
+			}
+			ft.fields[name] = field
+		}
+	case "slice":
+		if !p.consume('[') {
+			return nil, errors.New("expected [ after slice")
+		}
+		if p.consume(']') {
+			break
+		}
+		elem, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		ft.elem = elem
+		if !p.consume(']') {
+			return nil, errors.New("expected ] after slice elements")
+		}
+	}
+	return ft, nil
+}
+
+func (p *annotationParser) parseName() (string, error) {
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		dec := json.NewDecoder(strings.NewReader(p.s[p.pos:]))
+		var name string
+		if err := dec.Decode(&name); err != nil {
+			return "", fmt.Errorf("invalid quoted map field: %w", err)
+		}
+		p.pos += int(dec.InputOffset())
+		return name, nil
+	}
+	end := strings.IndexByte(p.s[p.pos:], ':')
+	if end <= 0 {
+		return "", errors.New("expected a map field name")
+	}
+	name := p.s[p.pos : p.pos+end]
+	p.pos += end
+	return name, nil
+}
+
+// mapInterfaceToLosslessStr is like mapInterfaceToStr, but converts values
+// to strings from which values of their MMDB type can be parsed back
+// exactly; see losslessStr.
+func mapInterfaceToLosslessStr(m map[string]any) map[string]string {
+	retVal := make(map[string]string, len(m))
+	for key, value := range m {
+		retVal[key] = losslessStr(value)
+	}
+	return retVal
+}
+
+// losslessStr converts a decoded value to a string in a column of a typed
+// header: numbers with all their precision, bytes as base64, maps and
+// arrays as JSON, and strings as is, unless they're empty or begin with a
+// quote, as JSON.
+func losslessStr(v any) string {
+	switch v := v.(type) {
+	case string:
+		if v == "" || v[0] == '"' {
+			quoted, _ := json.Marshal(v)
+			return string(quoted)
+		}
+		return v
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case int:
+		return strconv.Itoa(v)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case *big.Int:
+		return v.String()
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// typedFromStr parses a value of type ft from a column of a typed header. A
+// nil or mixed type is a string, which is unquoted if it's quoted as JSON,
+// unless the type is nil.
+func typedFromStr(ft *fieldType, s string) (mmdbtype.DataType, error) {
+	if ft == nil {
+		return mmdbtype.String(s), nil
+	}
+	switch ft.kind {
+	case "string", "mixed":
+		if strings.HasPrefix(s, `"`) {
+			var v string
+			if err := json.Unmarshal([]byte(s), &v); err != nil {
+				return nil, fmt.Errorf("invalid quoted string %s", s)
+			}
+			return mmdbtype.String(v), nil
+		}
+		return mmdbtype.String(s), nil
+	case "bytes":
+		v, err := base64.StdEncoding.DecodeString(s)
+		return mmdbtype.Bytes(v), err
+	case "float32":
+		v, err := strconv.ParseFloat(s, 32)
+		return mmdbtype.Float32(v), err
+	case "float64":
+		v, err := strconv.ParseFloat(s, 64)
+		return mmdbtype.Float64(v), err
+	case "bool":
+		v, err := strconv.ParseBool(s)
+		return mmdbtype.Bool(v), err
+	case "int32":
+		v, err := strconv.ParseInt(s, 10, 32)
+		return mmdbtype.Int32(v), err
+	case "uint16":
+		v, err := strconv.ParseUint(s, 10, 16)
+		return mmdbtype.Uint16(v), err
+	case "uint32":
+		v, err := strconv.ParseUint(s, 10, 32)
+		return mmdbtype.Uint32(v), err
+	case "uint64":
+		v, err := strconv.ParseUint(s, 10, 64)
+		return mmdbtype.Uint64(v), err
+	case "uint128":
+		v, ok := new(big.Int).SetString(s, 10)
+		if !ok || v.Sign() < 0 || v.BitLen() > 128 {
+			return nil, fmt.Errorf("invalid uint128 %q", s)
+		}
+		return (*mmdbtype.Uint128)(v), nil
+	}
+
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return typedFromJSON(ft, v)
+}
+
+// typedFromJSON converts a value decoded from JSON with json.Number numbers
+// to type ft. Values of nil or mixed type are converted after their JSON
+// type: numbers to uint64 if they're unsigned integers, int32 if they're
+// small enough negative ones, and float64 otherwise.
+func typedFromJSON(ft *fieldType, v any) (mmdbtype.DataType, error) {
+	if ft != nil && ft.kind != "mixed" {
+		switch v := v.(type) {
+		case map[string]any:
+			if ft.kind != "map" {
+				break
+			}
+			m := make(mmdbtype.Map, len(v))
+			for k, fv := range v {
+				tv, err := typedFromJSON(ft.fields[k], fv)
+				if err != nil {
+					return nil, err
+				}
+				m[mmdbtype.String(k)] = tv
+			}
+			return m, nil
+		case []any:
+			if ft.kind != "slice" {
+				break
+			}
+			s := make(mmdbtype.Slice, len(v))
+			for i, ev := range v {
+				tv, err := typedFromJSON(ft.elem, ev)
+				if err != nil {
+					return nil, err
+				}
+				s[i] = tv
+			}
+			return s, nil
+		case json.Number:
+			return typedFromStr(ft, v.String())
+		case string:
+			return typedFromStr(ft, v)
+		case bool:
+			if ft.kind == "bool" {
+				return mmdbtype.Bool(v), nil
+			}
+		}
+		return nil, fmt.Errorf("%v doesn't match type %v", v, ft.kind)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(mmdbtype.Map, len(v))
+		for k, fv := range v {
+			tv, err := typedFromJSON(nil, fv)
+			if err != nil {
+				return nil, err
+			}
+			m[mmdbtype.String(k)] = tv
+		}
+		return m, nil
+	case []any:
+		s := make(mmdbtype.Slice, len(v))
+		for i, ev := range v {
+			tv, err := typedFromJSON(nil, ev)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = tv
+		}
+		return s, nil
+	case json.Number:
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return mmdbtype.Uint64(u), nil
+		}
+		if i, err := strconv.ParseInt(v.String(), 10, 32); err == nil {
+			return mmdbtype.Int32(i), nil
+		}
+		f, err := v.Float64()
+		if err != nil || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("invalid number %v", v)
+		}
+		return mmdbtype.Float64(f), nil
+	case string:
+		return mmdbtype.String(v), nil
+	case bool:
+		return mmdbtype.Bool(v), nil
+	}
+	return nil, fmt.Errorf("unexpected JSON value %v", v)
+}
@@ -2,12 +2,16 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
+	"net/netip"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/edsrzf/mmap-go"
 )
@@ -48,6 +52,58 @@ func longestStrInStringSlice(s []string) string {
 	return *longest
 }
 
+// parsePrefixOrAddr parses a CIDR, or a single IP as the network of just
+// that IP.
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(s)
+}
+
+// prefixLastAddr returns the last address in prefix.
+func prefixLastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// rangeToPrefixes returns the fewest prefixes covering exactly the addresses
+// from start to end, in order.
+func rangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		// the largest prefix starting at start which doesn't pass end.
+		var prefix netip.Prefix
+		for bits := 0; bits <= start.BitLen(); bits++ {
+			prefix = netip.PrefixFrom(start, bits)
+			if prefix.Masked().Addr() == start && prefixLastAddr(prefix).Compare(end) <= 0 {
+				break
+			}
+		}
+		prefixes = append(prefixes, prefix)
+
+		last := prefixLastAddr(prefix)
+		if last.Compare(end) >= 0 {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+// addrToDecimalStr returns addr as a decimal integer.
+func addrToDecimalStr(addr netip.Addr) string {
+	return new(big.Int).SetBytes(addr.AsSlice()).String()
+}
+
 func mapInterfaceToStr(m map[string]interface{}) map[string]string {
 	retVal := make(map[string]string)
 	for key, value := range m {
@@ -150,7 +206,7 @@ type TypeSizes struct {
 	FloatSize             int64 `json:"float_size"`
 }
 
-func traverseDataSection(mmdbFile string, startOffset int64, endOffset int64) (TypeSizes, error) {
+func traverseDataSection(ctx context.Context, mmdbFile string, startOffset int64, endOffset int64, prog *progress) (TypeSizes, error) {
 	file, err := os.Open(mmdbFile)
 	if err != nil {
 		return TypeSizes{}, fmt.Errorf("couldn't open mmdb file: %w", err)
@@ -165,8 +221,16 @@ func traverseDataSection(mmdbFile string, startOffset int64, endOffset int64) (T
 
 	var typeSizes TypeSizes
 
+	prog.Phase("scan", "bytes", endOffset-startOffset)
+	defer prog.Stop()
+
 	// Read and process bytes until the end offset is reached.
 	for offset := startOffset; offset < endOffset; {
+		if err := ctxError(ctx); err != nil {
+			return TypeSizes{}, err
+		}
+		prog.Set(offset - startOffset)
+
 		var controlByte [1]byte
 		_, err := file.Read(controlByte[:])
 		if err != nil {
@@ -264,6 +328,7 @@ func traverseDataSection(mmdbFile string, startOffset int64, endOffset int64) (T
 			}
 		}
 	}
+	prog.Done()
 
 	return typeSizes, nil
 }
@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"context"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// Verify checks that db is a valid mmdb database, returning an error
+// describing the first problem found otherwise. It stops with an
+// ExitInterrupted error once ctx is cancelled while walking the search tree,
+// which takes most of the time of verifying it.
+func Verify(ctx context.Context, db *maxminddb.Reader) error {
+	for result := range db.Networks() {
+		if err := ctxError(ctx); err != nil {
+			return err
+		}
+		if err := result.Err(); err != nil {
+			return invalidDBError(err)
+		}
+	}
+	if err := ctxError(ctx); err != nil {
+		return err
+	}
+
+	// the metadata, the data section and its separator.
+	if err := db.Verify(); err != nil {
+		return invalidDBError(err)
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// whereExpr is a parsed predicate on record fields, as given to
+// `export --where`, e.g. `country == "US" && asn != 0`.
+//
+// The grammar is:
+//
+//	expr  = and { "||" and }
+//	and   = unary { "&&" unary }
+//	unary = "!" unary | "(" expr ")" | cmp
+//	cmp   = path [ op literal ]
+//	op    = "==" | "!=" | "<" | "<=" | ">" | ">="
+//
+// A path is a field name, with nested fields and array elements separated by
+// ".", e.g. `location.latitude` or `subdivisions.0.iso_code`. A literal is a
+// quoted string, a number, true, false or null. A path on its own is true
+// if the field exists and isn't empty, zero or false.
+type whereExpr interface {
+	eval(record map[string]any) bool
+}
+
+type whereOr struct{ l, r whereExpr }
+
+func (e whereOr) eval(record map[string]any) bool {
+	return e.l.eval(record) || e.r.eval(record)
+}
+
+type whereAnd struct{ l, r whereExpr }
+
+func (e whereAnd) eval(record map[string]any) bool {
+	return e.l.eval(record) && e.r.eval(record)
+}
+
+type whereNot struct{ e whereExpr }
+
+func (e whereNot) eval(record map[string]any) bool {
+	return !e.e.eval(record)
+}
+
+type whereTruthy struct{ path []string }
+
+func (e whereTruthy) eval(record map[string]any) bool {
+	v, ok := lookupPath(record, e.path)
+	if !ok {
+		return false
+	}
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case map[string]any:
+		return len(v) > 0
+	case []any:
+		return len(v) > 0
+	}
+	if n, ok := whereNumber(v); ok {
+		return n.cmp(whereNum{r: new(big.Rat), f: 0}) != 0
+	}
+	return true
+}
+
+type whereCmp struct {
+	path []string
+	op   string
+	lit  any // string, whereNum, bool or nil.
+}
+
+func (e whereCmp) eval(record map[string]any) bool {
+	v, ok := lookupPath(record, e.path)
+	if !ok || v == nil {
+		if e.lit == nil {
+			return e.op == "=="
+		}
+		return e.op == "!="
+	}
+	if e.lit == nil {
+		return e.op == "!="
+	}
+
+	// c is the comparison of v against the literal: -1, 0 or 1. values of
+	// another type than the literal are only ever unequal to it.
+	var c int
+	switch lit := e.lit.(type) {
+	case whereNum:
+		n, ok := whereNumber(v)
+		if !ok {
+			return e.op == "!="
+		}
+		c = n.cmp(lit)
+	case bool:
+		b, ok := v.(bool)
+		if !ok {
+			if s, isStr := v.(string); isStr {
+				b, ok = s == "true", s == "true" || s == "false"
+			}
+		}
+		if !ok {
+			return e.op == "!="
+		}
+		if b != lit {
+			c = 1
+		}
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		c = strings.Compare(s, lit)
+	}
+
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default: // ">="
+		return c >= 0
+	}
+}
+
+// whereNum is a number of a record or a literal. Integers of records are
+// exact, as are literals, which also have their float value; floats of
+// records only have that.
+type whereNum struct {
+	r *big.Rat // nil for floats of records.
+	f float64
+}
+
+// cmp compares n to the literal lit: exactly for integers, and as floats
+// for floats, so that e.g. a float field compares equal to a literal of the
+// same decimal.
+func (n whereNum) cmp(lit whereNum) int {
+	if n.r != nil {
+		return n.r.Cmp(lit.r)
+	}
+	switch {
+	case n.f < lit.f:
+		return -1
+	case n.f > lit.f:
+		return 1
+	}
+	return 0
+}
+
+// float returns n as a float.
+func (n whereNum) float() float64 {
+	if n.r != nil {
+		f, _ := n.r.Float64()
+		return f
+	}
+	return n.f
+}
+
+// whereNumber converts a decoded value to a number. Strings are parsed, as
+// imported databases store all values as strings, as integers if they are
+// ones.
+func whereNumber(v any) (whereNum, bool) {
+	switch v := v.(type) {
+	case float64:
+		return whereNum{f: v}, true
+	case float32:
+		return whereNum{f: float64(v)}, true
+	case int:
+		return whereNum{r: new(big.Rat).SetInt64(int64(v))}, true
+	case int32:
+		return whereNum{r: new(big.Rat).SetInt64(int64(v))}, true
+	case uint64:
+		return whereNum{r: new(big.Rat).SetUint64(v)}, true
+	case *big.Int:
+		return whereNum{r: new(big.Rat).SetInt(v)}, true
+	case string:
+		if i, ok := new(big.Int).SetString(v, 10); ok {
+			return whereNum{r: new(big.Rat).SetInt(i)}, true
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		return whereNum{f: f}, err == nil
+	}
+	return whereNum{}, false
+}
+
+// lookupPath returns the value at path within record.
+func lookupPath(record map[string]any, path []string) (any, bool) {
+	var v any = record
+	for _, k := range path {
+		switch node := v.(type) {
+		case map[string]any:
+			elem, ok := node[k]
+			if !ok {
+				return nil, false
+			}
+			v = elem
+		case []any:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// parseWhere parses a predicate on record fields; see whereExpr.
+func parseWhere(s string) (whereExpr, error) {
+	p := &whereParser{s: s}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return e, nil
+}
+
+type whereParser struct {
+	s   string
+	pos int
+}
+
+func (p *whereParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("invalid where expression at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *whereParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes tok if it's next.
+func (p *whereParser) accept(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *whereParser) parseOr() (whereExpr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = whereOr{l, r}
+	}
+	return l, nil
+}
+
+func (p *whereParser) parseAnd() (whereExpr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = whereAnd{l, r}
+	}
+	return l, nil
+}
+
+func (p *whereParser) parseUnary() (whereExpr, error) {
+	if p.accept("!") {
+		if p.accept("=") {
+			return nil, p.errorf("expected a field before \"!=\"")
+		}
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return whereNot{e}, nil
+	}
+	if p.accept("(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("expected \")\"")
+		}
+		return e, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *whereParser) parseCmp() (whereExpr, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && isWherePathChar(p.s[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		if p.pos == len(p.s) {
+			return nil, p.errorf("unexpected end, expected a field")
+		}
+		return nil, p.errorf("expected a field, got %q", p.s[p.pos:])
+	}
+	path := strings.Split(p.s[start:p.pos], ".")
+	for _, k := range path {
+		if k == "" {
+			return nil, p.errorf("invalid field %q", p.s[start:p.pos])
+		}
+	}
+
+	var op string
+	for _, candidate := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.accept(candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return whereTruthy{path}, nil
+	}
+
+	lit, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if op != "==" && op != "!=" {
+		if _, ok := lit.(whereNum); !ok {
+			if _, ok := lit.(string); !ok {
+				return nil, p.errorf("%q needs a number or string", op)
+			}
+		}
+	}
+	return whereCmp{path: path, op: op, lit: lit}, nil
+}
+
+func isWherePathChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *whereParser) parseLiteral() (any, error) {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return nil, p.errorf("unexpected end, expected a value")
+	}
+
+	// quoted string.
+	if q := p.s[p.pos]; q == '"' || q == '\'' {
+		var sb strings.Builder
+		for i := p.pos + 1; i < len(p.s); i++ {
+			c := p.s[i]
+			if c == '\\' && i+1 < len(p.s) {
+				i++
+				sb.WriteByte(p.s[i])
+				continue
+			}
+			if c == q {
+				p.pos = i + 1
+				return sb.String(), nil
+			}
+			sb.WriteByte(c)
+		}
+		return nil, p.errorf("unterminated string")
+	}
+
+	// number or keyword.
+	start := p.pos
+	for p.pos < len(p.s) && (isWherePathChar(p.s[p.pos]) || p.s[p.pos] == '+') {
+		p.pos++
+	}
+	word := p.s[start:p.pos]
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	// ParseFloat also accepts NaN and infinities, which aren't values of
+	// records.
+	f, err := strconv.ParseFloat(word, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		p.pos = start
+		return nil, p.errorf("expected a value, got %q", p.s[start:])
+	}
+	r, ok := new(big.Rat).SetString(word)
+	if !ok {
+		r = new(big.Rat).SetFloat64(f)
+	}
+	return whereNum{r: r, f: f}, nil
+}
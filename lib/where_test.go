@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestParseWhere(t *testing.T) {
+	a, b, c := whereTruthy{[]string{"a"}}, whereTruthy{[]string{"b"}}, whereTruthy{[]string{"c"}}
+	tests := []struct {
+		expr     string
+		expected whereExpr
+		err      string
+	}{
+		// precedence.
+		{expr: `a || b && c`, expected: whereOr{a, whereAnd{b, c}}},
+		{expr: `a && b || c`, expected: whereOr{whereAnd{a, b}, c}},
+		{expr: `(a || b) && c`, expected: whereAnd{whereOr{a, b}, c}},
+		{expr: `!a && b`, expected: whereAnd{whereNot{a}, b}},
+		{expr: `!(a && b)`, expected: whereNot{whereAnd{a, b}}},
+		{expr: `a || b || c`, expected: whereOr{whereOr{a, b}, c}},
+		{
+			expr:     `x.y >= 1.5 && z != null`,
+			expected: whereAnd{whereCmp{[]string{"x", "y"}, ">=", whereNum{big.NewRat(3, 2), 1.5}}, whereCmp{[]string{"z"}, "!=", nil}},
+		},
+
+		// quoting.
+		{expr: `a == "US"`, expected: whereCmp{[]string{"a"}, "==", "US"}},
+		{expr: `a == 'it''`, err: `invalid where expression at offset 9: unexpected "'"`},
+		{expr: `a == "say \"hi\""`, expected: whereCmp{[]string{"a"}, "==", `say "hi"`}},
+		{expr: `a == 'it\'s'`, expected: whereCmp{[]string{"a"}, "==", "it's"}},
+		{expr: `a == "&& ||"`, expected: whereCmp{[]string{"a"}, "==", "&& ||"}},
+		{expr: `a == "true"`, expected: whereCmp{[]string{"a"}, "==", "true"}},
+		{expr: `a == true`, expected: whereCmp{[]string{"a"}, "==", true}},
+
+		// errors and their positions.
+		{expr: ``, err: `invalid where expression at offset 0: unexpected end, expected a field`},
+		{expr: `a ==`, err: `invalid where expression at offset 4: unexpected end, expected a value`},
+		{expr: `a == "US`, err: `invalid where expression at offset 5: unterminated string`},
+		{expr: `(a && b`, err: `invalid where expression at offset 7: expected ")"`},
+		{expr: `a && == 1`, err: `invalid where expression at offset 5: expected a field, got "== 1"`},
+		{expr: `a..b`, err: `invalid where expression at offset 4: invalid field "a..b"`},
+		{expr: `!= 1`, err: `invalid where expression at offset 2: expected a field before "!="`},
+		{expr: `a < true`, err: `invalid where expression at offset 8: "<" needs a number or string`},
+		{expr: `a == b`, err: `invalid where expression at offset 5: expected a value, got "b"`},
+		{expr: `a b`, err: `invalid where expression at offset 2: unexpected "b"`},
+		{expr: `a > NaN`, err: `invalid where expression at offset 4: expected a value, got "NaN"`},
+		{expr: `a < Inf`, err: `invalid where expression at offset 4: expected a value, got "Inf"`},
+		{expr: `a > -infinity`, err: `invalid where expression at offset 4: expected a value, got "-infinity"`},
+		{expr: `a > 1e999`, err: `invalid where expression at offset 4: expected a value, got "1e999"`},
+	}
+	for _, tt := range tests {
+		e, err := parseWhere(tt.expr)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: expected error %q, got %v", tt.expr, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.expr, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(e, tt.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tt.expr, tt.expected, e)
+		}
+	}
+}
+
+func TestWhereCmp_Numbers(t *testing.T) {
+	record := map[string]any{
+		"asn_id":   uint64(9007199254740993),
+		"huge":     new(big.Int).Lsh(big.NewInt(1), 100),
+		"str_id":   "9007199254740993",
+		"delta":    int32(-5),
+		"latitude": 40.7128,
+		"ratio":    float32(0.5),
+	}
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		// integers compare exactly, beyond the precision of floats.
+		{`asn_id == 9007199254740993`, true},
+		{`asn_id == 9007199254740992`, false},
+		{`asn_id > 9007199254740992`, true},
+		{`str_id == 9007199254740993`, true},
+		{`str_id != 9007199254740992`, true},
+		{`huge == 1267650600228229401496703205376`, true},
+		{`huge > 1267650600228229401496703205375`, true},
+		{`huge < 1.2676506002282294e30`, false},
+		{`delta < -4.5`, true},
+		{`delta == -5.0`, true},
+
+		// floats compare as floats.
+		{`latitude == 40.7128`, true},
+		{`latitude > 40.7`, true},
+		{`ratio == 0.5`, true},
+		{`ratio == 5e-1`, true},
+	}
+	for _, tt := range tests {
+		e, err := parseWhere(tt.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.expr, err.Error())
+			continue
+		}
+		if got := e.eval(record); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.expected, got)
+		}
+	}
+}
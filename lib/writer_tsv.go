@@ -7,10 +7,18 @@ import (
 )
 
 type TsvWriter struct {
+	// Escape writes backslashes, tabs, newlines and carriage returns in
+	// fields as \\, \t, \n and \r, so that a field never spans columns or
+	// lines. TsvReader.Unescape reverses it.
+	Escape bool
+
 	bw  *bufio.Writer
 	err error
 }
 
+// tsvEscaper escapes TSV fields; see TsvWriter.Escape.
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
 func NewTsvWriter(w io.Writer) *TsvWriter {
 	return &TsvWriter{
 		bw: bufio.NewWriter(w),
@@ -18,6 +26,13 @@ func NewTsvWriter(w io.Writer) *TsvWriter {
 }
 
 func (w *TsvWriter) Write(record []string) error {
+	if w.Escape {
+		escaped := make([]string, len(record))
+		for i, field := range record {
+			escaped[i] = tsvEscaper.Replace(field)
+		}
+		record = escaped
+	}
 	_, err := w.bw.WriteString(strings.Join(record, "\t"))
 	if err != nil {
 		return err
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/fatih/color"
+	"github.com/ipinfo/mmdbctl/lib"
+	"github.com/spf13/pflag"
 )
 
 var progBase = filepath.Base(os.Args[0])
@@ -13,6 +22,26 @@ var progBase = filepath.Base(os.Args[0])
 // global flags
 var fHelp bool
 var fNoColor bool
+var fErrFormat = errFormat("text")
+
+// errFormat is the value of the --error-format flag.
+type errFormat string
+
+func (v *errFormat) String() string {
+	return string(*v)
+}
+
+func (v *errFormat) Set(s string) error {
+	if s != "text" && s != "json" {
+		return errors.New("must be \"text\" or \"json\"")
+	}
+	*v = errFormat(s)
+	return nil
+}
+
+func (v *errFormat) Type() string {
+	return "string"
+}
 
 func main() {
 	var err error
@@ -25,23 +54,47 @@ func main() {
 
 	handleCompletions()
 
-	if len(os.Args) > 1 {
-		cmd = os.Args[1]
+	// available to all commands, and parsed along with their own flags.
+	pflag.Var(&fErrFormat, "error-format", "see description in --help")
+
+	// flag errors are returned rather than printed by pflag, so that they're
+	// reported like any other.
+	pflag.CommandLine.Init(progBase, pflag.ContinueOnError)
+	pflag.CommandLine.SetOutput(io.Discard)
+	pflag.Usage = func() {}
+
+	cmd, err = scanGlobalArgs(os.Args[1:])
+	if err != nil {
+		code := lib.ExitCode(err)
+		printErr(err, code)
+		os.Exit(code)
 	}
 
+	// cancel commands on SIGINT/SIGTERM so they can stop cleanly; restore the
+	// default handling right away so that a second signal kills immediately.
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	switch {
 	case cmd == "read":
-		err = cmdRead()
+		err = cmdRead(ctx)
 	case cmd == "import":
-		err = cmdImport()
+		err = cmdImport(ctx)
 	case cmd == "export":
-		err = cmdExport()
+		err = cmdExport(ctx)
 	case cmd == "diff":
-		err = cmdDiff()
+		err = cmdDiff(ctx)
 	case cmd == "verify":
-		err = cmdVerify()
+		err = cmdVerify(ctx)
 	case cmd == "metadata":
-		err = cmdMetadata()
+		err = cmdMetadata(ctx)
 	case cmd == "completion":
 		err = cmdCompletion()
 	default:
@@ -49,6 +102,79 @@ func main() {
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "err: %v\n", err)
+		code := lib.ExitCode(err)
+		printErr(err, code)
+		os.Exit(code)
+	}
+}
+
+// scanGlobalArgs sets --error-format from args ahead of parsing the flags of
+// the command, so that errors parsing them are printed in its format too, and
+// returns the command, which the flag may come before.
+func scanGlobalArgs(args []string) (string, error) {
+	var cmd string
+	var cmdSeen bool
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+
+		var value string
+		if v, ok := strings.CutPrefix(arg, "--error-format="); ok {
+			value = v
+		} else if arg == "--error-format" && i+1 < len(args) {
+			i++
+			value = args[i]
+		} else {
+			// the command is the first argument that isn't the flag.
+			if !cmdSeen {
+				cmd, cmdSeen = arg, true
+			}
+			continue
+		}
+		if err := fErrFormat.Set(value); err != nil {
+			return "", &lib.CmdError{
+				Code: lib.ExitUsage,
+				Err:  fmt.Errorf("invalid argument %q for \"--error-format\" flag: %w", value, err),
+			}
+		}
+	}
+	return cmd, nil
+}
+
+// parseFlags parses the flags of the command, returning an ExitUsage error for
+// invalid ones; --help without a flag of the command's own sets fHelp.
+func parseFlags() error {
+	err := pflag.CommandLine.Parse(os.Args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		// commands without a help flag of their own.
+		fHelp = true
+		return nil
+	}
+	if err != nil {
+		return &lib.CmdError{Code: lib.ExitUsage, Err: err}
+	}
+	return nil
+}
+
+// printErr reports err on stderr in the format chosen by --error-format.
+// Errors without a message, which only carry an exit code, print nothing.
+func printErr(err error, code int) {
+	msg := err.Error()
+	if msg == "" {
+		return
 	}
+
+	if fErrFormat == "json" {
+		out, _ := json.Marshal(struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+			Kind  string `json:"kind"`
+		}{msg, code, lib.ExitCodeName(code)})
+		fmt.Fprintf(os.Stderr, "%s\n", out)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "err: %v\n", err)
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestMainProcess runs main with the arguments of runMain; it does nothing
+// in a regular test run.
+func TestMainProcess(t *testing.T) {
+	args := os.Getenv("MMDBCTL_TEST_ARGS")
+	if args == "" {
+		return
+	}
+	os.Args = append([]string{"mmdbctl"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// runMain runs mmdbctl with args in a subprocess, returning its stderr and
+// exit code.
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), "MMDBCTL_TEST_ARGS="+strings.Join(args, "\n"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stderr.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stderr.String(), 0
+}
+
+func TestErrorFormat_FlagErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"export", "--bogus", "--error-format", "json", "in.mmdb"},
+		{"export", "--error-format=json", "--bogus", "in.mmdb"},
+		{"--error-format", "json", "export", "--bogus", "in.mmdb"},
+		{"export", "--workers", "abc", "--error-format", "json", "in.mmdb"},
+	} {
+		stderr, code := runMain(t, args...)
+		if code != 2 {
+			t.Errorf("%v: expected exit code 2, got %d (%s)", args, code, stderr)
+		}
+		var report struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+			Kind  string `json:"kind"`
+		}
+		if err := json.Unmarshal([]byte(stderr), &report); err != nil {
+			t.Errorf("%v: expected a JSON error, got %q", args, stderr)
+			continue
+		}
+		if report.Code != 2 || report.Kind != "usage" {
+			t.Errorf("%v: unexpected error %+v", args, report)
+		}
+	}
+
+	// the flag applies before the command too.
+	stderr, code := runMain(t, "--error-format", "json", "verify", "missing.mmdb")
+	if code != 3 || !strings.HasPrefix(stderr, "{") {
+		t.Errorf("expected a JSON I/O error, got %d (%s)", code, stderr)
+	}
+
+	stderr, code = runMain(t, "export", "--bogus", "in.mmdb")
+	if code != 2 || !strings.HasPrefix(stderr, "err: unknown flag: --bogus") {
+		t.Errorf("expected a text usage error, got %d (%s)", code, stderr)
+	}
+}